@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffStrategy calculates how long to wait before retrying a Task that returned a queue.Error
+type BackoffStrategy interface {
+
+	// Backoff returns the delay before the next attempt, given the number of times the Task has already been retried
+	Backoff(retryCount int) time.Duration
+}
+
+// BackoffFunc is an adapter that allows an ordinary function to be used as a BackoffStrategy
+type BackoffFunc func(retryCount int) time.Duration
+
+// Backoff implements the BackoffStrategy interface
+func (f BackoffFunc) Backoff(retryCount int) time.Duration {
+	return f(retryCount)
+}
+
+// ExponentialBackoff waits Base * Factor^retryCount between attempts, up to Max
+type ExponentialBackoff struct {
+	Base   time.Duration // Delay before the first retry
+	Factor float64       // Multiplier applied to the delay for each subsequent retry
+	Max    time.Duration // Longest possible delay. Zero means no limit (other than overflow)
+}
+
+// NewExponentialBackoff returns a fully initialized ExponentialBackoff strategy
+func NewExponentialBackoff(base time.Duration, factor float64, maximum time.Duration) ExponentialBackoff {
+	return ExponentialBackoff{
+		Base:   base,
+		Factor: factor,
+		Max:    maximum,
+	}
+}
+
+// Backoff implements the BackoffStrategy interface
+func (strategy ExponentialBackoff) Backoff(retryCount int) time.Duration {
+	return capDuration(float64(strategy.Base)*math.Pow(strategy.Factor, float64(max(retryCount, 0))), strategy.Max)
+}
+
+// LinearBackoff waits Base + (Increment * retryCount) between attempts, up to Max
+type LinearBackoff struct {
+	Base      time.Duration // Delay before the first retry
+	Increment time.Duration // Amount added to the delay for each subsequent retry
+	Max       time.Duration // Longest possible delay. Zero means no limit (other than overflow)
+}
+
+// NewLinearBackoff returns a fully initialized LinearBackoff strategy
+func NewLinearBackoff(base time.Duration, increment time.Duration, maximum time.Duration) LinearBackoff {
+	return LinearBackoff{
+		Base:      base,
+		Increment: increment,
+		Max:       maximum,
+	}
+}
+
+// Backoff implements the BackoffStrategy interface
+func (strategy LinearBackoff) Backoff(retryCount int) time.Duration {
+	return capDuration(float64(strategy.Base)+float64(strategy.Increment)*float64(max(retryCount, 0)), strategy.Max)
+}
+
+// ConstantBackoff waits the same amount of time between every attempt
+type ConstantBackoff struct {
+	Delay time.Duration // Delay before every retry
+}
+
+// NewConstantBackoff returns a fully initialized ConstantBackoff strategy
+func NewConstantBackoff(delay time.Duration) ConstantBackoff {
+	return ConstantBackoff{
+		Delay: delay,
+	}
+}
+
+// Backoff implements the BackoffStrategy interface
+func (strategy ConstantBackoff) Backoff(_ int) time.Duration {
+	return strategy.Delay
+}
+
+// DecorrelatedJitterBackoff waits a random delay between Base and three times the
+// previous delay, up to Max. This spreads out retries from many tasks that failed
+// at the same moment. Tasks do not remember their previous delay, so this
+// strategy uses the largest possible previous delay (Base * 3^(retryCount-1)).
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration // Shortest possible delay
+	Max  time.Duration // Longest possible delay. Zero means no limit (other than overflow)
+}
+
+// NewDecorrelatedJitterBackoff returns a fully initialized DecorrelatedJitterBackoff strategy
+func NewDecorrelatedJitterBackoff(base time.Duration, maximum time.Duration) DecorrelatedJitterBackoff {
+	return DecorrelatedJitterBackoff{
+		Base: base,
+		Max:  maximum,
+	}
+}
+
+// Backoff implements the BackoffStrategy interface
+func (strategy DecorrelatedJitterBackoff) Backoff(retryCount int) time.Duration {
+
+	lower := capDuration(float64(strategy.Base), strategy.Max)
+	upper := capDuration(float64(strategy.Base)*math.Pow(3, float64(max(retryCount, 0))), strategy.Max)
+
+	if upper <= lower {
+		return lower
+	}
+
+	return lower + rand.N(upper-lower+1) // #nosec G404 -- jitter does not need a secure random number
+}
+
+// FibonacciBackoff waits Base * Fibonacci(retryCount+1) between attempts (1, 1, 2, 3, 5, 8...), up to Max.
+// This grows more gently than an ExponentialBackoff.
+type FibonacciBackoff struct {
+	Base time.Duration // Delay before the first retry
+	Max  time.Duration // Longest possible delay. Zero means no limit (other than overflow)
+}
+
+// NewFibonacciBackoff returns a fully initialized FibonacciBackoff strategy
+func NewFibonacciBackoff(base time.Duration, maximum time.Duration) FibonacciBackoff {
+	return FibonacciBackoff{
+		Base: base,
+		Max:  maximum,
+	}
+}
+
+// Backoff implements the BackoffStrategy interface
+func (strategy FibonacciBackoff) Backoff(retryCount int) time.Duration {
+
+	previous, current := 0.0, 1.0
+
+	for i := 0; i < retryCount; i++ {
+		previous, current = current, previous+current
+
+		// Stop early once the delay is already out of range
+		if float64(strategy.Base)*current >= math.MaxInt64 {
+			break
+		}
+	}
+
+	return capDuration(float64(strategy.Base)*current, strategy.Max)
+}
+
+// capDuration converts a (possibly enormous) floating point number of nanoseconds into
+// a time.Duration, clamping it to maximum (if set) and to the largest value that time.Duration can hold.
+func capDuration(nanoseconds float64, maximum time.Duration) time.Duration {
+
+	if (maximum > 0) && (nanoseconds >= float64(maximum)) {
+		return maximum
+	}
+
+	if math.IsNaN(nanoseconds) || (nanoseconds <= 0) {
+		return 0
+	}
+
+	if nanoseconds >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(nanoseconds)
+}
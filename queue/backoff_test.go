@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+
+	strategy := NewExponentialBackoff(time.Second, 3, time.Minute)
+
+	require.Equal(t, time.Second, strategy.Backoff(0))
+	require.Equal(t, 3*time.Second, strategy.Backoff(1))
+	require.Equal(t, 9*time.Second, strategy.Backoff(2))
+	require.Equal(t, 27*time.Second, strategy.Backoff(3))
+	require.Equal(t, time.Minute, strategy.Backoff(4)) // capped
+	require.Equal(t, time.Minute, strategy.Backoff(1000))
+}
+
+func TestExponentialBackoff_NoMaxDoesNotOverflow(t *testing.T) {
+
+	strategy := NewExponentialBackoff(time.Minute, 2, 0)
+
+	// Without a Max, enormous delays clamp to the largest time.Duration instead of wrapping negative
+	require.Equal(t, time.Duration(math.MaxInt64), strategy.Backoff(1000))
+}
+
+func TestExponentialBackoff_MatchesDefault(t *testing.T) {
+
+	// The default backoff is an exponential backoff of 2^retryCount minutes
+	strategy := NewExponentialBackoff(time.Minute, 2, 0)
+
+	for retryCount := 0; retryCount <= maxBackoffExponent; retryCount++ {
+		require.Equal(t, backoff(retryCount), strategy.Backoff(retryCount))
+	}
+}
+
+func TestLinearBackoff(t *testing.T) {
+
+	strategy := NewLinearBackoff(10*time.Second, 5*time.Second, 30*time.Second)
+
+	require.Equal(t, 10*time.Second, strategy.Backoff(0))
+	require.Equal(t, 15*time.Second, strategy.Backoff(1))
+	require.Equal(t, 20*time.Second, strategy.Backoff(2))
+	require.Equal(t, 30*time.Second, strategy.Backoff(4))
+	require.Equal(t, 30*time.Second, strategy.Backoff(5)) // capped
+}
+
+func TestConstantBackoff(t *testing.T) {
+
+	strategy := NewConstantBackoff(45 * time.Second)
+
+	require.Equal(t, 45*time.Second, strategy.Backoff(0))
+	require.Equal(t, 45*time.Second, strategy.Backoff(10))
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+
+	strategy := NewDecorrelatedJitterBackoff(time.Second, time.Minute)
+
+	// The first retry always waits exactly Base
+	require.Equal(t, time.Second, strategy.Backoff(0))
+
+	// Later retries fall between Base and Base * 3^retryCount (capped at Max)
+	for i := 0; i < 100; i++ {
+		delay := strategy.Backoff(2)
+		require.GreaterOrEqual(t, delay, time.Second)
+		require.LessOrEqual(t, delay, 9*time.Second)
+
+		delay = strategy.Backoff(10)
+		require.GreaterOrEqual(t, delay, time.Second)
+		require.LessOrEqual(t, delay, time.Minute)
+	}
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+
+	strategy := NewFibonacciBackoff(time.Second, 10*time.Second)
+
+	require.Equal(t, 1*time.Second, strategy.Backoff(0))
+	require.Equal(t, 1*time.Second, strategy.Backoff(1))
+	require.Equal(t, 2*time.Second, strategy.Backoff(2))
+	require.Equal(t, 3*time.Second, strategy.Backoff(3))
+	require.Equal(t, 5*time.Second, strategy.Backoff(4))
+	require.Equal(t, 8*time.Second, strategy.Backoff(5))
+	require.Equal(t, 10*time.Second, strategy.Backoff(6)) // capped
+	require.Equal(t, 10*time.Second, strategy.Backoff(10000))
+}
+
+func TestBackoffFunc(t *testing.T) {
+
+	strategy := BackoffFunc(func(retryCount int) time.Duration {
+		return time.Duration(retryCount) * time.Hour
+	})
+
+	require.Equal(t, 3*time.Hour, strategy.Backoff(3))
+}
+
+func TestRetryDelay(t *testing.T) {
+
+	q := New(
+		WithDefaultBackoff(NewConstantBackoff(time.Minute)),
+		WithBackoffStrategy("webhook", NewConstantBackoff(5*time.Second)),
+	)
+
+	// Tasks use their named strategy...
+	require.Equal(t, 5*time.Second, q.retryDelay(Task{Backoff: "webhook", RetryCount: 3}))
+
+	// ...or the Queue's default if they name none, or one that isn't registered
+	require.Equal(t, time.Minute, q.retryDelay(Task{RetryCount: 3}))
+	require.Equal(t, time.Minute, q.retryDelay(Task{Backoff: "unknown", RetryCount: 3}))
+}
+
+func TestOnTaskError_UsesBackoffStrategy(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(
+		WithStorage(storage),
+		WithBackoffStrategy("fast", NewConstantBackoff(time.Second)),
+		WithConsumers(func(string, map[string]any) Result {
+			return Error(nil)
+		}),
+	)
+
+	// The retry is scheduled using the task's own strategy, not the hour-long default
+	before := time.Now().Unix()
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 10, RetryCount: 6, Backoff: "fast"}))
+
+	require.Equal(t, 1, len(storage.saved))
+	require.InDelta(t, before+1, storage.saved[0].StartDate, 1)
+}
@@ -0,0 +1,246 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/rosetta/mapof"
+	"github.com/rs/zerolog/log"
+)
+
+// Batch is a group of Tasks that are published together.  Once every Task in the
+// Batch has finally succeeded or failed, the Batch's OnComplete Task is published,
+// with the results in its Arguments ("batchId", "total", "succeeded", "failed").
+type Batch struct {
+	BatchID    string // Unique identifier for this Batch
+	OnComplete Task   // Task to publish once every Task in the Batch has finished
+	tasks      []Task
+}
+
+// NewBatch returns a new, empty Batch that publishes `onComplete` when it finishes
+func NewBatch(onComplete Task) *Batch {
+	return &Batch{
+		BatchID:    newTaskID(),
+		OnComplete: onComplete,
+		tasks:      make([]Task, 0),
+	}
+}
+
+// Add includes one or more Tasks in the Batch
+func (batch *Batch) Add(tasks ...Task) {
+	batch.tasks = append(batch.tasks, tasks...)
+}
+
+// Tasks returns all of the Tasks in the Batch, in the order that they were added.
+func (batch *Batch) Tasks() []Task {
+	return batch.tasks
+}
+
+// BatchStatus counts the finished Tasks in a Batch
+type BatchStatus struct {
+	BatchID    string `bson:"_id"`        // Unique identifier for the Batch
+	Total      int    `bson:"total"`      // Number of Tasks in the Batch
+	Succeeded  int    `bson:"succeeded"`  // Number of Tasks that have succeeded
+	Failed     int    `bson:"failed"`     // Number of Tasks that have failed permanently
+	OnComplete Task   `bson:"onComplete"` // Task to publish once every Task in the Batch has finished
+}
+
+// Done returns TRUE if every Task in the Batch has finished
+func (status BatchStatus) Done() bool {
+	return status.Succeeded+status.Failed >= status.Total
+}
+
+// PublishBatch adds every Task in a Batch to the Queue.  The Batch is recorded
+// first, so that its counts are ready before any of its Tasks can finish.
+// An empty Batch publishes its OnComplete Task right away.
+func (q *Queue) PublishBatch(batch *Batch) error {
+
+	const location = "queue.Queue.PublishBatch"
+
+	tracker := q.batchTracker()
+
+	if tracker == nil {
+		return derp.Internal(location, "Storage provider does not support batches")
+	}
+
+	// RULE: Every task must finish exactly once, so signed tasks (which may be
+	// dropped as duplicates) and recurring tasks (which never finish) are not allowed
+	for _, task := range batch.tasks {
+
+		if task.Signature != "" {
+			return derp.BadRequest(location, "Signed tasks cannot be added to a batch", task.Name, task.Signature)
+		}
+
+		if task.Cron != "" {
+			return derp.BadRequest(location, "Recurring tasks cannot be added to a batch", task.Name)
+		}
+	}
+
+	status := BatchStatus{
+		BatchID:    batch.BatchID,
+		Total:      len(batch.tasks),
+		OnComplete: batch.OnComplete,
+	}
+
+	if status.Total == 0 {
+		return q.publishBatchComplete(status)
+	}
+
+	if err := tracker.CreateBatch(status); err != nil {
+		return derp.Wrap(err, location, "Unable to create batch", batch.BatchID)
+	}
+
+	for _, task := range batch.tasks {
+
+		task.BatchID = batch.BatchID
+
+		if err := q.Publish(task); err != nil {
+			return derp.Wrap(err, location, "Unable to publish batch task", batch.BatchID, task.Name)
+		}
+	}
+
+	return nil
+}
+
+// onBatchTaskFinished counts a finished Task in its Batch, and publishes the
+// Batch's OnComplete Task if this was the last one.
+func (q *Queue) onBatchTaskFinished(task Task, succeeded bool) error {
+
+	const location = "queue.onBatchTaskFinished"
+
+	if task.BatchID == "" {
+		return nil
+	}
+
+	tracker := q.batchTracker()
+
+	if tracker == nil {
+		return derp.Internal(location, "Storage provider does not support batches", task.BatchID)
+	}
+
+	status, err := tracker.CompleteBatchTask(task.BatchID, task.TaskID, succeeded)
+
+	// Batches are removed once they are complete, so a Task that runs again after
+	// its Batch finished has nothing left to count
+	if derp.IsNotFound(err) {
+		log.Trace().Str("location", location).Str("batchId", task.BatchID).Msg("Batch already complete")
+		return nil
+	}
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to update batch", task.BatchID)
+	}
+
+	if !status.Done() {
+		return nil
+	}
+
+	return q.publishBatchComplete(status)
+}
+
+// publishBatchComplete publishes the OnComplete Task for a finished Batch
+func (q *Queue) publishBatchComplete(status BatchStatus) error {
+
+	const location = "queue.publishBatchComplete"
+
+	task := status.OnComplete
+
+	// Copy the arguments, so that the original Task is not modified
+	arguments := mapof.NewAny()
+	for key, value := range task.Arguments {
+		arguments[key] = value
+	}
+
+	arguments["batchId"] = status.BatchID
+	arguments["total"] = status.Total
+	arguments["succeeded"] = status.Succeeded
+	arguments["failed"] = status.Failed
+	task.Arguments = arguments
+
+	if err := q.Publish(task); err != nil {
+		return derp.Wrap(err, location, "Unable to publish batch completion task", status.BatchID)
+	}
+
+	return nil
+}
+
+// batchTracker returns the BatchTracker for this Queue: the Storage provider
+// (if it supports batches), or an in-memory tracker if there is no Storage.
+func (q *Queue) batchTracker() BatchTracker {
+
+	if q.storage == nil {
+		return q.memoryBatches
+	}
+
+	if tracker, ok := q.storage.(BatchTracker); ok {
+		return tracker
+	}
+
+	return nil
+}
+
+// memoryBatchTracker counts Batches for Queues that have no Storage provider
+type memoryBatchTracker struct {
+	mutex    sync.Mutex
+	batches  map[string]BatchStatus
+	finished map[string]map[string]bool // TaskIDs that have been counted, by BatchID
+}
+
+func newMemoryBatchTracker() *memoryBatchTracker {
+	return &memoryBatchTracker{
+		batches:  make(map[string]BatchStatus),
+		finished: make(map[string]map[string]bool),
+	}
+}
+
+// CreateBatch implements the BatchTracker interface
+func (tracker *memoryBatchTracker) CreateBatch(status BatchStatus) error {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.batches[status.BatchID] = status
+	tracker.finished[status.BatchID] = make(map[string]bool)
+	return nil
+}
+
+// CompleteBatchTask implements the BatchTracker interface
+func (tracker *memoryBatchTracker) CompleteBatchTask(batchID string, taskID string, succeeded bool) (BatchStatus, error) {
+
+	const location = "queue.memoryBatchTracker.CompleteBatchTask"
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	status, exists := tracker.batches[batchID]
+
+	if !exists {
+		return BatchStatus{}, derp.NotFound(location, "Batch not found", batchID)
+	}
+
+	// Tasks that have already been counted are not counted again
+	if taskID != "" {
+
+		if tracker.finished[batchID][taskID] {
+			return status, nil
+		}
+
+		tracker.finished[batchID][taskID] = true
+	}
+
+	if succeeded {
+		status.Succeeded++
+	} else {
+		status.Failed++
+	}
+
+	// Forget finished batches, so that they are only completed once
+	if status.Done() {
+		delete(tracker.batches, batchID)
+		delete(tracker.finished, batchID)
+	} else {
+		tracker.batches[batchID] = status
+	}
+
+	return status, nil
+}
@@ -0,0 +1,238 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// batchStorage is a mockStorage that also implements BatchTracker
+type batchStorage struct {
+	mockStorage
+	tracker  *memoryBatchTracker
+	batchErr error
+}
+
+func newBatchStorage() *batchStorage {
+	return &batchStorage{tracker: newMemoryBatchTracker()}
+}
+
+func (s *batchStorage) CreateBatch(status BatchStatus) error {
+	return s.tracker.CreateBatch(status)
+}
+
+func (s *batchStorage) CompleteBatchTask(batchID string, taskID string, succeeded bool) (BatchStatus, error) {
+	if s.batchErr != nil {
+		return BatchStatus{}, s.batchErr
+	}
+	return s.tracker.CompleteBatchTask(batchID, taskID, succeeded)
+}
+
+func TestBatch_Add(t *testing.T) {
+
+	batch := NewBatch(NewTask("done", nil))
+	batch.Add(NewTask("a", nil), NewTask("b", nil))
+	batch.Add(NewTask("c", nil))
+
+	require.Len(t, batch.BatchID, 24)
+	require.Len(t, batch.Tasks(), 3)
+	require.Equal(t, "done", batch.OnComplete.Name)
+}
+
+func TestBatchStatus_Done(t *testing.T) {
+	require.False(t, BatchStatus{Total: 3, Succeeded: 1, Failed: 1}.Done())
+	require.True(t, BatchStatus{Total: 3, Succeeded: 2, Failed: 1}.Done())
+	require.True(t, BatchStatus{Total: 0}.Done())
+}
+
+func TestPublishBatch_MemoryQueue(t *testing.T) {
+
+	completed := make(chan map[string]any, 1)
+
+	q := New(WithWorkerCount(4), WithConsumers(func(name string, args map[string]any) Result {
+		switch name {
+		case "follower":
+			if args["fail"] == true {
+				return Failure(errors.New("unreachable"))
+			}
+			return Success()
+
+		case "done":
+			completed <- args
+			return Success()
+		}
+		return Ignored()
+	}))
+
+	q.Start()
+	defer q.Stop()
+
+	batch := NewBatch(NewTask("done", map[string]any{"activity": "123"}))
+	for index := 0; index < 10; index++ {
+		batch.Add(NewTask("follower", map[string]any{"fail": index%5 == 0}))
+	}
+
+	require.NoError(t, q.PublishBatch(batch))
+
+	select {
+	case args := <-completed:
+		require.Equal(t, "123", args["activity"])
+		require.Equal(t, batch.BatchID, args["batchId"])
+		require.Equal(t, 10, args["total"])
+		require.Equal(t, 8, args["succeeded"])
+		require.Equal(t, 2, args["failed"])
+
+	case <-time.After(time.Second):
+		t.Fatal("OnComplete task was not published")
+	}
+
+	// The OnComplete task is published exactly once
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, completed)
+}
+
+func TestPublishBatch_Storage(t *testing.T) {
+
+	storage := newBatchStorage()
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	batch := NewBatch(NewTask("done", nil))
+	batch.Add(NewTask("a", nil), NewTask("b", nil))
+	require.NoError(t, q.PublishBatch(batch))
+
+	// Every task is saved with the BatchID
+	require.Len(t, storage.saved, 2)
+	require.Equal(t, batch.BatchID, storage.saved[0].BatchID)
+	require.Equal(t, batch.BatchID, storage.saved[1].BatchID)
+
+	// The OnComplete task is only published after the last task finishes
+	require.NoError(t, q.consume(storage.saved[0]))
+	require.Len(t, storage.saved, 2)
+
+	require.NoError(t, q.consume(storage.saved[1]))
+	require.Len(t, storage.saved, 3)
+	require.Equal(t, "done", storage.saved[2].Name)
+	require.Equal(t, 2, storage.saved[2].Arguments["succeeded"])
+	require.Equal(t, 0, storage.saved[2].Arguments["failed"])
+}
+
+func TestPublishBatch_RetriesAreNotCounted(t *testing.T) {
+
+	storage := newBatchStorage()
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1), WithConsumers(func(string, map[string]any) Result {
+		return Error(errors.New("temporary"))
+	}))
+
+	batch := NewBatch(NewTask("done", nil))
+	batch.Add(NewTask("a", nil, WithRetryMax(1)))
+	require.NoError(t, q.PublishBatch(batch))
+
+	// The first error is retried, and does not count...
+	require.NoError(t, q.consume(storage.saved[0]))
+	require.Len(t, storage.saved, 2)
+
+	// ...but running out of retries counts as a failure
+	require.NoError(t, q.consume(storage.saved[1]))
+	require.Len(t, storage.saved, 3)
+	require.Equal(t, 1, storage.saved[2].Arguments["failed"])
+}
+
+func TestBatch_FailedUpdateKeepsTask(t *testing.T) {
+
+	storage := newBatchStorage()
+	storage.batchErr = errors.New("unavailable")
+	q := New(WithStorage(storage))
+
+	// The batch can't be updated...
+	task := Task{TaskID: "1", Name: "a", BatchID: "batch"}
+	require.Error(t, q.onTaskSucceeded(task))
+	require.Error(t, q.onTaskFailure(task, errors.New("failed")))
+
+	// ...and the task stays in storage, so its completion isn't lost
+	require.Empty(t, storage.deleted)
+}
+
+func TestBatch_RerunIsCountedOnce(t *testing.T) {
+
+	storage := newBatchStorage()
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1))
+	require.NoError(t, storage.CreateBatch(BatchStatus{BatchID: "batch", Total: 2, OnComplete: NewTask("done", nil)}))
+
+	// The first task is counted, but can't be removed, so it will run again...
+	first := Task{TaskID: "1", Name: "a", BatchID: "batch"}
+	storage.deleteErr = errors.New("unavailable")
+	require.Error(t, q.onTaskSucceeded(first))
+
+	// ...and the second run is not counted again, so the batch is not done yet
+	storage.deleteErr = nil
+	require.NoError(t, q.onTaskSucceeded(first))
+	require.Empty(t, storage.saved)
+
+	// The real last task completes the batch
+	require.NoError(t, q.onTaskSucceeded(Task{TaskID: "2", Name: "b", BatchID: "batch"}))
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, "done", storage.saved[0].Name)
+	require.Equal(t, 2, storage.saved[0].Arguments["succeeded"])
+
+	// A task that runs again after its batch is complete has nothing left to count
+	require.NoError(t, q.onTaskSucceeded(Task{TaskID: "2", Name: "b", BatchID: "batch"}))
+	require.Len(t, storage.saved, 1)
+}
+
+func TestPublishBatch_Empty(t *testing.T) {
+
+	// An empty batch is complete as soon as it is published
+	q := New()
+	require.NoError(t, q.PublishBatch(NewBatch(NewTask("done", nil))))
+	require.Len(t, q.buffer, 1)
+
+	task := <-q.buffer
+	require.Equal(t, 0, task.Arguments["total"])
+}
+
+func TestPublishBatch_Unsupported(t *testing.T) {
+	q := New(WithStorage(&mockStorage{}))
+	require.Error(t, q.PublishBatch(NewBatch(NewTask("done", nil))))
+}
+
+func TestPublishBatch_InvalidTasks(t *testing.T) {
+
+	q := New()
+
+	signed := NewBatch(NewTask("done", nil))
+	signed.Add(NewTask("a", nil, WithSignature("sig")))
+	require.Error(t, q.PublishBatch(signed))
+
+	recurring := NewBatch(NewTask("done", nil))
+	recurring.Add(NewTask("a", nil, WithCron("@daily")))
+	require.Error(t, q.PublishBatch(recurring))
+
+	require.Empty(t, q.buffer)
+}
+
+func TestRequeue_LeavesBatch(t *testing.T) {
+
+	storage := newBatchStorage()
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1), WithConsumers(func(string, map[string]any) Result {
+		return Requeue(time.Minute)
+	}))
+
+	batch := NewBatch(NewTask("done", nil))
+	batch.Add(NewTask("a", nil))
+	require.NoError(t, q.PublishBatch(batch))
+
+	// The original task completes the batch; the new copy is not part of it
+	require.NoError(t, q.consume(storage.saved[0]))
+	require.Len(t, storage.saved, 3)
+	require.Equal(t, "done", storage.saved[1].Name)
+	require.Empty(t, storage.saved[2].BatchID)
+}
+
+func TestMemoryBatchTracker_NotFound(t *testing.T) {
+	_, err := newMemoryBatchTracker().CompleteBatchTask("missing", "", true)
+	require.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"github.com/benpate/derp"
+	"github.com/benpate/rosetta/mapof"
+)
+
+// NewChain links a series of Tasks into a linear pipeline, and returns the first
+// one, which is published like any other Task.  Each Task runs only after the
+// previous one succeeds, and receives the previous Task's output (from SuccessWith)
+// merged into its Arguments.  If any step fails, then the rest of the Chain is dropped.
+func NewChain(first Task, next ...Task) Task {
+	first.Next = append(first.Next, next...)
+	return first
+}
+
+// publishNext publishes the next Task in a Chain, after the current Task succeeds.
+// Values in the output replace Arguments of the same name in the next Task.
+func (q *Queue) publishNext(task Task, output mapof.Any) error {
+
+	const location = "queue.publishNext"
+
+	if len(task.Next) == 0 {
+		return nil
+	}
+
+	next := task.Next[0]
+	next.Next = append(next.Next, task.Next[1:]...)
+
+	// Copy the arguments, so that the original Task is not modified
+	arguments := mapof.NewAny()
+
+	for key, value := range next.Arguments {
+		arguments[key] = value
+	}
+
+	for key, value := range output {
+		arguments[key] = value
+	}
+
+	next.Arguments = arguments
+
+	if err := q.Publish(next); err != nil {
+		return derp.Wrap(err, location, "Unable to publish next task in chain", task.Name, next.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChain(t *testing.T) {
+
+	chain := NewChain(NewTask("fetch", nil), NewTask("parse", nil), NewTask("index", nil))
+
+	require.Equal(t, "fetch", chain.Name)
+	require.Len(t, chain.Next, 2)
+	require.Equal(t, "parse", chain.Next[0].Name)
+	require.Equal(t, "index", chain.Next[1].Name)
+}
+
+func TestChain_MemoryQueue(t *testing.T) {
+
+	indexed := make(chan map[string]any, 1)
+
+	q := New(WithConsumers(func(name string, args map[string]any) Result {
+		switch name {
+
+		case "fetch":
+			return SuccessWith(map[string]any{"body": "<html>" + args["url"].(string) + "</html>"})
+
+		case "parse":
+			return SuccessWith(map[string]any{"title": "Parsed " + args["body"].(string)})
+
+		case "index":
+			indexed <- args
+			return Success()
+		}
+
+		return Ignored()
+	}))
+
+	q.Start()
+	defer q.Stop()
+
+	chain := NewChain(
+		NewTask("fetch", map[string]any{"url": "example.com"}),
+		NewTask("parse", nil),
+		NewTask("index", map[string]any{"index": "pages"}),
+	)
+
+	require.NoError(t, q.Publish(chain))
+
+	select {
+	case args := <-indexed:
+		// Each step receives its own arguments, plus the previous step's output
+		require.Equal(t, "pages", args["index"])
+		require.Equal(t, "Parsed <html>example.com</html>", args["title"])
+		require.Nil(t, args["body"])
+
+	case <-time.After(time.Second):
+		t.Fatal("chain did not finish")
+	}
+}
+
+func TestChain_PublishesNextOnSuccess(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1), WithConsumers(func(string, map[string]any) Result {
+		return SuccessWith(map[string]any{"id": 42, "shared": "output"})
+	}))
+
+	chain := NewChain(
+		Task{TaskID: "abc", Name: "first"},
+		Task{Name: "second", Arguments: map[string]any{"shared": "argument", "own": true}, RetryMax: -1, Priority: -1},
+		Task{Name: "third"},
+	)
+
+	require.NoError(t, q.consume(chain))
+
+	// The next step is saved before the current one is removed
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, []string{"abc"}, storage.deleted)
+
+	next := storage.saved[0]
+	require.Equal(t, "second", next.Name)
+	require.Equal(t, 42, next.Arguments["id"])
+	require.Equal(t, "output", next.Arguments["shared"]) // output wins
+	require.Equal(t, true, next.Arguments["own"])
+	require.Len(t, next.Next, 1)
+	require.Equal(t, "third", next.Next[0].Name)
+
+	// The original chain is not modified
+	require.Equal(t, "argument", chain.Next[0].Arguments["shared"])
+}
+
+func TestChain_StopsOnFailure(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Failure(errors.New("permanent"))
+	}))
+
+	require.NoError(t, q.consume(NewChain(Task{TaskID: "abc", Name: "first"}, Task{Name: "second"})))
+	require.Empty(t, storage.saved)
+	require.Len(t, storage.failures, 1)
+}
+
+func TestChain_RetriesKeepTheChain(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Error(errors.New("temporary"))
+	}))
+
+	// A retried step is saved with the rest of its chain intact
+	require.NoError(t, q.consume(NewChain(Task{TaskID: "abc", Name: "first", RetryMax: 3}, Task{Name: "second"})))
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, "first", storage.saved[0].Name)
+	require.Len(t, storage.saved[0].Next, 1)
+}
+
+func TestChain_PublishError(t *testing.T) {
+
+	storage := &mockStorage{saveErr: errors.New("db down")}
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	// If the next step can't be saved, then the current one is kept so it can run again
+	require.Error(t, q.consume(NewChain(Task{TaskID: "abc", Name: "first"}, Task{Name: "second"})))
+	require.Empty(t, storage.deleted)
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// concurrencySnoozeDelay is how long a task waits in storage when too many tasks
+// with the same name are already running or held on this node.
+const concurrencySnoozeDelay = 5 * time.Second
+
+// admission describes what a worker should do with a task, given the concurrency limits
+type admission int
+
+const (
+	admitRun      admission = iota // run the task now
+	admitHeld                      // the task is held in memory, and will be run by the worker that frees a slot
+	admitOverflow                  // too many tasks are already held, so the task must go back to storage
+)
+
+// concurrencyLimiter caps the number of tasks with the same name that run at
+// once on this node.  Tasks over the limit are held in memory (up to the limit
+// again) and handed directly to the worker that frees the next slot, so that
+// they never block a worker while they wait.  Held tasks keep their storage
+// lease alive with a heartbeat, so they aren't reclaimed by another node.
+type concurrencyLimiter struct {
+	mutex     sync.Mutex
+	limits    map[string]int         // maximum number of concurrent tasks, by name
+	running   map[string]int         // number of tasks currently running, by name (limited or not)
+	held      map[string][]heldTask  // tasks waiting for a free slot, by name
+	heartbeat func(task Task) func() // starts extending a held task's lease, and returns a function that stops it
+}
+
+// heldTask is a task waiting for a free slot, along with its lease heartbeat
+type heldTask struct {
+	task          Task
+	stopHeartbeat func()
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{
+		limits:    make(map[string]int),
+		running:   make(map[string]int),
+		held:      make(map[string][]heldTask),
+		heartbeat: func(Task) func() { return func() {} },
+	}
+}
+
+// setLimit sets the maximum number of concurrent tasks with the given name.
+// Limits below one remove the limit.
+func (limiter *concurrencyLimiter) setLimit(name string, limit int) {
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limit < 1 {
+		delete(limiter.limits, name)
+		return
+	}
+
+	limiter.limits[name] = limit
+}
+
+// admit decides whether a task can run now.  If it can, then a slot is taken,
+// which MUST be returned by calling release when the task is finished.
+// If holdAll is TRUE, then tasks over the limit are always held in memory.
+func (limiter *concurrencyLimiter) admit(task Task, holdAll bool) admission {
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Unlimited tasks are counted too, so that a limit set later sees them
+	limit, limited := limiter.limits[task.Name]
+
+	if !limited || limiter.running[task.Name] < limit {
+		limiter.running[task.Name]++
+		return admitRun
+	}
+
+	if holdAll || len(limiter.held[task.Name]) < limit {
+		limiter.held[task.Name] = append(limiter.held[task.Name], heldTask{
+			task:          task,
+			stopHeartbeat: limiter.heartbeat(task),
+		})
+		return admitHeld
+	}
+
+	return admitOverflow
+}
+
+// release returns a slot when a task finishes.  If handOver is TRUE and another
+// task with the same name is being held, then the slot is kept, and the held task
+// is returned for the caller to run next.
+func (limiter *concurrencyLimiter) release(name string, handOver bool) (Task, bool) {
+
+	limiter.mutex.Lock()
+
+	if held := limiter.held[name]; handOver && len(held) > 0 {
+		limiter.held[name] = held[1:]
+		limiter.mutex.Unlock()
+
+		// The caller runs the task next, with a heartbeat of its own.  Stop this one
+		// outside of the mutex, because it may be waiting on the storage provider.
+		held[0].stopHeartbeat()
+		return held[0].task, true
+	}
+
+	limiter.running[name]--
+
+	if limiter.running[name] <= 0 {
+		delete(limiter.running, name)
+	}
+
+	limiter.mutex.Unlock()
+	return Task{}, false
+}
+
+// drain removes and returns every held task
+func (limiter *concurrencyLimiter) drain() []Task {
+
+	limiter.mutex.Lock()
+
+	drained := make([]heldTask, 0)
+
+	for name, held := range limiter.held {
+		drained = append(drained, held...)
+		delete(limiter.held, name)
+	}
+
+	limiter.mutex.Unlock()
+
+	result := make([]Task, len(drained))
+
+	for index, held := range drained {
+		held.stopHeartbeat()
+		result[index] = held.task
+	}
+
+	return result
+}
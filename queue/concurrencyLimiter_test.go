@@ -0,0 +1,271 @@
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter_Unlimited(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+
+	for i := 0; i < 100; i++ {
+		require.Equal(t, admitRun, limiter.admit(Task{Name: "x"}, false))
+	}
+
+	for i := 0; i < 100; i++ {
+		_, ok := limiter.release("x", true)
+		require.False(t, ok)
+	}
+
+	// Every slot was returned, so nothing is left to leak
+	require.Empty(t, limiter.running)
+}
+
+func TestConcurrencyLimiter_LimitSetLater(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+
+	// Tasks that started without a limit still count against one set later
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+
+	limiter.setLimit("email", 2)
+	require.Equal(t, admitHeld, limiter.admit(Task{Name: "email", TaskID: "3"}, false))
+
+	// The held task takes over a slot, then every slot is returned
+	next, ok := limiter.release("email", true)
+	require.True(t, ok)
+	require.Equal(t, "3", next.TaskID)
+
+	for i := 0; i < 2; i++ {
+		_, ok = limiter.release("email", true)
+		require.False(t, ok)
+	}
+
+	require.Empty(t, limiter.running)
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+}
+
+func TestConcurrencyLimiter_HoldAndHandOver(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+	limiter.setLimit("email", 1)
+
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email", TaskID: "1"}, false))
+	require.Equal(t, admitHeld, limiter.admit(Task{Name: "email", TaskID: "2"}, false))
+	require.Equal(t, admitOverflow, limiter.admit(Task{Name: "email", TaskID: "3"}, false))
+
+	// Other names are not affected
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "other"}, false))
+
+	// The finishing worker keeps the slot and runs the held task
+	next, ok := limiter.release("email", true)
+	require.True(t, ok)
+	require.Equal(t, "2", next.TaskID)
+
+	// Then the slot is returned
+	_, ok = limiter.release("email", true)
+	require.False(t, ok)
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+}
+
+func TestConcurrencyLimiter_HoldAll(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+	limiter.setLimit("email", 1)
+
+	// Without storage, there is nowhere else to put tasks, so they are all held
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, true))
+	for i := 0; i < 10; i++ {
+		require.Equal(t, admitHeld, limiter.admit(Task{Name: "email"}, true))
+	}
+
+	require.Len(t, limiter.drain(), 10)
+	require.Empty(t, limiter.drain())
+}
+
+func TestConcurrencyLimiter_NoHandOver(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+	limiter.setLimit("email", 1)
+
+	limiter.admit(Task{Name: "email"}, false)
+	limiter.admit(Task{Name: "email"}, false)
+
+	// When the Queue is stopping, held tasks stay put so they can be released
+	_, ok := limiter.release("email", false)
+	require.False(t, ok)
+	require.Len(t, limiter.drain(), 1)
+}
+
+func TestConcurrencyLimiter_RemoveLimit(t *testing.T) {
+
+	limiter := newConcurrencyLimiter()
+	limiter.setLimit("email", 1)
+	limiter.setLimit("email", 0)
+
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+	require.Equal(t, admitRun, limiter.admit(Task{Name: "email"}, false))
+}
+
+func TestConcurrencyLimit_Queue(t *testing.T) {
+
+	var running, maxRunning, finished atomic.Int32
+	quick := make(chan struct{}, 1)
+
+	q := New(
+		WithWorkerCount(4),
+		WithConcurrencyLimit("SendEmail", 2),
+		WithConsumers(func(name string, _ map[string]any) Result {
+
+			if name == "Quick" {
+				quick <- struct{}{}
+				return Success()
+			}
+
+			current := running.Add(1)
+			for {
+				previous := maxRunning.Load()
+				if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+			finished.Add(1)
+			return Success()
+		}),
+	)
+
+	q.Start()
+	defer q.Stop()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Publish(NewTask("SendEmail", nil)))
+	}
+
+	// Quick tasks are not starved by the flood of slow ones
+	require.NoError(t, q.Publish(NewTask("Quick", nil)))
+
+	select {
+	case <-quick:
+		require.Less(t, finished.Load(), int32(10))
+	case <-time.After(time.Second):
+		t.Fatal("quick task was starved")
+	}
+
+	require.Eventually(t, func() bool { return finished.Load() == 10 }, 2*time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(2), maxRunning.Load())
+}
+
+func TestConcurrencyLimit_OverflowReturnsToStorage(t *testing.T) {
+
+	storage := &mockStorage{}
+	release := make(chan struct{})
+
+	q := New(WithStorage(storage), WithConcurrencyLimit("SendEmail", 1), WithConsumers(func(string, map[string]any) Result {
+		<-release
+		return Success()
+	}))
+
+	// Occupy the only slot
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.run(Task{TaskID: "1", Name: "SendEmail"})
+	}()
+	require.Eventually(t, func() bool {
+		q.limiter.mutex.Lock()
+		defer q.limiter.mutex.Unlock()
+		return q.limiter.running["SendEmail"] == 1
+	}, time.Second, time.Millisecond)
+
+	// The next task is held, and the one after that is snoozed back to storage
+	q.run(Task{TaskID: "2", Name: "SendEmail"})
+	q.run(Task{TaskID: "3", Name: "SendEmail", LockID: "lock"})
+
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, "3", storage.saved[0].TaskID)
+	require.Empty(t, storage.saved[0].LockID)
+	require.Greater(t, storage.saved[0].StartDate, time.Now().Unix())
+
+	// The worker that finishes the first task also runs the held one
+	close(release)
+	wg.Wait()
+	require.Equal(t, []string{"1", "2"}, storage.deleted)
+}
+
+func TestConcurrencyLimit_StopReleasesHeldTasks(t *testing.T) {
+
+	storage := &releaseStorage{}
+	q := New(WithStorage(storage), WithConcurrencyLimit("SendEmail", 1))
+
+	q.limiter.admit(Task{TaskID: "1", Name: "SendEmail"}, false)
+	q.limiter.admit(Task{TaskID: "2", Name: "SendEmail"}, false)
+
+	q.Stop()
+	require.Equal(t, []string{"2"}, storage.released)
+}
+
+func TestConcurrencyLimit_HeldTasksKeepTheirLease(t *testing.T) {
+
+	storage := &leaseStorage{}
+	q := New(WithStorage(storage), WithConcurrencyLimit("SendEmail", 1), WithHeartbeatInterval(5*time.Millisecond))
+
+	// Occupy the only slot, so that the next task is held
+	require.Equal(t, admitRun, q.limiter.admit(Task{TaskID: "1", Name: "SendEmail"}, false))
+	q.run(Task{TaskID: "2", LockID: "lock", Name: "SendEmail"})
+
+	// The held task's lease is extended while it waits
+	require.Eventually(t, func() bool { return storage.extensions() > 1 }, time.Second, time.Millisecond)
+
+	// Once it leaves the limiter, the heartbeat stops
+	require.Len(t, q.limiter.drain(), 1)
+	count := storage.extensions()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, count, storage.extensions())
+}
+
+func TestConcurrencyLimit_HungConsumerKeepsItsSlot(t *testing.T) {
+
+	storage := &mockStorage{}
+	release := make(chan struct{})
+
+	q := New(
+		WithStorage(storage),
+		WithConcurrencyLimit("SendEmail", 1),
+		WithDefaultTaskTimeout(10*time.Millisecond),
+		WithTimeoutGracePeriod(10*time.Millisecond),
+		WithConsumers(func(string, map[string]any) Result {
+			<-release
+			return Success()
+		}),
+	)
+
+	running := func() int {
+		q.limiter.mutex.Lock()
+		defer q.limiter.mutex.Unlock()
+		return q.limiter.running["SendEmail"]
+	}
+
+	// The worker moves on from the timed-out consumer...
+	q.run(Task{TaskID: "1", Name: "SendEmail", RetryMax: 3})
+
+	// ...but the consumer still holds the only slot, so the next task waits
+	require.Equal(t, 1, running())
+	q.run(Task{TaskID: "2", Name: "SendEmail", RetryMax: 3})
+	require.Equal(t, 1, running())
+
+	// Once the consumer exits, its task is retried, and its slot is handed to the held task
+	close(release)
+	require.Eventually(t, func() bool { return running() == 0 }, time.Second, time.Millisecond)
+	require.Equal(t, "1", storage.savedTasks()[0].TaskID)
+	require.Equal(t, []string{"2"}, storage.deleted)
+}
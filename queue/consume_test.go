@@ -1,8 +1,10 @@
 package queue
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -98,6 +100,76 @@ func TestConsume_Error_ExhaustedRetriesFails(t *testing.T) {
 	require.Equal(t, 0, len(storage.saved))
 }
 
+func TestConsume_ErrorAfter_UsesExplicitDelay(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return ErrorAfter(errors.New("Retry-After: 120"), 120*time.Second)
+	}))
+
+	// The retry is scheduled exactly 120 seconds out, not by the backoff strategy
+	before := time.Now().Unix()
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryCount: 5, RetryMax: 8}))
+
+	require.Equal(t, 1, len(storage.saved))
+	require.Equal(t, 6, storage.saved[0].RetryCount)
+	require.InDelta(t, before+120, storage.saved[0].StartDate, 1)
+}
+
+func TestConsume_ErrorAfter_RespectsRetryMax(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return ErrorAfter(errors.New("still rate limited"), time.Minute)
+	}))
+
+	// An explicit delay does not allow retries past RetryMax
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryCount: 3, RetryMax: 3}))
+	require.Equal(t, 1, len(storage.failures))
+	require.Equal(t, 0, len(storage.saved))
+}
+
+func TestConsume_Snooze(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Snooze(10 * time.Minute)
+	}))
+
+	before := time.Now().Unix()
+	require.NoError(t, q.consume(Task{TaskID: "abc", LockID: "lock", TimeoutDate: 999, Signature: "sig", Name: "x", RetryCount: 2, RetryMax: 3}))
+
+	// The SAME task is saved back with a later start date and no lock...
+	require.Equal(t, 1, len(storage.saved))
+	snoozed := storage.saved[0]
+	require.Equal(t, "abc", snoozed.TaskID)
+	require.Equal(t, "sig", snoozed.Signature)
+	require.Empty(t, snoozed.LockID)
+	require.Zero(t, snoozed.TimeoutDate)
+	require.InDelta(t, before+600, snoozed.StartDate, 1)
+
+	// ...without counting as a retry, and without being deleted or logged
+	require.Equal(t, 2, snoozed.RetryCount)
+	require.Equal(t, 0, len(storage.deleted))
+	require.Equal(t, 0, len(storage.failures))
+}
+
+func TestConsume_Snooze_NoStorage(t *testing.T) {
+
+	q := New(WithConsumers(func(string, map[string]any) Result {
+		return Snooze(20 * time.Millisecond)
+	}))
+	defer q.Stop()
+
+	// Without storage, the task waits in memory and then returns to the buffer
+	require.NoError(t, q.consume(Task{Name: "x"}))
+	require.Equal(t, 0, len(q.buffer))
+
+	require.Eventually(t, func() bool {
+		return len(q.buffer) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
 func TestConsume_Failure(t *testing.T) {
 
 	storage := &mockStorage{}
@@ -111,6 +183,57 @@ func TestConsume_Failure(t *testing.T) {
 	require.Equal(t, []string{"abc"}, storage.deleted)
 }
 
+func TestConsume_Recurring_Success(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	// A recurring task is rescheduled for its next occurrence, not deleted
+	require.NoError(t, q.consume(Task{TaskID: "abc", LockID: "lock", TimeoutDate: 999, Name: "x", Cron: "@hourly", RetryCount: 1, Error: "old"}))
+	require.Equal(t, 0, len(storage.deleted))
+	require.Equal(t, 1, len(storage.saved))
+
+	next := storage.saved[0]
+	require.Equal(t, "abc", next.TaskID)
+	require.Empty(t, next.LockID)
+	require.Empty(t, next.Error)
+	require.Zero(t, next.TimeoutDate)
+	require.Zero(t, next.RetryCount)
+	require.Greater(t, next.StartDate, time.Now().Unix())
+	require.Zero(t, time.Unix(next.StartDate, 0).Minute())
+}
+
+func TestConsume_Recurring_Failure(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Failure(errors.New("permanent"))
+	}))
+
+	// A failed run is logged, but the schedule continues
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", Cron: "@daily"}))
+	require.Equal(t, 1, len(storage.failures))
+	require.Equal(t, 0, len(storage.deleted))
+	require.Equal(t, 1, len(storage.saved))
+	require.NotEmpty(t, storage.saved[0].Error)
+	require.Greater(t, storage.saved[0].StartDate, time.Now().Unix())
+}
+
+func TestConsume_Recurring_InvalidCron(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	// A corrupted schedule cannot be rescheduled, so the task is failed and removed
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", Cron: "bogus"}))
+	require.Equal(t, 1, len(storage.failures))
+	require.Equal(t, []string{"abc"}, storage.deleted)
+}
+
 // --- Event handler edge cases ---
 
 func TestOnTaskSucceeded_NoStorage(t *testing.T) {
@@ -158,3 +281,163 @@ func TestOnTaskFailure_LogError(t *testing.T) {
 
 	require.Error(t, q.consume(Task{TaskID: "abc", Name: "x"}))
 }
+
+// --- Context-aware consumers ---
+
+func TestConsume_ContextConsumer(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithContextConsumers(func(ctx context.Context, _ string, _ map[string]any) Result {
+
+		// The context is live while the task is running
+		if ctx.Err() != nil {
+			return Failure(ctx.Err())
+		}
+		return Success()
+	}))
+
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x"}))
+	require.Equal(t, []string{"abc"}, storage.deleted)
+	require.Equal(t, 0, len(storage.failures))
+}
+
+func TestConsume_ContextCancelledOnStop(t *testing.T) {
+
+	started := make(chan struct{})
+	var consumerErr error
+
+	q := New(WithContextConsumers(func(ctx context.Context, _ string, _ map[string]any) Result {
+		close(started)
+
+		// Block until the Queue is stopped
+		<-ctx.Done()
+		consumerErr = ctx.Err()
+		return Success()
+	}))
+
+	q.Start()
+	require.NoError(t, q.Publish(NewTask("x", nil)))
+
+	<-started
+
+	// Stop must cancel the running consumer's context and wait for it to return
+	q.Stop()
+	require.ErrorIs(t, consumerErr, context.Canceled)
+}
+
+// --- Execution timeouts ---
+
+func TestConsume_Timeout_HungConsumer(t *testing.T) {
+
+	storage := &leaseStorage{}
+	release := make(chan struct{})
+
+	// This consumer ignores its context entirely
+	q := New(
+		WithStorage(storage),
+		WithDefaultTaskTimeout(20*time.Millisecond),
+		WithTimeoutGracePeriod(10*time.Millisecond),
+		WithHeartbeatInterval(5*time.Millisecond),
+		WithConsumers(func(string, map[string]any) Result {
+			<-release
+			return Success()
+		}),
+	)
+
+	// The worker gives up on the consumer...
+	require.NoError(t, q.consume(Task{TaskID: "abc", LockID: "lock", Name: "x", RetryMax: 3}))
+
+	// ...but the task keeps its lease, and isn't retried while the consumer is still running
+	extensions := storage.extensions()
+	require.Eventually(t, func() bool { return storage.extensions() > extensions }, time.Second, time.Millisecond)
+	require.Empty(t, storage.savedTasks())
+
+	// Once the consumer exits, the timeout is recorded as a retryable error
+	close(release)
+	require.Eventually(t, func() bool { return len(storage.savedTasks()) == 1 }, time.Second, time.Millisecond)
+
+	saved := storage.savedTasks()[0]
+	require.Equal(t, 1, saved.RetryCount)
+	require.NotEmpty(t, saved.Error)
+	require.Empty(t, storage.deleted)
+}
+
+func TestConsume_Timeout_GracePeriod(t *testing.T) {
+
+	storage := &mockStorage{}
+
+	// This consumer notices its deadline a little late
+	q := New(WithStorage(storage), WithDefaultTaskTimeout(20*time.Millisecond), WithConsumers(func(string, map[string]any) Result {
+		time.Sleep(40 * time.Millisecond)
+		return Success()
+	}))
+
+	// The worker waits for it, and records the timeout right away
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 3}))
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, 1, storage.saved[0].RetryCount)
+}
+
+func TestConsume_Timeout_CancelsContext(t *testing.T) {
+
+	storage := &mockStorage{}
+	cancelled := make(chan error, 1)
+
+	q := New(WithStorage(storage), WithContextConsumers(func(ctx context.Context, _ string, _ map[string]any) Result {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return Success()
+	}))
+
+	// The Task's own timeout applies even though the Queue has none
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 3, Timeout: 20}))
+	require.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+	require.Equal(t, 1, len(storage.saved))
+}
+
+func TestConsume_Timeout_TaskOverridesQueue(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithDefaultTaskTimeout(time.Millisecond), WithConsumers(func(string, map[string]any) Result {
+		time.Sleep(20 * time.Millisecond)
+		return Success()
+	}))
+
+	// A generous per-task timeout lets the slow consumer finish
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", Timeout: 5000}))
+	require.Equal(t, []string{"abc"}, storage.deleted)
+	require.Equal(t, 0, len(storage.saved))
+}
+
+// --- Panic recovery ---
+
+func TestConsume_Panic_LogsFailure(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		panic("parser exploded")
+	}))
+
+	// A panic becomes a permanent failure, with the panic value and stack trace in the error log
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 3}))
+	require.Equal(t, 1, len(storage.failures))
+	require.Contains(t, storage.failures[0].Error, "parser exploded")
+	require.Contains(t, storage.failures[0].Error, "runtime/debug.Stack")
+	require.Equal(t, []string{"abc"}, storage.deleted)
+	require.Equal(t, 0, len(storage.saved))
+}
+
+func TestConsume_Panic_RetryPanics(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithRetryPanics(true), WithConsumers(func(string, map[string]any) Result {
+		panic("temporary glitch")
+	}))
+
+	// With WithRetryPanics, a panic is retried like any other error
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 3}))
+	require.Equal(t, 0, len(storage.failures))
+	require.Equal(t, 1, len(storage.saved))
+	require.Equal(t, 1, storage.saved[0].RetryCount)
+	require.Contains(t, storage.saved[0].Error, "temporary glitch")
+}
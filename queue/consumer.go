@@ -1,4 +1,19 @@
 package queue
 
+import "context"
+
 // Consumer is a function that processes a task from the queue.
 type Consumer func(name string, args map[string]any) Result
+
+// ContextConsumer is a function that processes a task from the queue, and
+// receives a context that is cancelled when the Queue is stopped.  Long-running
+// consumers should watch ctx.Done() and return promptly once it is closed.
+type ContextConsumer func(ctx context.Context, name string, args map[string]any) Result
+
+// withContext wraps a Consumer so that it can be called as a ContextConsumer.
+// The context is simply ignored.
+func (consumer Consumer) withContext() ContextConsumer {
+	return func(_ context.Context, name string, args map[string]any) Result {
+		return consumer(name, args)
+	}
+}
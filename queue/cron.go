@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benpate/derp"
+)
+
+// CronSchedule is a parsed cron expression that calculates when a recurring Task should run next.
+// It supports the standard five fields (minute, hour, day of month, month, day of week) with
+// wildcards, lists, ranges, steps, and month/day names, plus the @yearly, @monthly, @weekly,
+// @daily, and @hourly shortcuts.
+type CronSchedule struct {
+	minute     uint64 // Bit set of matching minutes (0-59)
+	hour       uint64 // Bit set of matching hours (0-23)
+	dayOfMonth uint64 // Bit set of matching days of the month (1-31)
+	month      uint64 // Bit set of matching months (1-12)
+	dayOfWeek  uint64 // Bit set of matching days of the week (0-6, Sunday is 0)
+	anyDay     bool   // TRUE if either day field is a wildcard, so that only the other one applies
+}
+
+// cronField describes the valid values for one field of a cron expression
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronMinute = cronField{name: "minute", min: 0, max: 59}
+var cronHour = cronField{name: "hour", min: 0, max: 23}
+var cronDayOfMonth = cronField{name: "day of month", min: 1, max: 31}
+
+var cronMonth = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}}
+
+// Day of week allows 7 as an alias for Sunday, which is folded into 0 after parsing
+var cronDayOfWeek = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}}
+
+// cronShortcuts maps the "@" shortcuts to their equivalent expressions
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a standard five-field cron expression into a CronSchedule
+func ParseCron(spec string) (CronSchedule, error) {
+
+	const location = "queue.ParseCron"
+
+	spec = strings.TrimSpace(spec)
+
+	if shortcut, ok := cronShortcuts[strings.ToLower(spec)]; ok {
+		spec = shortcut
+	}
+
+	fields := strings.Fields(spec)
+
+	if len(fields) != 5 {
+		return CronSchedule{}, derp.BadRequest(location, "Cron expression must have exactly five fields", spec)
+	}
+
+	result := CronSchedule{}
+	var err error
+
+	if result.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return CronSchedule{}, derp.Wrap(err, location, "Invalid cron expression", spec)
+	}
+
+	if result.hour, err = cronHour.parse(fields[1]); err != nil {
+		return CronSchedule{}, derp.Wrap(err, location, "Invalid cron expression", spec)
+	}
+
+	if result.dayOfMonth, err = cronDayOfMonth.parse(fields[2]); err != nil {
+		return CronSchedule{}, derp.Wrap(err, location, "Invalid cron expression", spec)
+	}
+
+	if result.month, err = cronMonth.parse(fields[3]); err != nil {
+		return CronSchedule{}, derp.Wrap(err, location, "Invalid cron expression", spec)
+	}
+
+	if result.dayOfWeek, err = cronDayOfWeek.parse(fields[4]); err != nil {
+		return CronSchedule{}, derp.Wrap(err, location, "Invalid cron expression", spec)
+	}
+
+	// Sunday can be written as 0 or 7
+	if result.dayOfWeek&(1<<7) != 0 {
+		result.dayOfWeek = (result.dayOfWeek | 1) &^ (1 << 7)
+	}
+
+	// Per cron convention, if both day fields are restricted, then a day matches
+	// if EITHER field matches.  If one is a wildcard, then only the other applies.
+	result.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+
+	return result, nil
+}
+
+// Next returns the first time after `after` that matches the schedule, in the same time zone.
+// It returns the zero time if no match is found within the next five years
+// (for instance, for February 30th).
+func (schedule CronSchedule) Next(after time.Time) time.Time {
+
+	// Start at the beginning of the next whole minute
+	next := after.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+
+	for next.Before(limit) {
+
+		if !hasBit(schedule.month, int(next.Month())) {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !schedule.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !hasBit(schedule.hour, next.Hour()) {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+
+		if !hasBit(schedule.minute, next.Minute()) {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		return next
+	}
+
+	return time.Time{}
+}
+
+// matchesDay returns TRUE if the date matches the day-of-month and day-of-week fields
+func (schedule CronSchedule) matchesDay(date time.Time) bool {
+
+	dayOfMonth := hasBit(schedule.dayOfMonth, date.Day())
+	dayOfWeek := hasBit(schedule.dayOfWeek, int(date.Weekday()))
+
+	if schedule.anyDay {
+		return dayOfMonth && dayOfWeek
+	}
+
+	return dayOfMonth || dayOfWeek
+}
+
+// parse converts a single cron field (such as "*/15" or "1-5,10") into a bit set
+func (field cronField) parse(value string) (uint64, error) {
+
+	const location = "queue.cronField.parse"
+
+	var result uint64
+
+	for _, item := range strings.Split(value, ",") {
+
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+
+		// Parse the step (defaults to 1)
+		step := 1
+
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+
+			if err != nil || step < 1 {
+				return 0, derp.BadRequest(location, "Invalid step in "+field.name+" field", item)
+			}
+		}
+
+		// Parse the range (defaults to the whole field)
+		first, last := field.min, field.max
+
+		if rangePart != "*" {
+
+			firstPart, lastPart, hasRange := strings.Cut(rangePart, "-")
+
+			var err error
+			if first, err = field.value(firstPart); err != nil {
+				return 0, err
+			}
+
+			last = first
+
+			if hasRange {
+				if last, err = field.value(lastPart); err != nil {
+					return 0, err
+				}
+
+			} else if hasStep {
+				// "5/15" means "starting at 5, every 15"
+				last = field.max
+			}
+
+			if last < first {
+				return 0, derp.BadRequest(location, "Invalid range in "+field.name+" field", item)
+			}
+		}
+
+		for index := first; index <= last; index += step {
+			result |= 1 << index
+		}
+	}
+
+	return result, nil
+}
+
+// value converts a single number (or name) into its integer value, checking that it is in range
+func (field cronField) value(value string) (int, error) {
+
+	const location = "queue.cronField.value"
+
+	if number, ok := field.names[strings.ToUpper(value)]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil {
+		return 0, derp.BadRequest(location, "Invalid value in "+field.name+" field", value)
+	}
+
+	if number < field.min || number > field.max {
+		return 0, derp.BadRequest(location, "Value out of range in "+field.name+" field", value)
+	}
+
+	return number, nil
+}
+
+// hasBit returns TRUE if the bit at `index` is set
+func hasBit(bits uint64, index int) bool {
+	return bits&(1<<index) != 0
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron_Invalid(t *testing.T) {
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"abc * * * *",
+		"@sometimes",
+	}
+
+	for _, spec := range invalid {
+		_, err := ParseCron(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestCron_Next(t *testing.T) {
+
+	// Saturday, March 14th 2026 at 10:30:15
+	from := time.Date(2026, 3, 14, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 14, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 3, 14, 10, 45, 0, 0, time.UTC)},
+		{"0 */6 * * *", time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2026, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17 * * MON-FRI", time.Date(2026, 3, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"5,10 3 * * *", time.Date(2026, 3, 15, 3, 5, 0, 0, time.UTC)},
+		{"10-30/10 11 * * *", time.Date(2026, 3, 14, 11, 10, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 3, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec)
+		require.NoError(t, err, test.spec)
+		require.Equal(t, test.expected, schedule.Next(from), test.spec)
+	}
+}
+
+func TestCron_Next_DayOfMonthOrDayOfWeek(t *testing.T) {
+
+	// When both day fields are restricted, EITHER one can match:
+	// the 20th of the month, or any Monday.
+	schedule, err := ParseCron("0 0 20 * 1")
+	require.NoError(t, err)
+
+	from := time.Date(2026, 3, 14, 10, 30, 0, 0, time.UTC)
+	first := schedule.Next(from)
+	require.Equal(t, time.Date(2026, 3, 16, 0, 0, 0, 0, time.UTC), first) // Monday
+
+	second := schedule.Next(first)
+	require.Equal(t, time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC), second) // the 20th
+}
+
+func TestCron_Next_Impossible(t *testing.T) {
+
+	// February 30th never happens
+	schedule, err := ParseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	require.True(t, schedule.Next(time.Now()).IsZero())
+}
@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiration_DiscardedWithoutRunning(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		t.Fatal("expired task must not run")
+		return Success()
+	}))
+
+	task := NewTask("Notify", nil, WithExpiration(time.Now().Add(-time.Minute)))
+	task.TaskID = "abc"
+	q.run(task)
+
+	// The task is moved to the error log with a distinct "expired" reason
+	require.Len(t, storage.failures, 1)
+	require.True(t, strings.Contains(storage.failures[0].Error, "Task expired before it could run"))
+	require.Equal(t, []string{"abc"}, storage.deleted)
+}
+
+func TestExpiration_NotExpired(t *testing.T) {
+
+	var calls atomic.Int32
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		calls.Add(1)
+		return Success()
+	}))
+
+	q.run(NewTask("Notify", nil, WithTTL(time.Hour)))
+	q.run(NewTask("Notify", nil)) // no expiration at all
+
+	require.Equal(t, int32(2), calls.Load())
+	require.Empty(t, storage.failures)
+}
+
+func TestExpiration_HeldTask(t *testing.T) {
+
+	var calls atomic.Int32
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithConcurrencyLimit("Notify", 1), WithConsumers(func(string, map[string]any) Result {
+		calls.Add(1)
+		return Success()
+	}))
+
+	// A task that expired while it was held is discarded when its turn comes
+	expired := NewTask("Notify", nil)
+	expired.ExpireDate = time.Now().Add(-time.Second).Unix()
+	q.limiter.held["Notify"] = []heldTask{{task: expired, stopHeartbeat: func() {}}}
+
+	q.run(NewTask("Notify", nil))
+
+	require.Equal(t, int32(1), calls.Load())
+	require.Len(t, storage.failures, 1)
+}
+
+func TestExpiration_CountsInBatch(t *testing.T) {
+
+	q := New()
+	batch := NewBatch(NewTask("Done", nil))
+	batch.Add(NewTask("Notify", nil, WithExpiration(time.Now().Add(-time.Minute))))
+	require.NoError(t, q.PublishBatch(batch))
+	require.Len(t, q.buffer, 1)
+
+	// An expired task is a final outcome, so it completes the batch as a failure
+	q.run(<-q.buffer)
+	require.Len(t, q.buffer, 1)
+
+	done := <-q.buffer
+	require.Equal(t, "Done", done.Name)
+	require.Equal(t, 1, done.Arguments["failed"])
+}
+
+func TestOnTaskExpired(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage))
+
+	require.NoError(t, q.onTaskExpired(Task{TaskID: "abc", Name: "Notify"}))
+	require.Len(t, storage.failures, 1)
+
+	// The logged error is a "Gone" error, so it can be told apart from other failures
+	logged := derp.Error{}
+	require.NoError(t, json.Unmarshal([]byte(storage.failures[0].Error), &logged))
+	require.True(t, derp.IsGone(logged))
+}
@@ -0,0 +1,222 @@
+package queue
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FairScheduler decides which tasks a Storage provider should lock next, so that
+// every priority band (and, optionally, every tenant) gets a guaranteed share of
+// throughput, instead of lower-priority work waiting behind the entire backlog.
+// Bands are chosen by smooth weighted round-robin, and tenants within a band share
+// equally.  The scheduler keeps its state between calls, so the shares hold over
+// time even when each call picks only a few tasks.  It is safe for concurrent use.
+type FairScheduler struct {
+	mutex    sync.Mutex
+	bands    []FairBandConfig
+	byTenant bool
+	current  map[string]int // current weight of every lane, for smooth weighted round-robin
+}
+
+// FairBandConfig describes one priority band in a FairScheduler
+type FairBandConfig struct {
+	MaxPriority int // Tasks with a priority up to (and including) this value, and above the previous band, are in this band
+	Weight      int // Relative share of throughput for this band
+}
+
+// FairOption is a functional option that modifies a FairScheduler
+type FairOption func(*FairScheduler)
+
+// FairBand adds a priority band to the scheduler.  Lower priority values run
+// first, so bands usually get smaller weights as maxPriority increases.
+// Tasks above the highest band are counted in the highest band.
+func FairBand(maxPriority int, weight int) FairOption {
+	return func(scheduler *FairScheduler) {
+		scheduler.bands = append(scheduler.bands, FairBandConfig{MaxPriority: maxPriority, Weight: max(weight, 1)})
+	}
+}
+
+// FairByTenant shares each band's throughput equally between tenants (see WithTenant),
+// so that one tenant's backlog cannot starve the others.
+func FairByTenant() FairOption {
+	return func(scheduler *FairScheduler) {
+		scheduler.byTenant = true
+	}
+}
+
+// NewFairScheduler returns a FairScheduler with the given options.  Without any
+// bands, every priority shares a single band.
+func NewFairScheduler(options ...FairOption) *FairScheduler {
+
+	result := &FairScheduler{
+		bands:   make([]FairBandConfig, 0),
+		current: make(map[string]int),
+	}
+
+	for _, option := range options {
+		option(result)
+	}
+
+	if len(result.bands) == 0 {
+		result.bands = append(result.bands, FairBandConfig{MaxPriority: math.MaxInt, Weight: 1})
+	}
+
+	slices.SortStableFunc(result.bands, func(a, b FairBandConfig) int {
+		return cmp.Compare(a.MaxPriority, b.MaxPriority)
+	})
+
+	return result
+}
+
+// Bands returns the priority bands, sorted by MaxPriority.  Storage providers use
+// them to gather candidates from every band, so that no band is crowded out.
+func (scheduler *FairScheduler) Bands() []FairBandConfig {
+	return scheduler.bands
+}
+
+// ByTenant returns TRUE if throughput is shared between tenants within each band
+func (scheduler *FairScheduler) ByTenant() bool {
+	return scheduler.byTenant
+}
+
+// Band returns the index of the band that a priority belongs to
+func (scheduler *FairScheduler) Band(priority int) int {
+
+	for index, band := range scheduler.bands {
+		if priority <= band.MaxPriority {
+			return index
+		}
+	}
+
+	return len(scheduler.bands) - 1
+}
+
+// Pick chooses up to `count` tasks from the candidates, in the order that they
+// should be locked.  Candidates should already be sorted by priority and start
+// date, which is the order that tasks within the same band and tenant are picked.
+func (scheduler *FairScheduler) Pick(candidates []Task, count int) []Task {
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	// Sort candidates into lanes: one per band, and one per tenant within each band
+	lanes := make([]map[string][]Task, len(scheduler.bands))
+	tenants := make([][]string, len(scheduler.bands))
+	seen := make(map[string]bool)
+
+	for _, task := range candidates {
+
+		band := scheduler.Band(task.Priority)
+		tenant := ""
+
+		if scheduler.byTenant {
+			tenant = task.Tenant
+		}
+
+		if lanes[band] == nil {
+			lanes[band] = make(map[string][]Task)
+		}
+
+		if _, exists := lanes[band][tenant]; !exists {
+			tenants[band] = append(tenants[band], tenant)
+			seen[tenantKey(band, tenant)] = true
+		}
+
+		lanes[band][tenant] = append(lanes[band][tenant], task)
+	}
+
+	result := make([]Task, 0, min(count, len(candidates)))
+
+	for len(result) < count {
+
+		// Choose a band, weighted by its share
+		bandWeights := make(map[string]int)
+		bandIndexes := make(map[string]int)
+
+		for index, band := range scheduler.bands {
+			if len(lanes[index]) > 0 {
+				bandWeights[bandKey(index)] = band.Weight
+				bandIndexes[bandKey(index)] = index
+			}
+		}
+
+		if len(bandWeights) == 0 {
+			break
+		}
+
+		band := bandIndexes[scheduler.next(bandWeights)]
+
+		// Choose a tenant within the band, with equal shares
+		tenantWeights := make(map[string]int)
+		tenantNames := make(map[string]string)
+
+		for _, tenant := range tenants[band] {
+			if len(lanes[band][tenant]) > 0 {
+				tenantWeights[tenantKey(band, tenant)] = 1
+				tenantNames[tenantKey(band, tenant)] = tenant
+			}
+		}
+
+		tenant := tenantNames[scheduler.next(tenantWeights)]
+
+		// Take the first task from the chosen lane
+		lane := lanes[band][tenant]
+		result = append(result, lane[0])
+
+		if len(lane) == 1 {
+			delete(lanes[band], tenant)
+		} else {
+			lanes[band][tenant] = lane[1:]
+		}
+	}
+
+	// Forget tenants that have no more work, so that the state does not grow forever
+	for key := range scheduler.current {
+		if strings.HasPrefix(key, "t") && !seen[key] {
+			delete(scheduler.current, key)
+		}
+	}
+
+	return result
+}
+
+// next runs one round of smooth weighted round-robin: every lane gains its weight,
+// and the lane with the highest current weight is chosen and loses the total weight.
+func (scheduler *FairScheduler) next(weights map[string]int) string {
+
+	// Iterate in a stable order, so that ties are broken the same way every time
+	keys := make([]string, 0, len(weights))
+	for key := range weights {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	total := 0
+	chosen := ""
+
+	for _, key := range keys {
+		scheduler.current[key] += weights[key]
+		total += weights[key]
+
+		if chosen == "" || scheduler.current[key] > scheduler.current[chosen] {
+			chosen = key
+		}
+	}
+
+	scheduler.current[chosen] -= total
+	return chosen
+}
+
+// bandKey identifies a band in the round-robin state
+func bandKey(band int) string {
+	return "b" + strconv.Itoa(band)
+}
+
+// tenantKey identifies a tenant within a band in the round-robin state
+func tenantKey(band int, tenant string) string {
+	return "t" + strconv.Itoa(band) + ":" + tenant
+}
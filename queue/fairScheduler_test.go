@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// backlog returns `count` tasks with the given priority and tenant
+func backlog(count int, priority int, tenant string) []Task {
+	result := make([]Task, count)
+	for index := range result {
+		result[index] = Task{Name: tenant, Priority: priority, Tenant: tenant}
+	}
+	return result
+}
+
+func TestFairScheduler_Defaults(t *testing.T) {
+
+	scheduler := NewFairScheduler()
+	require.Len(t, scheduler.Bands(), 1)
+	require.False(t, scheduler.ByTenant())
+
+	// A single band keeps the candidates' order
+	candidates := []Task{{Name: "a", Priority: 1}, {Name: "b", Priority: 50}, {Name: "c", Priority: 99}}
+	require.Equal(t, candidates, scheduler.Pick(candidates, 10))
+}
+
+func TestFairScheduler_Band(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairBand(20, 1), FairBand(10, 3))
+
+	// Bands are sorted by MaxPriority
+	require.Equal(t, 10, scheduler.Bands()[0].MaxPriority)
+
+	require.Equal(t, 0, scheduler.Band(-5))
+	require.Equal(t, 0, scheduler.Band(10))
+	require.Equal(t, 1, scheduler.Band(11))
+	require.Equal(t, 1, scheduler.Band(20))
+	require.Equal(t, 1, scheduler.Band(1000)) // above every band
+}
+
+func TestFairScheduler_WeightedBands(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairBand(10, 3), FairBand(20, 1))
+
+	// A large backlog of high-priority tasks does not starve the low-priority band
+	candidates := append(backlog(100, 10, "high"), backlog(100, 20, "low")...)
+	picked := scheduler.Pick(candidates, 40)
+
+	counts := map[string]int{}
+	for _, task := range picked {
+		counts[task.Name]++
+	}
+
+	require.Len(t, picked, 40)
+	require.Equal(t, 30, counts["high"])
+	require.Equal(t, 10, counts["low"])
+}
+
+func TestFairScheduler_SharesHoldAcrossCalls(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairBand(10, 3), FairBand(20, 1))
+	candidates := append(backlog(10, 10, "high"), backlog(10, 20, "low")...)
+
+	// Picking one task at a time still gives each band its share
+	counts := map[string]int{}
+	for i := 0; i < 40; i++ {
+		counts[scheduler.Pick(candidates, 1)[0].Name]++
+	}
+
+	require.Equal(t, 30, counts["high"])
+	require.Equal(t, 10, counts["low"])
+}
+
+func TestFairScheduler_EmptyBandsAreSkipped(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairBand(10, 1), FairBand(20, 100))
+
+	// When one band is empty, the others get all of the throughput
+	picked := scheduler.Pick(backlog(5, 1, "high"), 10)
+	require.Len(t, picked, 5)
+}
+
+func TestFairScheduler_ByTenant(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairByTenant())
+	require.True(t, scheduler.ByTenant())
+
+	// One tenant's huge backlog does not starve the others
+	candidates := append(backlog(100, 10, "big"), backlog(3, 10, "small")...)
+	candidates = append(candidates, backlog(3, 10, "tiny")...)
+
+	picked := scheduler.Pick(candidates, 9)
+
+	counts := map[string]int{}
+	for _, task := range picked {
+		counts[task.Tenant]++
+	}
+
+	require.Equal(t, map[string]int{"big": 3, "small": 3, "tiny": 3}, counts)
+}
+
+func TestFairScheduler_ForgetsIdleTenants(t *testing.T) {
+
+	scheduler := NewFairScheduler(FairByTenant())
+	scheduler.Pick(append(backlog(2, 1, "a"), backlog(2, 1, "b")...), 2)
+	scheduler.Pick(backlog(2, 1, "c"), 2)
+
+	for key := range scheduler.current {
+		require.NotContains(t, []string{tenantKey(0, "a"), tenantKey(0, "b")}, key)
+	}
+}
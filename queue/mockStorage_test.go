@@ -1,9 +1,13 @@
 package queue
 
+import "sync"
+
 // mockStorage is an in-memory Storage implementation used to test the Queue
 // without a real database. It records every call so tests can assert on them,
-// and exposes error fields so failure paths can be exercised.
+// and exposes error fields so failure paths can be exercised. Methods are
+// guarded by a mutex because the poller and workers may call them concurrently.
 type mockStorage struct {
+	mutex        sync.Mutex
 	tasks        []Task
 	saved        []Task
 	deleted      []string
@@ -22,6 +26,9 @@ func (m *mockStorage) GetTasks() ([]Task, error) {
 }
 
 func (m *mockStorage) SaveTask(task Task) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.saveErr != nil {
 		return m.saveErr
 	}
@@ -30,6 +37,9 @@ func (m *mockStorage) SaveTask(task Task) error {
 }
 
 func (m *mockStorage) DeleteTask(taskID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.deleteErr != nil {
 		return m.deleteErr
 	}
@@ -38,6 +48,9 @@ func (m *mockStorage) DeleteTask(taskID string) error {
 }
 
 func (m *mockStorage) DeleteTaskBySignature(signature string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.deleteSigErr != nil {
 		return m.deleteSigErr
 	}
@@ -46,9 +59,20 @@ func (m *mockStorage) DeleteTaskBySignature(signature string) error {
 }
 
 func (m *mockStorage) LogFailure(task Task) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.logErr != nil {
 		return m.logErr
 	}
 	m.failures = append(m.failures, task)
 	return nil
 }
+
+// savedTasks returns a copy of every saved task, for tests that save from other goroutines
+func (m *mockStorage) savedTasks() []Task {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]Task(nil), m.saved...)
+}
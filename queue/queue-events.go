@@ -16,7 +16,20 @@ func (q *Queue) onTaskSucceeded(task Task) error {
 
 	// If there is no storage provider, then there's no stored record to remove.
 	if q.storage == nil {
-		return nil
+		return q.onBatchTaskFinished(task, true)
+	}
+
+	// Let dependent tasks run (before removing this one, so they can't be stranded)
+	if tracker, ok := q.storage.(DependencyTracker); ok && task.TaskID != "" {
+		if err := tracker.ResolveDependents(task.TaskID); err != nil {
+			return derp.Wrap(err, location, "Unable to resolve dependent tasks", task.TaskID)
+		}
+	}
+
+	// Count this task in its Batch (if any) before removing it, so that a failed
+	// update leaves the task to run again, instead of losing its completion
+	if err := q.onBatchTaskFinished(task, true); err != nil {
+		return derp.Wrap(err, location, "Unable to update batch", task.BatchID)
 	}
 
 	// Remove the task from the queue
@@ -29,9 +42,10 @@ func (q *Queue) onTaskSucceeded(task Task) error {
 }
 
 // onTaskError marks a task as errored and attempts to re-queue it for later.
+// If delay is zero, then the next attempt is scheduled by the task's BackoffStrategy.
 // If the task has already been retried too many times, then it will be moved
 // to the error log and removed from the queue.
-func (q *Queue) onTaskError(task Task, err error) error {
+func (q *Queue) onTaskError(task Task, err error, delay time.Duration) error {
 
 	const location = "queue.onTaskError"
 	log.Trace().Str("name", task.Name).Str("location", location).Msg("Logging task error")
@@ -42,9 +56,14 @@ func (q *Queue) onTaskError(task Task, err error) error {
 		return q.onTaskFailure(task, err)
 	}
 
+	// Use the backoff strategy unless the consumer asked for a specific delay
+	if delay <= 0 {
+		delay = q.retryDelay(task)
+	}
+
 	// Update the task data and re-queue it
 	task.LockID = ""
-	task.StartDate = time.Now().Add(backoff(task.RetryCount)).Unix()
+	task.StartDate = time.Now().Add(delay).Unix()
 	task.TimeoutDate = 0
 	task.RetryCount++
 	task.Error = derp.Serialize(err)
@@ -65,26 +84,118 @@ func (q *Queue) onTaskError(task Task, err error) error {
 	return q.storage.SaveTask(task)
 }
 
+// onTaskSnoozed puts a task back in the queue to run again after a delay.
+// Unlike onTaskError, this does not count against the task's RetryMax, and
+// unlike requeueTask, the task keeps its TaskID, Signature, and RetryCount.
+func (q *Queue) onTaskSnoozed(task Task, delay time.Duration) error {
+
+	const location = "queue.onTaskSnoozed"
+	log.Trace().Str("location", location).Str("name", task.Name).Msg("Snoozing task")
+
+	// Clear the lock and push back the start date
+	task.LockID = ""
+	task.StartDate = time.Now().Add(delay).Unix()
+	task.TimeoutDate = 0
+
+	// If there is no storage provider, then hold the task in memory until it's ready
+	if q.storage == nil {
+		q.bufferAfter(task, delay)
+		return nil
+	}
+
+	// Otherwise, write the same Task back to the storage provider
+	if err := q.storage.SaveTask(task); err != nil {
+		return derp.Wrap(err, location, "Unable to save snoozed task")
+	}
+
+	return nil
+}
+
+// bufferAfter waits in the background for the given delay, then adds the
+// task to the in-memory buffer.  It gives up if the Queue is stopped first.
+func (q *Queue) bufferAfter(task Task, delay time.Duration) {
+
+	go func() {
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-q.done:
+			return
+		}
+
+		select {
+		case q.buffer <- task:
+		case <-q.done:
+		}
+	}()
+}
+
+// onRecurringTaskFinished reschedules a recurring task for its next occurrence
+// after the current run, keeping the same TaskID and Signature so that only
+// one copy of the task ever exists.
+func (q *Queue) onRecurringTaskFinished(task Task) error {
+
+	const location = "queue.onRecurringTaskFinished"
+	log.Trace().Str("location", location).Str("name", task.Name).Msg("Rescheduling recurring task")
+
+	schedule, err := ParseCron(task.Cron)
+
+	if err != nil {
+		return q.onTaskFailure(task, derp.Wrap(err, location, "Invalid cron expression. Recurring task removed.", task.Cron))
+	}
+
+	now := time.Now()
+	next := schedule.Next(now)
+
+	if next.IsZero() {
+		return q.onTaskFailure(task, derp.Internal(location, "Cron expression never matches. Recurring task removed.", task.Cron))
+	}
+
+	// Reset the run counters and schedule the next occurrence
+	task.LockID = ""
+	task.StartDate = next.Unix()
+	task.TimeoutDate = 0
+	task.RetryCount = 0
+
+	// If there is no storage provider, then hold the task in memory until it's ready
+	if q.storage == nil {
+		q.bufferAfter(task, next.Sub(now))
+		return nil
+	}
+
+	if err := q.storage.SaveTask(task); err != nil {
+		return derp.Wrap(err, location, "Unable to save recurring task")
+	}
+
+	return nil
+}
+
 // onTaskFailure marks a task as failed and moves it to the error log.
 func (q *Queue) onTaskFailure(task Task, err error) error {
 
 	const location = "queue.onTaskFailure"
 	log.Trace().Str("location", location).Str("name", task.Name).Msg("Logging task failure...")
 
-	// Add the error into the Task record
-	task.Error = derp.Message(err)
+	// Add the error into the Task record. The serialized error keeps its
+	// details (such as the stack trace from a panic) for the error log.
+	task.Error = derp.Serialize(err)
 
-	// If there is no storage provider, then there's not much we can do...
-	// Just report the error and return
+	// Add the task to the error log
+	if err := q.logFailure(task); err != nil {
+		return derp.Wrap(err, location, "Unable to add task to error log")
+	}
+
+	// If there is no storage provider, then there's no stored record to remove.
 	if q.storage == nil {
-		log.Trace().Str("location", location).Msg("Storage is nil.  Unable to log failure.")
-		derp.Report(err)
-		return nil
+		return q.onBatchTaskFinished(task, false)
 	}
 
-	// Add the task to the error log
-	if err := q.storage.LogFailure(task); err != nil {
-		return derp.Wrap(err, location, "Unable to add task to error log")
+	// Count this task in its Batch (if any) before removing it, like onTaskSucceeded
+	if err := q.onBatchTaskFinished(task, false); err != nil {
+		return derp.Wrap(err, location, "Unable to update batch", task.BatchID)
 	}
 
 	// Remove the task from the queue
@@ -92,6 +203,58 @@ func (q *Queue) onTaskFailure(task Task, err error) error {
 		return derp.Wrap(err, location, "Unable to remove task from queue")
 	}
 
+	// Tasks that depend on this one can never run, so cancel them too
+	if tracker, ok := q.storage.(DependencyTracker); ok && task.TaskID != "" {
+		if err := tracker.CancelDependents(task.TaskID); err != nil {
+			return derp.Wrap(err, location, "Unable to cancel dependent tasks", task.TaskID)
+		}
+	}
+
 	// Succeeded in logging the failure, even if the Task itself failed.
 	return nil
 }
+
+// onTaskExpired moves a task that passed its ExpireDate before it could run into
+// the error log.  The error is a derp.Gone error, so that expired tasks can be told
+// apart from tasks that ran and failed.
+func (q *Queue) onTaskExpired(task Task) error {
+
+	const location = "queue.onTaskExpired"
+	log.Trace().Str("location", location).Str("name", task.Name).Msg("Task expired")
+
+	return q.onTaskFailure(task, derp.Gone(location, "Task expired before it could run", task.Name, task.ExpireDate))
+}
+
+// logFailure writes a failed task (with its Error already set) to the error log.
+func (q *Queue) logFailure(task Task) error {
+
+	const location = "queue.logFailure"
+
+	// If there is no storage provider, then there's not much we can do...
+	// Just report the error and return
+	if q.storage == nil {
+		log.Trace().Str("location", location).Msg("Storage is nil.  Unable to log failure.")
+		derp.Report(derp.Internal(location, "Task failed", task.Name, task.Error))
+		return nil
+	}
+
+	return q.storage.LogFailure(task)
+}
+
+// retryDelay returns how long to wait before retrying a Task, using the Task's
+// named BackoffStrategy if the Queue has one registered, or the Queue's default.
+func (q *Queue) retryDelay(task Task) time.Duration {
+
+	const location = "queue.retryDelay"
+
+	if task.Backoff != "" {
+
+		if strategy, ok := q.backoffStrategies[task.Backoff]; ok {
+			return strategy.Backoff(task.RetryCount)
+		}
+
+		log.Warn().Str("location", location).Str("name", task.Name).Str("backoff", task.Backoff).Msg("Unrecognized backoff strategy. Using default.")
+	}
+
+	return q.defaultBackoff.Backoff(task.RetryCount)
+}
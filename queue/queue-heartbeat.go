@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/rs/zerolog/log"
+)
+
+// startHeartbeat periodically extends the storage lock on a running Task so
+// that it is not reclaimed by another worker while this one is still busy.
+// It returns a function that stops the heartbeat and waits for it to exit, so
+// that no lease is extended after the Task has been completed.
+func (q *Queue) startHeartbeat(task Task) func() {
+
+	const location = "queue.startHeartbeat"
+
+	// Only tasks locked in a storage provider that supports leases need a heartbeat
+	extender, ok := q.storage.(LeaseExtender)
+
+	if !ok || q.heartbeatInterval <= 0 || task.TaskID == "" || task.LockID == "" {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+
+		defer close(stopped)
+
+		ticker := time.NewTicker(q.heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+
+			case <-stop:
+				return
+
+			case <-ticker.C:
+				log.Trace().Str("location", location).Str("taskId", task.TaskID).Msg("Extending task lease")
+
+				if err := extender.ExtendLease(task); err != nil {
+					derp.Report(derp.Wrap(err, location, "Unable to extend task lease", task.TaskID))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/rs/zerolog/log"
+)
+
+// SchedulerLeaseName is the name of the lease that elects the node which
+// registers recurring tasks in storage.
+const SchedulerLeaseName = "scheduler"
+
+// IsLeader returns TRUE if this Queue is currently the elected leader, responsible
+// for registering recurring tasks in storage.
+func (q *Queue) IsLeader() bool {
+	return q.leader.Load()
+}
+
+// leaderElector returns the Storage provider as a LeaderElector, if it implements
+// the interface and leader election has not been disabled with WithLeaderLease(0)
+func (q *Queue) leaderElector() (LeaderElector, bool) {
+
+	if q.leaderLease <= 0 {
+		return nil, false
+	}
+
+	elector, ok := q.storage.(LeaderElector)
+	return elector, ok
+}
+
+// startScheduler competes for the scheduler lease for the entire lifecycle of the
+// Queue, renewing it three times per lease.  When this node becomes the leader, it
+// publishes every recurring task that has been registered here.  When the Queue
+// stops, the lease is released so that another node can take over right away.
+func (q *Queue) startScheduler(elector LeaderElector) {
+
+	defer q.workers.Done()
+
+	ticker := time.NewTicker(q.leaderLease / 3)
+	defer ticker.Stop()
+
+	for {
+
+		q.runElection(elector)
+
+		select {
+
+		case <-q.draining:
+			q.resign(elector)
+			return
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// runElection claims (or renews) the scheduler lease. If this node has just
+// become the leader, then it publishes all registered recurring tasks.
+func (q *Queue) runElection(elector LeaderElector) {
+
+	const location = "queue.runElection"
+
+	leader, err := elector.AcquireLeadership(SchedulerLeaseName, q.nodeID, q.leaderLease)
+
+	// If we can't confirm the lease, then we can't assume that we still hold it
+	if err != nil {
+		derp.Report(derp.Wrap(err, location, "Unable to acquire scheduler lease", q.nodeID))
+		leader = false
+	}
+
+	wasLeader := q.leader.Swap(leader)
+
+	switch {
+
+	case leader && !wasLeader:
+		log.Trace().Str("location", location).Str("nodeId", q.nodeID).Msg("Turbine Queue: elected scheduler leader")
+		q.publishSchedules()
+
+	case !leader && wasLeader:
+		log.Trace().Str("location", location).Str("nodeId", q.nodeID).Msg("Turbine Queue: lost scheduler leadership")
+	}
+}
+
+// resign gives up the scheduler lease (if this node holds it) when the Queue stops.
+func (q *Queue) resign(elector LeaderElector) {
+
+	const location = "queue.resign"
+
+	if !q.leader.Swap(false) {
+		return
+	}
+
+	log.Trace().Str("location", location).Str("nodeId", q.nodeID).Msg("Turbine Queue: releasing scheduler leadership")
+
+	if err := elector.ReleaseLeadership(SchedulerLeaseName, q.nodeID); err != nil {
+		derp.Report(derp.Wrap(err, location, "Unable to release scheduler lease", q.nodeID))
+	}
+}
+
+// publishSchedules writes every recurring task registered on this node to storage.
+// Recurring tasks are signed, so tasks that already exist are not duplicated.
+func (q *Queue) publishSchedules() {
+
+	const location = "queue.publishSchedules"
+
+	q.schedulesMutex.Lock()
+	tasks := make([]Task, 0, len(q.schedules))
+	for _, task := range q.schedules {
+		tasks = append(tasks, task)
+	}
+	q.schedulesMutex.Unlock()
+
+	for _, task := range tasks {
+
+		// Start from the next occurrence, not the one after registration
+		if schedule, err := ParseCron(task.Cron); err == nil {
+			task.StartDate = schedule.Next(time.Now()).Unix()
+		}
+
+		if err := q.Publish(task); err != nil {
+			derp.Report(derp.Wrap(err, location, "Unable to publish recurring task", task.Name, task.Cron))
+		}
+	}
+}
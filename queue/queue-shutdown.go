@@ -0,0 +1,186 @@
+package queue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/benpate/derp"
+	"github.com/rs/zerolog/log"
+)
+
+// Stop closes the queue and stops all workers (after they complete their current task).
+// The context passed to any running ContextConsumer is cancelled, so that
+// long-running tasks can abort cleanly instead of holding up the shutdown.
+// Tasks still waiting in the buffer are released back to the Storage provider.
+func (q *Queue) Stop() {
+	derp.Report(q.StopWithContext(context.Background()))
+}
+
+// StopWithContext stops all workers (after they complete their current task)
+// without starting any more tasks from the buffer. It waits for running tasks
+// until the context expires, then releases every task still in the buffer back
+// to the Storage provider so that other nodes can pick them up immediately.
+func (q *Queue) StopWithContext(ctx context.Context) error {
+
+	const location = "queue.Queue.StopWithContext"
+
+	// Stop polling and send "stop" signal to all workers
+	q.close()
+
+	// Wait for running tasks to finish (or give up when the context expires)
+	waitErr := q.waitForWorkers(ctx)
+
+	// Hand all unprocessed tasks back to storage
+	if err := q.releaseBuffer(); err != nil {
+		return derp.Wrap(err, location, "Unable to release buffered tasks")
+	}
+
+	if err := q.releaseTasks(q.limiter.drain()); err != nil {
+		return derp.Wrap(err, location, "Unable to release tasks held by concurrency limits")
+	}
+
+	if waitErr != nil {
+		return derp.Wrap(waitErr, location, "Workers did not finish before the context expired")
+	}
+
+	return nil
+}
+
+// Drain stops polling storage and lets the workers finish every task that is
+// already in the buffer. If the context expires before the buffer is empty, then
+// the Queue is stopped and any tasks that were not processed are released back
+// to the Storage provider.
+func (q *Queue) Drain(ctx context.Context) error {
+
+	const location = "queue.Queue.Drain"
+
+	log.Trace().Str("location", location).Msg("Turbine Queue: draining")
+
+	// Stop polling. Workers exit on their own once the buffer is empty.
+	q.drainOnce.Do(func() {
+		close(q.draining)
+	})
+
+	// Wait for the workers to empty the buffer (or until the context expires),
+	// then stop everything and release whatever is left.
+	if err := q.waitForWorkers(ctx); err != nil {
+		log.Trace().Str("location", location).Msg("Turbine Queue: drain deadline passed. Stopping.")
+	}
+
+	if err := q.StopWithContext(ctx); err != nil {
+		return derp.Wrap(err, location, "Unable to drain queue")
+	}
+
+	return nil
+}
+
+// close stops the polling loop, signals all workers to stop, and cancels the
+// Queue's lifetime context. It is safe to call more than once.
+func (q *Queue) close() {
+
+	q.stopOnce.Do(func() {
+
+		// Close done BEFORE draining, so that a worker that sees the
+		// draining channel can trust the done channel to be accurate.
+		close(q.done)
+
+		q.drainOnce.Do(func() {
+			close(q.draining)
+		})
+
+		// Tell running consumers to wrap up
+		q.cancel()
+	})
+}
+
+// waitForWorkers blocks until all workers have exited, or until the context expires.
+func (q *Queue) waitForWorkers(ctx context.Context) error {
+
+	finished := make(chan struct{})
+
+	go func() {
+		q.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseBuffer empties the task buffer, releasing every unprocessed task back to storage.
+func (q *Queue) releaseBuffer() error {
+
+	tasks := make([]Task, 0, len(q.buffer))
+
+	for {
+		select {
+
+		case task := <-q.buffer:
+			tasks = append(tasks, task)
+
+		default:
+			return q.releaseTasks(tasks)
+		}
+	}
+}
+
+// releaseTasks hands a set of unprocessed tasks back to the Storage provider,
+// clearing their locks so that they can be picked up by another worker right away.
+func (q *Queue) releaseTasks(tasks []Task) error {
+
+	const location = "queue.releaseTasks"
+
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	// Without a storage provider, there's nowhere to put the tasks
+	if q.storage == nil {
+		return derp.Internal(location, "No storage provider. Unprocessed tasks will be lost.", len(tasks))
+	}
+
+	var result error
+
+	for _, task := range tasks {
+		if err := q.releaseTask(task); err != nil {
+			result = errors.Join(result, derp.Wrap(err, location, "Unable to release task", task.Name))
+		}
+	}
+
+	return result
+}
+
+// releaseTask hands a single unprocessed task back to the Storage provider.
+func (q *Queue) releaseTask(task Task) error {
+
+	const location = "queue.releaseTask"
+
+	// Without a storage provider, there's nowhere to put the task
+	if q.storage == nil {
+		return derp.Internal(location, "No storage provider. Unprocessed task will be lost.", task.Name)
+	}
+
+	// If the Task is locked in storage, then just remove the lock
+	if releaser, ok := q.storage.(TaskReleaser); ok && task.TaskID != "" {
+
+		if err := releaser.ReleaseTask(task.TaskID); err != nil {
+			return derp.Wrap(err, location, "Unable to release task lock", task.TaskID)
+		}
+
+		return nil
+	}
+
+	// Otherwise, save the Task (with its lock cleared) so that it is available immediately
+	task.LockID = ""
+	task.TimeoutDate = 0
+
+	if err := q.storage.SaveTask(task); err != nil {
+		return derp.Wrap(err, location, "Unable to save task to storage", task.Name)
+	}
+
+	return nil
+}
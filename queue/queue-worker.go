@@ -1,16 +1,21 @@
 package queue
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"time"
 
 	"github.com/benpate/derp"
+	"github.com/benpate/rosetta/channel"
 	"github.com/rs/zerolog/log"
 )
 
 // startWorker runs a single, long-lived worker process, pulling Tasks off
 // the buffered channel and running them one at a time. It blocks waiting for
 // new work for the entire lifecycle of the Queue, and only exits when Stop
-// closes the done channel.
+// closes the done channel (or when Drain has emptied the buffer).
 func (q *Queue) startWorker() {
 
 	// Signal the WaitGroup when this worker exits, so Stop can return.
@@ -26,23 +31,211 @@ func (q *Queue) startWorker() {
 			return
 
 		case task := <-q.buffer:
-			if err := q.consume(task); err != nil {
-				derp.Report(err)
+			q.run(task)
+
+		// When draining, finish whatever is left in the buffer, then exit.
+		case <-q.draining:
+			q.drainBuffer()
+			return
+		}
+	}
+}
+
+// drainBuffer runs tasks from the buffer until it is empty, or until the Queue is stopped.
+func (q *Queue) drainBuffer() {
+
+	for {
+
+		// Check done first, so a stopped Queue never starts another task
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		select {
+
+		case task := <-q.buffer:
+			q.run(task)
+
+		default:
+			return
+		}
+	}
+}
+
+// run consumes a single Task pulled from the buffer. If the Queue was stopped
+// while the worker was waiting, then the Task is released instead of started.
+// Tasks over their concurrency limit are held, and when this worker finishes a
+// Task, it runs the next held Task with the same name (if any).
+func (q *Queue) run(task Task) {
+
+	const location = "queue.run"
+
+	if channel.Closed(q.done) {
+		derp.Report(q.releaseTask(task))
+		return
+	}
+
+	// Discard expired tasks before they take a rate limit token or a concurrency slot
+	if task.IsExpired() {
+		derp.Report(q.onTaskExpired(task))
+		return
+	}
+
+	// Tasks over their rate limit wait until a token is available
+	if delay := q.rateLimitDelay(task); delay > 0 {
+		log.Trace().Str("location", location).Str("name", task.Name).Dur("delay", delay).Msg("Rate limit reached. Task snoozed.")
+		derp.Report(q.onTaskSnoozed(task, delay))
+		return
+	}
+
+	switch q.limiter.admit(task, q.storage == nil) {
+
+	case admitHeld:
+		log.Trace().Str("location", location).Str("name", task.Name).Msg("Concurrency limit reached. Task held.")
+		return
+
+	case admitOverflow:
+		log.Trace().Str("location", location).Str("name", task.Name).Msg("Concurrency limit reached. Task returned to storage.")
+		derp.Report(q.onTaskSnoozed(task, concurrencySnoozeDelay))
+		return
+	}
+
+	q.runAdmitted(task)
+}
+
+// runAdmitted runs a Task that holds a concurrency slot, then runs each held Task
+// that it hands the slot to.  If a consumer is still running past its deadline,
+// then this worker moves on, and the slot is kept until the consumer exits.
+func (q *Queue) runAdmitted(task Task) {
+
+	for {
+
+		// Held tasks may have expired while they waited
+		if task.IsExpired() {
+			derp.Report(q.onTaskExpired(task))
+
+		} else {
+
+			finished, err := q.consumeTask(task)
+			derp.Report(err)
+
+			if finished != nil {
+				go func() {
+					<-finished
+					q.releaseAdmitted(task.Name)
+				}()
+				return
 			}
 		}
+
+		next, ok := q.limiter.release(task.Name, !channel.Closed(q.done))
+
+		if !ok {
+			return
+		}
+
+		task = next
+	}
+}
+
+// releaseAdmitted returns the concurrency slot of a finished Task, and runs the
+// held Task that it is handed over to (if any).  Once stopped, held tasks are
+// released by Stop instead of run here.
+func (q *Queue) releaseAdmitted(name string) {
+
+	if next, ok := q.limiter.release(name, !channel.Closed(q.done)); ok {
+		q.runAdmitted(next)
+	}
+}
+
+// rateLimitDelay takes a token for the Task from its rate limit (if any). It returns
+// zero if the Task can run now, or how long the Task should wait before trying again.
+func (q *Queue) rateLimitDelay(task Task) time.Duration {
+
+	const location = "queue.rateLimitDelay"
+
+	key := task.RateLimitKey
+
+	if key == "" {
+		key = task.Name
+	}
+
+	limit, ok := q.rateLimits.get(key)
+
+	if !ok {
+		return 0
+	}
+
+	var delay time.Duration
+
+	if limiter, ok := q.storage.(RateLimiter); ok {
+
+		var err error
+
+		if delay, err = limiter.TakeToken(key, limit.rate, limit.burst); err != nil {
+			// Fall back to this node's own bucket so that the limit still applies
+			derp.Report(derp.Wrap(err, location, "Unable to take shared rate limit token", key))
+			delay = q.rateLimits.take(key, time.Now())
+		}
+
+	} else {
+		delay = q.rateLimits.take(key, time.Now())
+	}
+
+	// Storage schedules tasks in whole seconds, so round up to avoid
+	// picking up the task again before its token is ready
+	if delay > 0 && q.storage != nil {
+		delay = (delay + time.Second - 1).Truncate(time.Second)
 	}
+
+	return delay
 }
 
 // consume executes a single Task by offering it to each consumer in turn,
-// stopping at the first one that recognizes (does not ignore) it.
+// stopping at the first one that recognizes (does not ignore) it.  If the
+// consumer is still running past its deadline, then its result is applied in
+// the background once it exits.
 func (q *Queue) consume(task Task) error {
+	_, err := q.consumeTask(task)
+	return err
+}
+
+// consumeTask works like consume.  If the consumer is still running after its
+// deadline and grace period, then it returns a channel that is closed once the
+// consumer exits and its (timed out) result has been applied.  Until then, the
+// Task keeps its storage lock, and it is not retried, so it never runs twice at once.
+func (q *Queue) consumeTask(task Task) (<-chan struct{}, error) {
 
 	const location = "queue.consume"
 
+	// Each task gets its own context, which is cancelled when the task
+	// completes, when its timeout passes, or when the Queue is stopped.
+	ctx, cancel := q.taskContext(task)
+	defer cancel()
+
 	for _, consumeFunc := range q.consumers {
 
 		// Try to run the Task
-		result := consumeFunc(task.Name, task.Arguments)
+		result, exited := q.runConsumer(ctx, consumeFunc, task)
+
+		// Apply a timed-out result only once the consumer has really exited
+		if exited != nil {
+
+			finished := make(chan struct{})
+
+			go func() {
+				defer close(finished)
+				<-exited
+
+				if _, err := q.applyResult(task, result); err != nil {
+					derp.Report(derp.Wrap(err, location, "Applying result for timed out task", task))
+				}
+			}()
+
+			return finished, nil
+		}
 
 		log.Trace().Str("location", location).Str("name", task.Name).Str("status", result.Status).Msg("Task executed")
 		derp.Report(result.Error)
@@ -55,14 +248,168 @@ func (q *Queue) consume(task Task) error {
 		}
 
 		if err != nil {
-			return derp.Wrap(err, location, "Applying result for task", task)
+			return nil, derp.Wrap(err, location, "Applying result for task", task)
 		}
 
-		return nil
+		return nil, nil
 	}
 
 	// No matching consumers found. Return disgrace.
-	return derp.Internal(location, "No consumers available to process task", task)
+	return nil, derp.Internal(location, "No consumers available to process task", task)
+}
+
+// taskContext returns the context for a single Task, derived from the Queue's
+// lifetime context. If the Task (or the Queue) defines a timeout, then the
+// context is cancelled once it passes.
+func (q *Queue) taskContext(task Task) (context.Context, context.CancelFunc) {
+
+	timeout := q.defaultTaskTimeout
+
+	if task.Timeout > 0 {
+		timeout = time.Duration(task.Timeout) * time.Millisecond
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(q.ctx)
+	}
+
+	return context.WithTimeout(q.ctx, timeout)
+}
+
+// runConsumer executes a single consumer in a separate goroutine, so that a
+// consumer that ignores its context cannot hold this worker past the task's
+// deadline. A timed-out task returns a retryable Error result. If the consumer
+// has not returned within the grace period after its deadline, then it is
+// abandoned, and runConsumer also returns a channel that is closed once the
+// consumer finally exits.  The Task's lease is extended until then.
+func (q *Queue) runConsumer(ctx context.Context, consumer ContextConsumer, task Task) (Result, <-chan struct{}) {
+
+	const location = "queue.runConsumer"
+
+	// Keep the Task's storage lock alive for as long as the consumer is running
+	stopHeartbeat := q.startHeartbeat(task)
+
+	// Buffered, so an abandoned consumer can still deliver its result and exit
+	results := make(chan Result, 1)
+
+	go func() {
+
+		// Convert panics into a Result, so that one misbehaving consumer
+		// cannot take down the whole process.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				results <- q.panicResult(task, recovered, debug.Stack())
+			}
+		}()
+
+		results <- consumer(ctx, task.Name, task.Arguments)
+	}()
+
+	select {
+
+	case result := <-results:
+		stopHeartbeat()
+		return result, nil
+
+	case <-ctx.Done():
+	}
+
+	// If the Queue is stopping, then let the consumer wrap up on its own.
+	// Only a deadline abandons the consumer.
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result := <-results
+		stopHeartbeat()
+		return result, nil
+	}
+
+	log.Trace().Str("location", location).Str("name", task.Name).Msg("Task timed out")
+	timedOut := Error(derp.Timeout(location, "Task exceeded its execution timeout", task.Name))
+
+	// Give the consumer a moment to notice that its context was cancelled
+	grace := time.NewTimer(q.timeoutGracePeriod)
+	defer grace.Stop()
+
+	select {
+
+	case <-results:
+		stopHeartbeat()
+		return timedOut, nil
+
+	case <-grace.C:
+	}
+
+	// The consumer is still running, so keep its lease until it exits
+	log.Warn().Str("location", location).Str("name", task.Name).Msg("Consumer is still running after its timeout")
+	exited := make(chan struct{})
+
+	go func() {
+		<-results
+		stopHeartbeat()
+		close(exited)
+	}()
+
+	return timedOut, exited
+}
+
+// panicResult converts a panic from a consumer into a Result. The panic value
+// and stack trace are attached to the error so they land in the error log.
+// Panics are permanent failures unless the Queue is configured to retry them.
+func (q *Queue) panicResult(task Task, recovered any, stack []byte) Result {
+
+	const location = "queue.panicResult"
+
+	log.Error().Str("location", location).Str("name", task.Name).Msgf("Consumer panicked: %v", recovered)
+	err := derp.Internal(location, "Consumer panicked while running task", task.Name, fmt.Sprint(recovered), string(stack))
+
+	if q.retryPanics {
+		return Error(err)
+	}
+
+	return Failure(err)
+}
+
+// applyRecurringResult records the outcome of a single run of a recurring task.
+// Whatever the outcome, the task is rescheduled for its next occurrence instead
+// of being removed. Errors and failures are written to the error log, and are
+// not retried: the next occurrence is the retry.
+func (q *Queue) applyRecurringResult(task Task, result Result) (bool, error) {
+
+	const location = "queue.applyRecurringResult"
+
+	switch result.Status {
+
+	case ResultStatusSuccess, ResultStatusRequeue:
+		log.Trace().Str("location", location).Msg("Recurring task succeeded.")
+		task.Error = ""
+
+	case ResultStatusError, ResultStatusFailure:
+		log.Trace().Str("location", location).Msg("Recurring task failed.")
+		task.Error = derp.Serialize(result.Error)
+
+		if err := q.logFailure(task); err != nil {
+			return true, derp.Wrap(err, location, "Logging recurring task failure", result.Error)
+		}
+
+	// Snoozing a recurring task just delays this occurrence
+	case ResultStatusSnooze:
+
+		log.Trace().Str("location", location).Msg("Recurring task snoozed.")
+
+		if err := q.onTaskSnoozed(task, result.Delay); err != nil {
+			return true, derp.Wrap(err, location, "Snoozing recurring task")
+		}
+
+		return true, nil
+
+	default:
+		return false, nil
+	}
+
+	if err := q.onRecurringTaskFinished(task); err != nil {
+		return true, derp.Wrap(err, location, "Rescheduling recurring task")
+	}
+
+	return true, nil
 }
 
 // applyResult records the outcome of a single consumer run. It returns
@@ -72,12 +419,23 @@ func (q *Queue) applyResult(task Task, result Result) (bool, error) {
 
 	const location = "queue.applyResult"
 
+	// Recurring tasks are rescheduled instead of removed
+	if task.Cron != "" {
+		return q.applyRecurringResult(task, result)
+	}
+
 	switch result.Status {
 
 	// If the task was successful, then mark it as complete
 	case ResultStatusSuccess:
 
 		log.Trace().Str("location", location).Msg("Task succeeded.")
+
+		// Publish the next step in the Chain first, so that it can't be lost
+		if err := q.publishNext(task, result.Output); err != nil {
+			return true, derp.Wrap(err, location, "Continuing task chain")
+		}
+
 		if err := q.onTaskSucceeded(task); err != nil {
 			return true, derp.Wrap(err, location, "Setting task success")
 		}
@@ -95,12 +453,23 @@ func (q *Queue) applyResult(task Task, result Result) (bool, error) {
 		q.requeueTask(task, result.Delay)
 		return true, nil
 
+	// If the Task is not ready yet, then put it back to run again later
+	case ResultStatusSnooze:
+
+		log.Trace().Str("location", location).Msg("Task snoozed.")
+
+		if err := q.onTaskSnoozed(task, result.Delay); err != nil {
+			return true, derp.Wrap(err, location, "Snoozing task")
+		}
+
+		return true, nil
+
 	// If the Task fails but can be retried, then try to re-queue for another attempt
 	case ResultStatusError:
 
 		log.Trace().Str("location", location).Msg("Task error...")
 
-		if err := q.onTaskError(task, result.Error); err != nil {
+		if err := q.onTaskError(task, result.Error, result.Delay); err != nil {
 			return true, derp.Wrap(err, location, "Setting task error", result.Error)
 		}
 
@@ -139,6 +508,7 @@ func (q *Queue) requeueTask(task Task, delay time.Duration) {
 	task.StartDate = time.Now().Add(delay).Unix()
 	task.TimeoutDate = 0
 	task.RetryCount = 0
+	task.BatchID = "" // the original task has already been counted in its Batch
 
 	// Queue the "new" task
 	if err := q.Publish(task); err != nil {
@@ -2,7 +2,10 @@
 package queue
 
 import (
+	"context"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benpate/derp"
@@ -12,18 +15,38 @@ import (
 
 // Queue represents a task queue with support for persistent storage and concurrent processing
 type Queue struct {
-	storage              Storage        // Storage is the interface to the database
-	consumers            []Consumer     // consumers contains all registered Consumer objects
-	workerCount          int            // workerCount represents the number of goroutines to use for processing Tasks concurrently. Default process count is 16
-	bufferSize           int            // bufferSize determines the number of Tasks to lock in one transaction. Default buffer size is 32
-	pollStorage          bool           // pollStorage determines if the queue should poll the database for new tasks. Default is true
-	defaultPriority      int            // defaultPriority is the default priority to use when creating new tasks
-	runImmediatePriority int            // runImmediatePriority is the maximum priority value that will be tried immediately
-	defaultRetryMax      int            // defaultRetryMax is the default number of times to retry a task before giving up
-	preProcessor         PreProcessor   // optional pre-processor function that is executed on all tasks before they are published
-	buffer               chan Task      // buffer is a channel of tasks that are ready to be processed
-	done                 chan struct{}  // done channel is closed to signal all workers to stop
-	workers              sync.WaitGroup // workers tracks the running worker goroutines so Stop can wait for them to exit
+	storage              Storage                    // Storage is the interface to the database
+	consumers            []ContextConsumer          // consumers contains all registered consumers, in the order they were added
+	workerCount          int                        // workerCount represents the number of goroutines to use for processing Tasks concurrently. Default process count is 16
+	bufferSize           int                        // bufferSize determines the number of Tasks to lock in one transaction. Default buffer size is 32
+	pollStorage          bool                       // pollStorage determines if the queue should poll the database for new tasks. Default is true
+	defaultPriority      int                        // defaultPriority is the default priority to use when creating new tasks
+	runImmediatePriority int                        // runImmediatePriority is the maximum priority value that will be tried immediately
+	defaultRetryMax      int                        // defaultRetryMax is the default number of times to retry a task before giving up
+	defaultTaskTimeout   time.Duration              // defaultTaskTimeout is the maximum time a consumer may run a task (unless overridden by the Task). Zero means no timeout
+	timeoutGracePeriod   time.Duration              // timeoutGracePeriod is how long a worker waits for a timed-out consumer to return, before it moves on. Default is 5 seconds
+	defaultBackoff       BackoffStrategy            // defaultBackoff calculates retry delays for tasks that do not name their own strategy
+	backoffStrategies    map[string]BackoffStrategy // backoffStrategies contains named strategies that tasks can select with WithBackoff
+	retryPanics          bool                       // retryPanics determines if a panicking consumer is treated as a retryable Error (true) or a permanent Failure (false, the default)
+	heartbeatInterval    time.Duration              // heartbeatInterval is how often to extend the storage lock on running Tasks (if the Storage is a LeaseExtender). Default is 1 minute
+	nodeID               string                     // nodeID uniquely identifies this Queue when electing a leader. Default is the hostname plus a random suffix
+	leaderLease          time.Duration              // leaderLease is how long leadership lasts without being renewed (if the Storage is a LeaderElector). Default is 30 seconds
+	leader               atomic.Bool                // leader is TRUE while this Queue holds the scheduler lease
+	schedules            map[string]Task            // schedules contains the recurring tasks registered on this node, keyed by signature
+	schedulesMutex       sync.Mutex                 // schedulesMutex guards the schedules map
+	memoryBatches        *memoryBatchTracker        // memoryBatches counts Batches when there is no Storage provider
+	limiter              *concurrencyLimiter        // limiter caps the number of tasks with the same name that run at once
+	rateLimits           *rateLimits                // rateLimits caps how often tasks with the same rate limit key can start
+	queueNames           []string                   // queueNames lists the named queues that this Queue consumes. If empty, then it consumes every task
+	preProcessor         PreProcessor               // optional pre-processor function that is executed on all tasks before they are published
+	buffer               chan Task                  // buffer is a channel of tasks that are ready to be processed
+	done                 chan struct{}              // done channel is closed to signal all workers to stop
+	draining             chan struct{}              // draining channel is closed to stop polling storage. Workers exit once the buffer is empty
+	stopOnce             sync.Once                  // stopOnce guards closing the done channel, so that Stop and Drain can both be called safely
+	drainOnce            sync.Once                  // drainOnce guards closing the draining channel
+	workers              sync.WaitGroup             // workers tracks the running worker goroutines so Stop can wait for them to exit
+	ctx                  context.Context            // ctx lives as long as the Queue does. Every consumer receives a context derived from it
+	cancel               context.CancelFunc         // cancel ends ctx, signalling all running consumers to abort
 }
 
 // New returns a fully initialized Queue object, with all options applied
@@ -36,8 +59,19 @@ func New(options ...Option) *Queue {
 		defaultPriority:      16,
 		runImmediatePriority: 16,
 		defaultRetryMax:      8, // 511 minutes => ~8.5 hours of retries
+		heartbeatInterval:    1 * time.Minute,
+		timeoutGracePeriod:   5 * time.Second,
+		nodeID:               newNodeID(),
+		leaderLease:          30 * time.Second,
+		schedules:            make(map[string]Task),
+		memoryBatches:        newMemoryBatchTracker(),
+		limiter:              newConcurrencyLimiter(),
+		rateLimits:           newRateLimits(),
+		defaultBackoff:       BackoffFunc(backoff),
+		backoffStrategies:    make(map[string]BackoffStrategy),
 		pollStorage:          true,
 		done:                 make(chan struct{}),
+		draining:             make(chan struct{}),
 	}
 
 	// Apply options
@@ -45,9 +79,15 @@ func New(options ...Option) *Queue {
 		option(&result)
 	}
 
+	// Held tasks keep their storage lease alive, just like running tasks
+	result.limiter.heartbeat = result.startHeartbeat
+
 	// Create the task buffer last (to use the correct buffer size)
 	result.buffer = make(chan Task, result.bufferSize)
 
+	// Create the lifetime context that is passed to all consumers
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+
 	// UwU LOL.
 	return &result
 }
@@ -58,6 +98,12 @@ func (q *Queue) Start() {
 	// Poll the storage container for new Tasks
 	go q.start()
 
+	// Compete to become the node that registers recurring tasks
+	if elector, ok := q.leaderElector(); ok {
+		q.workers.Add(1)
+		go q.startScheduler(elector)
+	}
+
 	// Start workers to consume tasks. Add to the WaitGroup *before* launching
 	// each goroutine so Stop can reliably wait for all of them to exit.
 	for i := 0; i < q.workerCount; i++ {
@@ -86,40 +132,86 @@ func (q *Queue) start() {
 	// Poll the storage container for new Tasks
 	for {
 
-		if channel.Closed(q.done) {
+		if channel.Closed(q.draining) {
 			log.Trace().Msg("Turbine Queue: stopped")
 			return
 		}
 
 		// Loop through any existing tasks that are locked by this worker
-		tasks, err := q.storage.GetTasks()
+		tasks, err := q.getTasks()
 
 		if err != nil {
 			// Pause before retrying so a failing storage backend doesn't hot-spin this loop.
 			derp.Report(derp.Wrap(err, location, "Unable to get tasks from storage"))
-			time.Sleep(1 * time.Minute)
+			q.pause(1 * time.Minute)
 			continue
 		}
 
 		// If there are no tasks, wait one minute before trying to lock more.
 		if len(tasks) == 0 {
 			log.Trace().Msg("Turbine Queue: no tasks found.  Waiting 1 minute.")
-			time.Sleep(1 * time.Minute)
+			q.pause(1 * time.Minute)
 		}
 
 		// Loop through all tasks that we have to process
-		for _, task := range tasks {
+		for index, task := range tasks {
 
-			if channel.Closed(q.done) {
-				log.Trace().Msg("Turbine Queue: done channel closed. Exiting.")
+			select {
+
+			case q.buffer <- task:
+
+			// If the Queue stops while we're waiting for room in the buffer,
+			// then hand the rest of this batch back to storage.
+			case <-q.draining:
+				log.Trace().Msg("Turbine Queue: stopped polling. Releasing remaining tasks.")
+				derp.Report(q.releaseTasks(tasks[index:]))
 				return
 			}
-
-			q.buffer <- task
 		}
 	}
 }
 
+// getTasks retrieves the next batch of tasks from storage, limited to
+// the named queues that this Queue consumes (if any).
+func (q *Queue) getTasks() ([]Task, error) {
+
+	const location = "queue.Queue.getTasks"
+
+	if len(q.queueNames) == 0 {
+		return q.storage.GetTasks()
+	}
+
+	filter, ok := q.storage.(QueueFilter)
+
+	if !ok {
+		return nil, derp.Internal(location, "Storage provider does not support named queues", q.queueNames)
+	}
+
+	return filter.GetTasksFromQueues(q.queueNames)
+}
+
+// consumesQueue returns TRUE if this Queue runs tasks from the named queue
+func (q *Queue) consumesQueue(queueName string) bool {
+
+	if len(q.queueNames) == 0 {
+		return true
+	}
+
+	return slices.Contains(q.queueNames, queueName)
+}
+
+// pause waits for the given duration, or until the Queue stops polling storage.
+func (q *Queue) pause(duration time.Duration) {
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-q.draining:
+	}
+}
+
 // NewTask pushes a new task to the Queue and swallows any errors that are generated.
 func (q *Queue) NewTask(name string, args map[string]any, options ...TaskOption) {
 	task := NewTask(name, args, options...)
@@ -153,6 +245,18 @@ func (q *Queue) Publish(task Task) error {
 		return nil
 	}
 
+	// RULE: Recurring tasks must have a valid cron expression
+	if task.Cron != "" {
+		if _, err := ParseCron(task.Cron); err != nil {
+			return derp.Wrap(err, location, "Invalid cron expression for recurring task", task)
+		}
+
+		// The memory buffer runs tasks right away, so it cannot wait for the next occurrence
+		if q.storage == nil {
+			return derp.Internal(location, "Must have a storage provider in order to publish recurring tasks", task.Name)
+		}
+	}
+
 	// RULE: Update task.Priority if unset
 	if task.Priority == -1 {
 		task.Priority = q.defaultPriority
@@ -163,6 +267,18 @@ func (q *Queue) Publish(task Task) error {
 		task.RetryMax = q.defaultRetryMax
 	}
 
+	// RULE: Tasks that wait for parent tasks require storage that tracks dependencies
+	if task.HasParents() {
+		if _, ok := q.storage.(DependencyTracker); !ok {
+			return derp.Internal(location, "Storage provider does not support task dependencies", task)
+		}
+
+		// Signed tasks may be dropped as duplicates, which would leave their dependency records behind
+		if task.Signature != "" {
+			return derp.BadRequest(location, "Tasks with parents cannot be signed", task.Name, task.Signature)
+		}
+	}
+
 	// Special Case #1: If there is no storage provider,
 	// then queue the Task in the memory buffer.  This *may*
 	// hold up execution if the buffer is full because there's
@@ -217,6 +333,53 @@ func (q *Queue) Schedule(task Task, delay time.Duration) error {
 	return nil
 }
 
+// ScheduleRecurring adds a recurring Task to the Queue, which runs on the given
+// cron schedule (such as "0 */6 * * *") until it is deleted.  Each recurring
+// task is identified by a signature derived from its name, so registering the
+// same schedule from several processes (or on every restart) stores only one
+// copy.  Use q.Delete(RecurringSignature(name)) to remove it.
+//
+// If the Storage provider is a LeaderElector, then the task is only registered
+// on this node, and is written to storage by whichever started node is currently
+// the leader.  Every node should register the same recurring tasks, so that any
+// of them can take over when the leader goes away.  Nodes that never call Start
+// never lead, so they should disable leader election with WithLeaderLease(0),
+// which publishes the task directly.
+func (q *Queue) ScheduleRecurring(name string, spec string, args map[string]any, options ...TaskOption) error {
+
+	const location = "queue.ScheduleRecurring"
+
+	if q.storage == nil {
+		return derp.Internal(location, "Must have a storage provider in order to schedule recurring tasks")
+	}
+
+	if _, err := ParseCron(spec); err != nil {
+		return derp.Wrap(err, location, "Invalid cron expression", name, spec)
+	}
+
+	// Set the signature first, so that callers can still override it
+	options = append([]TaskOption{WithSignature(RecurringSignature(name)), WithCron(spec)}, options...)
+	task := NewTask(name, args, options...)
+
+	// With leader election, the leader publishes the task (now, or when it is elected)
+	if _, ok := q.leaderElector(); ok {
+
+		q.schedulesMutex.Lock()
+		q.schedules[task.Signature] = task
+		q.schedulesMutex.Unlock()
+
+		if !q.IsLeader() {
+			return nil
+		}
+	}
+
+	if err := q.Publish(task); err != nil {
+		return derp.Wrap(err, location, "Unable to publish recurring task", name, spec)
+	}
+
+	return nil
+}
+
 // Delete removes a task from the queue by its signature
 func (q *Queue) Delete(signature string) error {
 	const location = "queue.Queue.Delete"
@@ -226,22 +389,17 @@ func (q *Queue) Delete(signature string) error {
 		return derp.Internal(location, "Must have a storage provider in order to delete tasks")
 	}
 
+	// Forget recurring tasks registered on this node, so that they are not re-published
+	q.schedulesMutex.Lock()
+	delete(q.schedules, signature)
+	q.schedulesMutex.Unlock()
+
 	if err := q.storage.DeleteTaskBySignature(signature); err != nil {
 		return derp.Wrap(err, location, "Unable to delete task by signature")
 	}
 	return nil
 }
 
-// Stop closes the queue and stops all workers (after they complete their current task)
-func (q *Queue) Stop() {
-
-	// Send "stop" signal to all workers
-	close(q.done)
-
-	// Wait until all workers have finished their current task and exited
-	q.workers.Wait()
-}
-
 // allowImmediate returns TRUE if the Task can be executed immediately
 func (q *Queue) allowImmediate(task *Task) bool {
 
@@ -250,6 +408,21 @@ func (q *Queue) allowImmediate(task *Task) bool {
 		return false
 	}
 
+	// If the task belongs to a queue that this node does not consume, then it CANNOT be executed here
+	if !q.consumesQueue(task.QueueName) {
+		return false
+	}
+
+	// If the task is waiting for parent tasks, then it CANNOT be executed immediately
+	if task.HasParents() {
+		return false
+	}
+
+	// If the task is scheduled for the future, then it CANNOT be executed immediately
+	if task.StartDate > time.Now().Unix() {
+		return false
+	}
+
 	// Otherwise, tasks can execute immediately if their priority is less than or equal to the runImmediatePriority
 	return task.Priority <= q.runImmediatePriority
 }
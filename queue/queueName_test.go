@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// queueFilterStorage is a mockStorage that also implements QueueFilter
+type queueFilterStorage struct {
+	mockStorage
+	requested [][]string
+}
+
+func (s *queueFilterStorage) GetTasksFromQueues(queueNames []string) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requested = append(s.requested, queueNames)
+	return s.tasks, nil
+}
+
+func TestGetTasks_AllQueues(t *testing.T) {
+
+	storage := &queueFilterStorage{mockStorage: mockStorage{tasks: []Task{{Name: "a"}}}}
+	q := New(WithStorage(storage))
+
+	// Without queue names, every task is consumed
+	tasks, err := q.getTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Empty(t, storage.requested)
+}
+
+func TestGetTasks_NamedQueues(t *testing.T) {
+
+	storage := &queueFilterStorage{}
+	q := New(WithStorage(storage), WithQueueNames("media", ""))
+
+	_, err := q.getTasks()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"media", ""}}, storage.requested)
+}
+
+func TestGetTasks_NamedQueues_Unsupported(t *testing.T) {
+	q := New(WithStorage(&mockStorage{}), WithQueueNames("media"))
+	_, err := q.getTasks()
+	require.Error(t, err)
+}
+
+func TestConsumesQueue(t *testing.T) {
+
+	require.True(t, New().consumesQueue("anything"))
+
+	q := New(WithQueueNames("media", ""))
+	require.True(t, q.consumesQueue("media"))
+	require.True(t, q.consumesQueue(""))
+	require.False(t, q.consumesQueue("email"))
+}
+
+func TestPublish_OtherQueueGoesToStorage(t *testing.T) {
+
+	storage := &queueFilterStorage{}
+	q := New(WithStorage(storage), WithQueueNames("web"), WithRunImmediatePriority(100))
+
+	// Tasks for this node's queues may run immediately...
+	require.NoError(t, q.Publish(NewTask("render", nil, WithQueueName("web"))))
+	require.Len(t, q.buffer, 1)
+
+	// ...but tasks for other queues are saved for the nodes that consume them
+	require.NoError(t, q.Publish(NewTask("transcode", nil, WithQueueName("media"))))
+	require.Len(t, q.buffer, 1)
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, "media", storage.saved[0].QueueName)
+}
+
+func TestStart_PollsNamedQueues(t *testing.T) {
+
+	storage := &queueFilterStorage{mockStorage: mockStorage{tasks: []Task{{Name: "a", QueueName: "media"}}}}
+	q := New(WithStorage(storage), WithQueueNames("media"), WithBufferSize(1))
+
+	go q.start()
+
+	select {
+	case task := <-q.buffer:
+		require.Equal(t, "media", task.QueueName)
+	case <-time.After(time.Second):
+		t.Fatal("expected a task from the named queue")
+	}
+
+	q.Stop()
+}
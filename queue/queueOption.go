@@ -1,10 +1,22 @@
 package queue
 
+import "time"
+
 // Option is a functional option that modifies a Queue object
 type Option func(*Queue)
 
 // WithConsumers adds one or more consumers to process tasks from  the Queue
 func WithConsumers(consumers ...Consumer) Option {
+	return func(q *Queue) {
+		for _, consumer := range consumers {
+			q.consumers = append(q.consumers, consumer.withContext())
+		}
+	}
+}
+
+// WithContextConsumers adds one or more context-aware consumers to process tasks from the Queue.
+// These are called in the same order as all other consumers, so they can be mixed freely with WithConsumers.
+func WithContextConsumers(consumers ...ContextConsumer) Option {
 	return func(q *Queue) {
 		q.consumers = append(q.consumers, consumers...)
 	}
@@ -59,6 +71,107 @@ func WithDefaultRetryMax(defaultRetryMax int) Option {
 	}
 }
 
+// WithDefaultBackoff sets the BackoffStrategy used to delay retries of tasks
+// that do not name their own strategy.  The default is an exponential backoff
+// of 2^retryCount minutes.
+func WithDefaultBackoff(strategy BackoffStrategy) Option {
+	return func(q *Queue) {
+		q.defaultBackoff = strategy
+	}
+}
+
+// WithBackoffStrategy registers a named BackoffStrategy that individual tasks
+// can select with the WithBackoff TaskOption.
+func WithBackoffStrategy(name string, strategy BackoffStrategy) Option {
+	return func(q *Queue) {
+		q.backoffStrategies[name] = strategy
+	}
+}
+
+// WithDefaultTaskTimeout sets the maximum amount of time that a consumer may spend on a task.
+// Tasks can override this value with the WithTimeout TaskOption. Zero (the default) means no timeout.
+func WithDefaultTaskTimeout(timeout time.Duration) Option {
+	return func(q *Queue) {
+		q.defaultTaskTimeout = timeout
+	}
+}
+
+// WithTimeoutGracePeriod sets how long a worker waits for a consumer to return after
+// its timeout.  A consumer that is still running after that is left to finish in the
+// background: its task keeps its storage lock and its concurrency slot, and is only
+// retried once the consumer exits.  The default is 5 seconds.
+func WithTimeoutGracePeriod(gracePeriod time.Duration) Option {
+	return func(q *Queue) {
+		q.timeoutGracePeriod = gracePeriod
+	}
+}
+
+// WithRetryPanics sets whether a consumer that panics should be retried (as a queue.Error)
+// or moved straight to the error log (as a queue.Failure, the default).
+func WithRetryPanics(retryPanics bool) Option {
+	return func(q *Queue) {
+		q.retryPanics = retryPanics
+	}
+}
+
+// WithHeartbeatInterval sets how often the Queue extends the storage lock on running Tasks.
+// This only applies to Storage providers that implement LeaseExtender, and should be
+// comfortably shorter than the provider's lock timeout. Zero disables the heartbeat.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(q *Queue) {
+		q.heartbeatInterval = interval
+	}
+}
+
+// WithConcurrencyLimit sets the maximum number of tasks with the given name that
+// run at once on this node.  Tasks over the limit wait in memory without blocking a
+// worker, or (if too many are waiting) go back to storage to be picked up later.
+// A limit below one removes the limit.
+func WithConcurrencyLimit(name string, limit int) Option {
+	return func(q *Queue) {
+		q.limiter.setLimit(name, limit)
+	}
+}
+
+// WithRateLimit limits how often tasks can start, using a token bucket that refills at
+// `rate` tokens per second and holds up to `burst` tokens.  The key matches a task's
+// RateLimitKey (see WithRateLimitKey) or, if that is empty, its Name.  If the Storage
+// provider is a RateLimiter, then the limit is shared by every node.  Tasks over the
+// limit are snoozed until a token is available.  A rate at or below zero removes the limit.
+func WithRateLimit(key string, rate float64, burst int) Option {
+	return func(q *Queue) {
+		q.rateLimits.set(key, rate, burst)
+	}
+}
+
+// WithQueueNames sets the named queues (or topics) that this Queue consumes.  Use an
+// empty string to include tasks that are not assigned to a queue.  By default, a Queue
+// consumes every task.  Named queues require a Storage provider that is a QueueFilter.
+func WithQueueNames(queueNames ...string) Option {
+	return func(q *Queue) {
+		q.queueNames = queueNames
+	}
+}
+
+// WithNodeID sets the unique identifier that this Queue uses when electing a leader.
+// Every node that shares a Storage provider must have a different ID.
+func WithNodeID(nodeID string) Option {
+	return func(q *Queue) {
+		q.nodeID = nodeID
+	}
+}
+
+// WithLeaderLease sets how long this Queue remains the leader without renewing its
+// lease.  Leadership is renewed three times per lease, so a dead leader is replaced
+// within one lease.  This only applies to Storage providers that implement
+// LeaderElector.  Zero disables leader election on this node, so ScheduleRecurring
+// publishes recurring tasks directly (their signature keeps a single copy).
+func WithLeaderLease(lease time.Duration) Option {
+	return func(q *Queue) {
+		q.leaderLease = lease
+	}
+}
+
 // WithPreProcessor sets a global PreProcessor function that runs on every task before it is published.
 func WithPreProcessor(preProcessor PreProcessor) Option {
 	return func(q *Queue) {
@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -29,6 +31,16 @@ func TestWithConsumers(t *testing.T) {
 	require.Equal(t, 2, len(q.consumers))
 }
 
+func TestWithContextConsumers(t *testing.T) {
+
+	consumer := func(string, map[string]any) Result { return Success() }
+	contextConsumer := func(context.Context, string, map[string]any) Result { return Success() }
+
+	// Both kinds of consumers share a single, ordered list
+	q := New(WithConsumers(consumer), WithContextConsumers(contextConsumer, contextConsumer))
+	require.Equal(t, 3, len(q.consumers))
+}
+
 func TestWithStorage(t *testing.T) {
 	storage := &mockStorage{}
 	q := New(WithStorage(storage))
@@ -66,6 +78,60 @@ func TestWithDefaultRetryMax(t *testing.T) {
 	require.Equal(t, 2, q.defaultRetryMax)
 }
 
+func TestWithDefaultBackoff(t *testing.T) {
+	strategy := NewConstantBackoff(time.Second)
+	q := New(WithDefaultBackoff(strategy))
+	require.Equal(t, strategy, q.defaultBackoff)
+}
+
+func TestWithBackoffStrategy(t *testing.T) {
+	strategy := NewLinearBackoff(time.Second, time.Second, 0)
+	q := New(WithBackoffStrategy("linear", strategy))
+	require.Equal(t, strategy, q.backoffStrategies["linear"])
+}
+
+func TestWithDefaultTaskTimeout(t *testing.T) {
+	q := New(WithDefaultTaskTimeout(time.Minute))
+	require.Equal(t, time.Minute, q.defaultTaskTimeout)
+}
+
+func TestWithRetryPanics(t *testing.T) {
+	require.False(t, New().retryPanics)
+	require.True(t, New(WithRetryPanics(true)).retryPanics)
+}
+
+func TestWithHeartbeatInterval(t *testing.T) {
+	require.Equal(t, time.Minute, New().heartbeatInterval)
+	require.Equal(t, time.Second, New(WithHeartbeatInterval(time.Second)).heartbeatInterval)
+}
+
+func TestWithConcurrencyLimit(t *testing.T) {
+	q := New(WithConcurrencyLimit("SendEmail", 4))
+	require.Equal(t, 4, q.limiter.limits["SendEmail"])
+}
+
+func TestWithRateLimit(t *testing.T) {
+	q := New(WithRateLimit("api", 10, 5))
+	limit, ok := q.rateLimits.get("api")
+	require.True(t, ok)
+	require.Equal(t, rateLimit{rate: 10, burst: 5}, limit)
+}
+
+func TestWithQueueNames(t *testing.T) {
+	require.Empty(t, New().queueNames)
+	require.Equal(t, []string{"media", ""}, New(WithQueueNames("media", "")).queueNames)
+}
+
+func TestWithNodeID(t *testing.T) {
+	require.NotEqual(t, New().nodeID, New().nodeID) // unique by default
+	require.Equal(t, "node-1", New(WithNodeID("node-1")).nodeID)
+}
+
+func TestWithLeaderLease(t *testing.T) {
+	require.Equal(t, 30*time.Second, New().leaderLease)
+	require.Equal(t, time.Minute, New(WithLeaderLease(time.Minute)).leaderLease)
+}
+
 func TestWithPreProcessor(t *testing.T) {
 	preProcessor := func(*Task) error { return nil }
 	q := New(WithPreProcessor(preProcessor))
@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// leaseStorage is a mockStorage that also implements LeaseExtender,
+// counting every lease extension it receives.
+type leaseStorage struct {
+	mockStorage
+	mutex    sync.Mutex
+	extended []string
+}
+
+func (storage *leaseStorage) ExtendLease(task Task) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.extended = append(storage.extended, task.TaskID)
+	return nil
+}
+
+func (storage *leaseStorage) extensions() int {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return len(storage.extended)
+}
+
+func TestHeartbeat_ExtendsLeaseWhileRunning(t *testing.T) {
+
+	storage := &leaseStorage{}
+	q := New(WithStorage(storage), WithHeartbeatInterval(5*time.Millisecond), WithConsumers(func(string, map[string]any) Result {
+		time.Sleep(50 * time.Millisecond)
+		return Success()
+	}))
+
+	require.NoError(t, q.consume(Task{TaskID: "abc", LockID: "lock", Name: "x"}))
+	require.Greater(t, storage.extensions(), 1)
+
+	// Once the task is finished, the heartbeat stops
+	count := storage.extensions()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, count, storage.extensions())
+}
+
+func TestHeartbeat_SkipsUnlockedTasks(t *testing.T) {
+
+	storage := &leaseStorage{}
+	q := New(WithStorage(storage), WithHeartbeatInterval(5*time.Millisecond), WithConsumers(func(string, map[string]any) Result {
+		time.Sleep(20 * time.Millisecond)
+		return Success()
+	}))
+
+	// In-memory tasks have no lock to extend
+	require.NoError(t, q.consume(Task{Name: "x"}))
+	require.Equal(t, 0, storage.extensions())
+}
+
+func TestHeartbeat_Disabled(t *testing.T) {
+
+	storage := &leaseStorage{}
+	q := New(WithStorage(storage), WithHeartbeatInterval(0), WithConsumers(func(string, map[string]any) Result {
+		time.Sleep(20 * time.Millisecond)
+		return Success()
+	}))
+
+	require.NoError(t, q.consume(Task{TaskID: "abc", LockID: "lock", Name: "x"}))
+	require.Equal(t, 0, storage.extensions())
+}
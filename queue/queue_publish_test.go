@@ -139,6 +139,45 @@ func TestSchedule_StorageError(t *testing.T) {
 	require.Error(t, q.Schedule(NewTask("x", nil), time.Minute))
 }
 
+func TestScheduleRecurring(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage), WithRunImmediatePriority(100))
+
+	require.NoError(t, q.ScheduleRecurring("Cleanup", "*/5 * * * *", map[string]any{"k": "v"}))
+
+	// Recurring tasks always go to storage, with a signature derived from the name
+	require.Equal(t, 0, len(q.buffer))
+	require.Equal(t, 1, len(storage.saved))
+
+	task := storage.saved[0]
+	require.Equal(t, "Cleanup", task.Name)
+	require.Equal(t, "v", task.Arguments["k"])
+	require.Equal(t, "*/5 * * * *", task.Cron)
+	require.Equal(t, RecurringSignature("Cleanup"), task.Signature)
+	require.Greater(t, task.StartDate, time.Now().Unix())
+}
+
+func TestScheduleRecurring_Invalid(t *testing.T) {
+	storage := &mockStorage{}
+	q := New(WithStorage(storage))
+
+	require.Error(t, q.ScheduleRecurring("Cleanup", "every five minutes", nil))
+	require.Equal(t, 0, len(storage.saved))
+}
+
+func TestScheduleRecurring_NoStorage(t *testing.T) {
+	q := New()
+	require.Error(t, q.ScheduleRecurring("Cleanup", "@hourly", nil))
+}
+
+func TestPublish_Recurring_NoStorage(t *testing.T) {
+	// Without storage, a recurring task would run right away instead of at its next occurrence
+	q := New()
+	require.Error(t, q.Publish(NewTask("Cleanup", nil, WithCron("@hourly"))))
+	require.Equal(t, 0, len(q.buffer))
+}
+
 func TestDelete(t *testing.T) {
 
 	storage := &mockStorage{}
@@ -181,4 +220,7 @@ func TestAllowImmediate(t *testing.T) {
 
 	// A task with a signature is never immediate
 	require.False(t, q.allowImmediate(&Task{Priority: 1, Signature: "sig"}))
+
+	// A task scheduled for the future is never immediate
+	require.False(t, q.allowImmediate(&Task{Priority: 1, StartDate: time.Now().Add(time.Hour).Unix()}))
 }
@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// electorStorage is a mockStorage that also implements LeaderElector. Several
+// Queues can share one electorStorage to simulate a cluster of nodes.
+type electorStorage struct {
+	mockStorage
+	leaseMutex sync.Mutex
+	holder     string
+	expires    time.Time
+	released   []string
+	acquireErr error
+}
+
+func (e *electorStorage) AcquireLeadership(name string, nodeID string, duration time.Duration) (bool, error) {
+	e.leaseMutex.Lock()
+	defer e.leaseMutex.Unlock()
+
+	if e.acquireErr != nil {
+		return false, e.acquireErr
+	}
+
+	if e.holder != "" && e.holder != nodeID && time.Now().Before(e.expires) {
+		return false, nil
+	}
+
+	e.holder = nodeID
+	e.expires = time.Now().Add(duration)
+	return true, nil
+}
+
+func (e *electorStorage) ReleaseLeadership(name string, nodeID string) error {
+	e.leaseMutex.Lock()
+	defer e.leaseMutex.Unlock()
+
+	if e.holder == nodeID {
+		e.holder = ""
+		e.released = append(e.released, nodeID)
+	}
+	return nil
+}
+
+func (e *electorStorage) savedCount() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.saved)
+}
+
+func TestScheduleRecurring_WaitsForLeader(t *testing.T) {
+
+	storage := &electorStorage{}
+	q := New(WithStorage(storage), WithPollStorage(false), WithNodeID("node-1"))
+
+	// Until the Queue is started and elected, the task is only registered locally
+	require.NoError(t, q.ScheduleRecurring("Cleanup", "@hourly", nil))
+	require.Equal(t, 0, storage.savedCount())
+	require.False(t, q.IsLeader())
+
+	q.Start()
+	defer q.Stop()
+
+	// Once elected, the leader publishes every registered task
+	require.Eventually(t, q.IsLeader, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return storage.savedCount() == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, RecurringSignature("Cleanup"), storage.saved[0].Signature)
+
+	// Tasks registered while this node is the leader are published right away
+	require.NoError(t, q.ScheduleRecurring("Report", "@daily", nil))
+	require.Equal(t, 2, storage.savedCount())
+}
+
+func TestScheduleRecurring_ElectionDisabled(t *testing.T) {
+
+	storage := &electorStorage{}
+	q := New(WithStorage(storage), WithPollStorage(false), WithLeaderLease(0))
+
+	// Without an election, the task is published right away, even though this node never starts
+	require.NoError(t, q.ScheduleRecurring("Cleanup", "@hourly", nil))
+	require.Equal(t, 1, storage.savedCount())
+	require.Equal(t, RecurringSignature("Cleanup"), storage.saved[0].Signature)
+	require.Empty(t, q.schedules)
+}
+
+func TestScheduleRecurring_Invalid_WithElector(t *testing.T) {
+	q := New(WithStorage(&electorStorage{}))
+	require.Error(t, q.ScheduleRecurring("Cleanup", "sometimes", nil))
+	require.Empty(t, q.schedules)
+}
+
+func TestScheduler_OnlyOneLeader(t *testing.T) {
+
+	storage := &electorStorage{}
+
+	queues := make([]*Queue, 3)
+	for index := range queues {
+		queues[index] = New(WithStorage(storage), WithPollStorage(false), WithLeaderLease(time.Second))
+		require.NoError(t, queues[index].ScheduleRecurring("Cleanup", "@hourly", nil))
+		queues[index].Start()
+	}
+
+	require.Eventually(t, func() bool { return storage.savedCount() == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// Exactly one node is the leader, and only it has published the task
+	leaders := 0
+	for _, q := range queues {
+		if q.IsLeader() {
+			leaders++
+		}
+	}
+
+	require.Equal(t, 1, leaders)
+	require.Equal(t, 1, storage.savedCount())
+
+	for _, q := range queues {
+		q.Stop()
+	}
+}
+
+func TestScheduler_Failover(t *testing.T) {
+
+	storage := &electorStorage{}
+
+	first := New(WithStorage(storage), WithPollStorage(false), WithNodeID("first"), WithLeaderLease(30*time.Millisecond))
+	second := New(WithStorage(storage), WithPollStorage(false), WithNodeID("second"), WithLeaderLease(30*time.Millisecond))
+
+	first.Start()
+	require.Eventually(t, first.IsLeader, time.Second, time.Millisecond)
+
+	second.Start()
+	defer second.Stop()
+
+	// The second node waits while the first is alive...
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, second.IsLeader())
+
+	// ...and takes over when the first one stops, which releases the lease
+	first.Stop()
+	require.False(t, first.IsLeader())
+	require.Equal(t, []string{"first"}, storage.released)
+	require.Eventually(t, second.IsLeader, time.Second, time.Millisecond)
+}
+
+func TestScheduler_ExpiredLease(t *testing.T) {
+
+	// A leader that dies without releasing its lease is replaced once the lease expires
+	storage := &electorStorage{holder: "dead-node", expires: time.Now().Add(50 * time.Millisecond)}
+
+	q := New(WithStorage(storage), WithPollStorage(false), WithLeaderLease(30*time.Millisecond))
+	q.Start()
+	defer q.Stop()
+
+	require.False(t, q.IsLeader())
+	require.Eventually(t, q.IsLeader, time.Second, time.Millisecond)
+}
+
+func TestScheduler_AcquireError(t *testing.T) {
+
+	storage := &electorStorage{}
+	q := New(WithStorage(storage), WithNodeID("node-1"))
+
+	q.runElection(storage)
+	require.True(t, q.IsLeader())
+
+	// If the lease can't be confirmed, then this node stops acting as leader
+	storage.acquireErr = errors.New("db down")
+	q.runElection(storage)
+	require.False(t, q.IsLeader())
+}
+
+func TestDelete_ForgetsSchedule(t *testing.T) {
+
+	storage := &electorStorage{}
+	q := New(WithStorage(storage))
+
+	require.NoError(t, q.ScheduleRecurring("Cleanup", "@hourly", nil))
+	require.Len(t, q.schedules, 1)
+
+	require.NoError(t, q.Delete(RecurringSignature("Cleanup")))
+	require.Empty(t, q.schedules)
+}
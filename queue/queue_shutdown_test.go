@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain_FinishesBufferedTasks(t *testing.T) {
+
+	var mu sync.Mutex
+	consumed := 0
+
+	q := New(WithWorkerCount(2), WithConsumers(func(string, map[string]any) Result {
+		mu.Lock()
+		consumed++
+		mu.Unlock()
+		return Success()
+	}))
+
+	for i := 0; i < 10; i++ {
+		q.buffer <- Task{Name: "x"}
+	}
+
+	q.Start()
+
+	// Drain returns only after every buffered task has been consumed
+	require.NoError(t, q.Drain(context.Background()))
+	require.Equal(t, 10, consumed)
+	require.Equal(t, 0, len(q.buffer))
+}
+
+func TestDrain_DeadlineReleasesUnprocessedTasks(t *testing.T) {
+
+	storage := &mockStorage{}
+	started := make(chan struct{}, 10)
+
+	// This consumer runs until the Queue cancels it
+	q := New(WithStorage(storage), WithWorkerCount(1), WithContextConsumers(func(ctx context.Context, _ string, _ map[string]any) Result {
+		started <- struct{}{}
+		<-ctx.Done()
+		return Success()
+	}))
+
+	q.buffer <- Task{TaskID: "a", LockID: "lock", TimeoutDate: 100, Name: "x"}
+	q.buffer <- Task{TaskID: "b", LockID: "lock", TimeoutDate: 100, Name: "x"}
+	q.buffer <- Task{TaskID: "c", LockID: "lock", TimeoutDate: 100, Name: "x"}
+
+	q.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// The deadline passes while the first task is still running
+	require.Error(t, q.Drain(ctx))
+
+	// The two tasks that never started are handed back to storage, unlocked
+	require.Equal(t, 2, len(storage.saved))
+
+	for _, task := range storage.saved {
+		require.Contains(t, []string{"b", "c"}, task.TaskID)
+		require.Empty(t, task.LockID)
+		require.Zero(t, task.TimeoutDate)
+	}
+}
+
+func TestStopWithContext_ReleasesBuffer(t *testing.T) {
+
+	storage := &mockStorage{}
+	q := New(WithStorage(storage))
+
+	q.buffer <- Task{TaskID: "a", LockID: "lock", Name: "x"}
+	q.buffer <- Task{Name: "memory-only"}
+
+	// No workers are running, so every buffered task is released
+	require.NoError(t, q.StopWithContext(context.Background()))
+	require.Equal(t, 2, len(storage.saved))
+	require.Equal(t, 0, len(q.buffer))
+}
+
+func TestStopWithContext_NoStorage(t *testing.T) {
+
+	q := New()
+	q.buffer <- Task{Name: "x"}
+
+	// Without storage, buffered tasks cannot be released
+	require.Error(t, q.StopWithContext(context.Background()))
+}
+
+func TestStop_AfterDrain(t *testing.T) {
+
+	q := New()
+	require.NoError(t, q.Drain(context.Background()))
+
+	// Stopping an already-drained queue must not panic
+	require.NotPanics(t, q.Stop)
+}
+
+// releaseStorage is a mockStorage that also implements TaskReleaser
+type releaseStorage struct {
+	mockStorage
+	released []string
+}
+
+func (storage *releaseStorage) ReleaseTask(taskID string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.released = append(storage.released, taskID)
+	return nil
+}
+
+func TestStop_ReleasesLockedTasks(t *testing.T) {
+
+	storage := &releaseStorage{}
+	q := New(WithStorage(storage))
+
+	q.buffer <- Task{TaskID: "a", LockID: "lock", Name: "x"}
+	q.buffer <- Task{TaskID: "b", LockID: "lock", Name: "x"}
+	q.buffer <- Task{Name: "memory-only"}
+
+	q.Stop()
+
+	// Stored tasks have their locks released in place...
+	require.Equal(t, []string{"a", "b"}, storage.released)
+
+	// ...while memory-only tasks are saved so they are not lost
+	require.Equal(t, 1, len(storage.saved))
+	require.Equal(t, "memory-only", storage.saved[0].Name)
+}
@@ -96,3 +96,36 @@ func TestStartAndStop_NoStorage(t *testing.T) {
 
 	q.Stop()
 }
+
+func TestStartWorker_SurvivesPanic(t *testing.T) {
+
+	var mu sync.Mutex
+	consumed := make([]string, 0)
+
+	q := New(WithConsumers(func(name string, _ map[string]any) Result {
+		if name == "panic" {
+			panic("boom")
+		}
+
+		mu.Lock()
+		consumed = append(consumed, name)
+		mu.Unlock()
+		return Success()
+	}))
+
+	q.buffer <- Task{Name: "panic"}
+	q.buffer <- Task{Name: "after"}
+
+	q.workers.Add(1)
+	go q.startWorker()
+
+	// The worker recovers from the first task and keeps processing
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(consumed) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	q.Stop()
+	require.Equal(t, []string{"after"}, consumed)
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimit is the configuration for a single rate limit
+type rateLimit struct {
+	rate  float64 // tokens per second
+	burst int     // maximum number of tokens
+}
+
+// rateLimits holds the rate limits configured on a Queue, along with in-process
+// token buckets that enforce them when the Storage provider cannot.
+type rateLimits struct {
+	mutex   sync.Mutex
+	limits  map[string]rateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		limits:  make(map[string]rateLimit),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// set configures the rate limit for a key.  Rates at or below zero remove the limit.
+func (limits *rateLimits) set(key string, rate float64, burst int) {
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	delete(limits.buckets, key)
+
+	if rate <= 0 {
+		delete(limits.limits, key)
+		return
+	}
+
+	limits.limits[key] = rateLimit{rate: rate, burst: max(burst, 1)}
+}
+
+// get returns the rate limit for a key, if there is one
+func (limits *rateLimits) get(key string) (rateLimit, bool) {
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	limit, ok := limits.limits[key]
+	return limit, ok
+}
+
+// take tries to take a token from the in-process bucket for a key.  It returns
+// zero if a token was taken, or how long to wait before one is available.
+func (limits *rateLimits) take(key string, now time.Time) time.Duration {
+
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+
+	limit, ok := limits.limits[key]
+
+	if !ok {
+		return 0
+	}
+
+	bucket, ok := limits.buckets[key]
+
+	if !ok {
+		bucket = newTokenBucket(limit.rate, limit.burst, now)
+		limits.buckets[key] = bucket
+	}
+
+	return bucket.take(now)
+}
+
+// tokenBucket is a classic token bucket, which refills at a steady rate up to a maximum
+type tokenBucket struct {
+	rate    float64   // tokens added per second
+	burst   float64   // maximum number of tokens
+	tokens  float64   // tokens currently available
+	updated time.Time // last time that tokens were added
+}
+
+// newTokenBucket returns a full token bucket
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: now,
+	}
+}
+
+// take removes one token from the bucket.  It returns zero if a token was taken,
+// or how long to wait before one is available.
+func (bucket *tokenBucket) take(now time.Time) time.Duration {
+
+	// Refill the bucket for the time that has passed
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+		bucket.updated = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+
+	// Wait until the next whole token arrives
+	wait := (1 - bucket.tokens) / bucket.rate
+	return time.Duration(math.Ceil(wait * float64(time.Second)))
+}
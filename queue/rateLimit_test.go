@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rateLimitStorage is a mockStorage that also implements RateLimiter
+type rateLimitStorage struct {
+	mockStorage
+	limitMutex sync.Mutex
+	keys       []string
+	delay      time.Duration
+	err        error
+}
+
+func (s *rateLimitStorage) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+	s.limitMutex.Lock()
+	defer s.limitMutex.Unlock()
+
+	s.keys = append(s.keys, key)
+	return s.delay, s.err
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	now := time.Now()
+	bucket := newTokenBucket(10, 2, now)
+
+	// A full bucket allows a burst...
+	require.Zero(t, bucket.take(now))
+	require.Zero(t, bucket.take(now))
+
+	// ...then waits for the next token
+	require.Equal(t, 100*time.Millisecond, bucket.take(now))
+
+	// Tokens refill over time
+	require.Equal(t, 50*time.Millisecond, bucket.take(now.Add(50*time.Millisecond)))
+	require.Zero(t, bucket.take(now.Add(100*time.Millisecond)))
+
+	// But never beyond the burst size
+	later := now.Add(time.Hour)
+	require.Zero(t, bucket.take(later))
+	require.Zero(t, bucket.take(later))
+	require.Greater(t, bucket.take(later), time.Duration(0))
+}
+
+func TestRateLimits(t *testing.T) {
+
+	limits := newRateLimits()
+	now := time.Now()
+
+	// Keys without a limit are never delayed
+	require.Zero(t, limits.take("unlimited", now))
+
+	limits.set("api", 1, 1)
+	require.Zero(t, limits.take("api", now))
+	require.Equal(t, time.Second, limits.take("api", now))
+
+	// Removing the limit
+	limits.set("api", 0, 1)
+	_, ok := limits.get("api")
+	require.False(t, ok)
+	require.Zero(t, limits.take("api", now))
+}
+
+func TestRateLimits_MinimumBurst(t *testing.T) {
+	limits := newRateLimits()
+	limits.set("api", 5, 0)
+
+	limit, ok := limits.get("api")
+	require.True(t, ok)
+	require.Equal(t, 1, limit.burst)
+}
+
+func TestRateLimit_MemoryQueue(t *testing.T) {
+
+	var started atomic.Int32
+
+	q := New(WithWorkerCount(4), WithRateLimit("CallAPI", 20, 2), WithConsumers(func(string, map[string]any) Result {
+		started.Add(1)
+		return Success()
+	}))
+
+	q.Start()
+	defer q.Stop()
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, q.Publish(NewTask("CallAPI", nil)))
+	}
+
+	// The burst runs right away, and the rest are spread out over time
+	require.Eventually(t, func() bool { return started.Load() == 2 }, time.Second, time.Millisecond)
+	require.Less(t, started.Load(), int32(6))
+	require.Eventually(t, func() bool { return started.Load() == 6 }, time.Second, time.Millisecond)
+}
+
+func TestRateLimit_SharedKey(t *testing.T) {
+
+	q := New(WithRateLimit("mastodon.social", 1, 1))
+
+	// Tasks with different names share the limit through their key
+	require.Zero(t, q.rateLimitDelay(NewTask("Follow", nil, WithRateLimitKey("mastodon.social"))))
+	require.Greater(t, q.rateLimitDelay(NewTask("Like", nil, WithRateLimitKey("mastodon.social"))), time.Duration(0))
+
+	// Tasks without the key are not limited
+	require.Zero(t, q.rateLimitDelay(NewTask("Like", nil)))
+}
+
+func TestRateLimit_SnoozedToStorage(t *testing.T) {
+
+	storage := &rateLimitStorage{delay: 300 * time.Millisecond}
+	q := New(WithStorage(storage), WithRateLimit("CallAPI", 10, 1), WithConsumers(func(string, map[string]any) Result {
+		t.Fatal("rate-limited task must not run")
+		return Success()
+	}))
+
+	before := time.Now().Unix()
+	q.run(Task{TaskID: "abc", LockID: "lock", Name: "CallAPI", RetryCount: 2})
+
+	// The shared limiter is used, and the task is snoozed (rounded up to a whole second)
+	require.Equal(t, []string{"CallAPI"}, storage.keys)
+	require.Len(t, storage.saved, 1)
+	require.Equal(t, "abc", storage.saved[0].TaskID)
+	require.Empty(t, storage.saved[0].LockID)
+	require.Equal(t, 2, storage.saved[0].RetryCount)
+	require.InDelta(t, before+1, storage.saved[0].StartDate, 1)
+}
+
+func TestRateLimit_SharedLimiterError(t *testing.T) {
+
+	storage := &rateLimitStorage{err: errors.New("db down")}
+	q := New(WithStorage(storage), WithRateLimit("CallAPI", 1, 1))
+
+	// If the shared limiter fails, then this node's own bucket still applies
+	require.Zero(t, q.rateLimitDelay(Task{Name: "CallAPI"}))
+	require.Equal(t, time.Second, q.rateLimitDelay(Task{Name: "CallAPI"}))
+}
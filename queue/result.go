@@ -1,6 +1,10 @@
 package queue
 
-import "time"
+import (
+	"time"
+
+	"github.com/benpate/rosetta/mapof"
+)
 
 // ResultStatusIgnored represents a task that was not processed because
 // the consumer does not recognize it.  The task will be passed to
@@ -15,6 +19,11 @@ const ResultStatusSuccess = "SUCCESS"
 // for long series of tasks that need to execute over multiple records.
 const ResultStatusRequeue = "REQUEUE"
 
+// ResultStatusSnooze represents a task that is not ready to run yet
+// (for instance, because it is waiting on an external resource).  The
+// same task is run again after a delay, and this does not count as a retry.
+const ResultStatusSnooze = "SNOOZE"
+
 // ResultStatusError represents a task that was experienced an error,
 // but CAN be retried
 const ResultStatusError = "ERROR"
@@ -25,9 +34,10 @@ const ResultStatusFailure = "FAILURE"
 
 // Result is the return value from a task function
 type Result struct {
-	Status string
-	Error  error
-	Delay  time.Duration
+	Status string        // One of the ResultStatus constants
+	Error  error         // Error (if any) that caused an ERROR or FAILURE result
+	Delay  time.Duration // Delay before the task runs again (for REQUEUE and SNOOZE, or for ERROR to override the backoff strategy)
+	Output mapof.Any     // Output data (for SUCCESS) that is merged into the Arguments of the next task in a Chain
 }
 
 // IsSuccessful returns TRUE if the Result is a "SUCCESS" or "REQUEUE"
@@ -58,6 +68,17 @@ func Requeue(delay time.Duration) Result {
 	}
 }
 
+// Snooze returns a Result object that will be "SNOOZED", which puts
+// THIS task back on the queue to run again after the given delay.
+// Unlike Requeue, the task keeps its identity, and unlike Error, it
+// does not count against the task's RetryMax.
+func Snooze(delay time.Duration) Result {
+	return Result{
+		Status: ResultStatusSnooze,
+		Delay:  delay,
+	}
+}
+
 // Success returns a Result object with a status of "SUCCESS"
 func Success() Result {
 	return Result{
@@ -65,6 +86,16 @@ func Success() Result {
 	}
 }
 
+// SuccessWith returns a Result object with a status of "SUCCESS" that includes
+// output data.  If the task is part of a Chain, then the output is merged into
+// the Arguments of the next task.
+func SuccessWith(output map[string]any) Result {
+	return Result{
+		Status: ResultStatusSuccess,
+		Output: output,
+	}
+}
+
 // Error returns a Result object with a status of "ERROR"
 func Error(err error) Result {
 	return Result{
@@ -73,6 +104,19 @@ func Error(err error) Result {
 	}
 }
 
+// ErrorAfter returns a Result object with a status of "ERROR" that will be
+// retried after exactly the given delay, instead of the delay calculated by
+// the Queue's BackoffStrategy.  This is useful when the consumer knows better,
+// for instance from an upstream server's Retry-After header.  Retries still
+// count against the task's RetryMax.
+func ErrorAfter(err error, delay time.Duration) Result {
+	return Result{
+		Status: ResultStatusError,
+		Error:  err,
+		Delay:  delay,
+	}
+}
+
 // Failure returns a Result object with a status of "FAILURE"
 func Failure(err error) Result {
 	return Result{
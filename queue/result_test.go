@@ -8,6 +8,13 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestResult_SuccessWith(t *testing.T) {
+	result := SuccessWith(map[string]any{"id": 1})
+	require.Equal(t, ResultStatusSuccess, result.Status)
+	require.Equal(t, 1, result.Output["id"])
+	require.True(t, result.IsSuccessful())
+}
+
 func TestResult_Success(t *testing.T) {
 	result := Success()
 	require.Equal(t, ResultStatusSuccess, result.Status)
@@ -47,3 +54,22 @@ func TestResult_Failure(t *testing.T) {
 	require.False(t, result.IsSuccessful())
 	require.True(t, result.NotSuccessful())
 }
+
+func TestResult_ErrorAfter(t *testing.T) {
+	err := errors.New("rate limited")
+	result := ErrorAfter(err, 2*time.Minute)
+	require.Equal(t, ResultStatusError, result.Status)
+	require.Equal(t, err, result.Error)
+	require.Equal(t, 2*time.Minute, result.Delay)
+	require.False(t, result.IsSuccessful())
+	require.True(t, result.NotSuccessful())
+}
+
+func TestResult_Snooze(t *testing.T) {
+	result := Snooze(10 * time.Minute)
+	require.Equal(t, ResultStatusSnooze, result.Status)
+	require.Equal(t, 10*time.Minute, result.Delay)
+	require.Nil(t, result.Error)
+	require.False(t, result.IsSuccessful())
+	require.True(t, result.NotSuccessful())
+}
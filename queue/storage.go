@@ -1,5 +1,7 @@
 package queue
 
+import "time"
+
 // Storage is the interface for persisting Tasks outside of memory
 type Storage interface {
 
@@ -18,3 +20,89 @@ type Storage interface {
 	// LogFailure writes a Task to the error log
 	LogFailure(task Task) error
 }
+
+// LeaseExtender is an optional interface for Storage providers that lock Tasks
+// for a limited time.  While a Task is running, the Queue calls ExtendLease
+// periodically so that long-running Tasks are not reclaimed (and run twice) by
+// another worker.
+type LeaseExtender interface {
+
+	// ExtendLease pushes the lock timeout of a running Task further into the future.
+	// It should return an error if the Task is no longer locked by task.LockID.
+	ExtendLease(task Task) error
+}
+
+// TaskReleaser is an optional interface for Storage providers that lock Tasks.
+// When the Queue shuts down, it calls ReleaseTask for every Task that it locked
+// but never started, so that other nodes can pick them up immediately instead
+// of waiting for the lock to time out.
+type TaskReleaser interface {
+
+	// ReleaseTask removes the lock from a Task, making it available to other workers right away
+	ReleaseTask(taskID string) error
+}
+
+// LeaderElector is an optional interface for Storage providers that are shared
+// by many nodes.  The Queue uses it to elect a single node that registers
+// recurring tasks, so that each one is materialized exactly once.  Leadership is
+// a lease that expires unless it is renewed, so if the leader dies, another node
+// takes over automatically.
+type LeaderElector interface {
+
+	// AcquireLeadership claims (or renews) the named lease for this node. It returns
+	// TRUE if this node now holds the lease for the given duration, and FALSE if
+	// another node holds a lease that has not yet expired.
+	AcquireLeadership(name string, nodeID string, duration time.Duration) (bool, error)
+
+	// ReleaseLeadership gives up the named lease, if it is currently held by this node.
+	ReleaseLeadership(name string, nodeID string) error
+}
+
+// DependencyTracker is an optional interface for Storage providers that support
+// Workflows.  Tasks with Parents must not be returned by GetTasks until all of
+// their parents have succeeded.
+type DependencyTracker interface {
+
+	// ResolveDependents removes a successful Task from the Parents of every Task
+	// that depends on it, so that they can run once their other parents succeed.
+	ResolveDependents(taskID string) error
+
+	// CancelDependents removes every Task that depends (directly or indirectly) on
+	// a failed Task from the queue, and writes them to the error log as cancelled.
+	CancelDependents(taskID string) error
+}
+
+// BatchTracker is an optional interface for Storage providers that support Batches.
+// It counts the tasks in each Batch as they finish, so that the Queue can publish
+// the Batch's OnComplete task exactly once, after the last one.
+type BatchTracker interface {
+
+	// CreateBatch records a new Batch, before any of its tasks are published
+	CreateBatch(status BatchStatus) error
+
+	// CompleteBatchTask atomically counts one finished task in the Batch, and returns
+	// the updated counts.  Exactly one call per Batch returns a status that is Done.
+	// Each taskID is only counted once, so a Task that runs again (because DeleteTask
+	// failed after it finished) doesn't change the counts.  An empty taskID (a Task
+	// that was never stored) is always counted.
+	CompleteBatchTask(batchID string, taskID string, succeeded bool) (BatchStatus, error)
+}
+
+// RateLimiter is an optional interface for Storage providers that can share rate
+// limits across every node.  Without it, each node enforces its limits separately.
+type RateLimiter interface {
+
+	// TakeToken tries to take one token from the named bucket, which refills at `rate`
+	// tokens per second and holds up to `burst` tokens.  It returns zero if a token was
+	// taken, or how long to wait before one is available.
+	TakeToken(key string, rate float64, burst int) (time.Duration, error)
+}
+
+// QueueFilter is an optional interface for Storage providers that support named
+// queues.  Queues that consume specific queue names (see WithQueueNames) require it.
+type QueueFilter interface {
+
+	// GetTasksFromQueues retrieves a batch of Tasks, like GetTasks, but only from the
+	// named queues.  An empty name matches Tasks that are not assigned to a queue.
+	GetTasksFromQueues(queueNames []string) ([]Task, error)
+}
@@ -0,0 +1,28 @@
+package storagetest
+
+// Option is a functional option that describes the Storage being tested
+type Option func(*config)
+
+// config holds the capabilities of the Storage being tested
+type config struct {
+	expiredLocks   Factory // Makes a Storage whose locks have already timed out when they are taken
+	noLockTimeouts bool    // TRUE if the Storage never times out its locks
+}
+
+// WithExpiredLocks provides a second factory, which returns a Storage whose locks
+// time out as soon as they are taken (for example, with a negative lock timeout).
+// The suite uses it to confirm that GetTasks reclaims timed-out locks.
+func WithExpiredLocks(factory Factory) Option {
+	return func(config *config) {
+		config.expiredLocks = factory
+	}
+}
+
+// WithoutLockTimeouts declares that the Storage never times out its locks, so the
+// timeout tests are skipped.  The Queue can't recover tasks from a crashed worker
+// with such a Storage.
+func WithoutLockTimeouts() Option {
+	return func(config *config) {
+		config.noLockTimeouts = true
+	}
+}
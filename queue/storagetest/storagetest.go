@@ -0,0 +1,364 @@
+// Package storagetest provides a conformance test suite for queue.Storage providers.
+// Every provider should pass RunConformance, so that the Queue behaves the same way
+// no matter where its tasks are stored.
+package storagetest
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new, empty Storage for a single test.  Use t.Cleanup to
+// remove anything that the Storage leaves behind.
+type Factory func(t *testing.T) queue.Storage
+
+// RunConformance runs every conformance test against Storage objects made by the
+// factory.  Each test gets its own Storage.  Optional interfaces (such as
+// queue.TaskReleaser) are only tested if the Storage implements them.  Lock
+// timeouts must be declared with either WithExpiredLocks or WithoutLockTimeouts.
+func RunConformance(t *testing.T, factory Factory, options ...Option) {
+
+	config := config{}
+
+	for _, option := range options {
+		option(&config)
+	}
+
+	t.Run("SaveAndGetTasks", func(t *testing.T) { testSaveAndGetTasks(t, factory(t)) })
+	t.Run("FutureTasksWait", func(t *testing.T) { testFutureTasksWait(t, factory(t)) })
+	t.Run("LockedTasksAreNotReturnedTwice", func(t *testing.T) { testLocking(t, factory(t)) })
+	t.Run("TimedOutLocksAreReclaimed", func(t *testing.T) { testTimeoutReclaim(t, config) })
+	t.Run("RetriesKeepTheirTaskID", func(t *testing.T) { testRetry(t, factory(t)) })
+	t.Run("DeleteTask", func(t *testing.T) { testDeleteTask(t, factory(t)) })
+	t.Run("DuplicateSignatures", func(t *testing.T) { testDuplicateSignatures(t, factory(t)) })
+	t.Run("DeleteTaskBySignature", func(t *testing.T) { testDeleteTaskBySignature(t, factory(t)) })
+	t.Run("LogFailure", func(t *testing.T) { testLogFailure(t, factory(t)) })
+	t.Run("ConcurrentGetTasks", func(t *testing.T) { testConcurrentGetTasks(t, factory(t)) })
+	t.Run("ReleaseTask", func(t *testing.T) { testReleaseTask(t, factory(t)) })
+	t.Run("ExtendLease", func(t *testing.T) { testExtendLease(t, factory(t)) })
+}
+
+// testSaveAndGetTasks confirms that a saved task comes back intact, with a TaskID
+func testSaveAndGetTasks(t *testing.T, storage queue.Storage) {
+
+	task := queue.NewTask("hello", map[string]any{"key": "value"}, queue.WithPriority(5), queue.WithRetryMax(3))
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.NotEmpty(t, tasks[0].TaskID)
+	require.Equal(t, "hello", tasks[0].Name)
+	require.Equal(t, "value", tasks[0].Arguments.GetString("key"))
+	require.Equal(t, 5, tasks[0].Priority)
+	require.Equal(t, 3, tasks[0].RetryMax)
+}
+
+// testFutureTasksWait confirms that tasks are not returned before their StartDate
+func testFutureTasksWait(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("later", nil, queue.WithDelayHours(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("now", nil)))
+
+	require.Equal(t, []string{"now"}, names(drain(t, storage)))
+}
+
+// testLocking confirms that GetTasks locks the tasks that it returns
+func testLocking(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("once", nil)))
+
+	require.Len(t, drain(t, storage), 1)
+	require.Empty(t, drain(t, storage))
+}
+
+// testTimeoutReclaim confirms that a task whose lock has timed out (as left behind
+// by a worker that crashed) is locked again by the next call to GetTasks
+func testTimeoutReclaim(t *testing.T, config config) {
+
+	if config.noLockTimeouts {
+		t.Skip("Storage does not time out locks")
+	}
+
+	if config.expiredLocks == nil {
+		t.Fatal("Declare lock timeouts with storagetest.WithExpiredLocks or storagetest.WithoutLockTimeouts")
+	}
+
+	storage := config.expiredLocks(t)
+	require.NoError(t, storage.SaveTask(queue.NewTask("abandoned", nil)))
+
+	// Lock the task, then never finish it
+	first, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.NotEmpty(t, first[0].LockID)
+
+	// The lock has already timed out, so the task is locked again, by a new lock
+	second, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, second, 1)
+	require.Equal(t, first[0].TaskID, second[0].TaskID)
+	require.NotEqual(t, first[0].LockID, second[0].LockID)
+
+	// The worker that lost the lock can't extend it
+	if extender, ok := storage.(queue.LeaseExtender); ok {
+		require.Error(t, extender.ExtendLease(first[0]))
+	}
+}
+
+// testRetry confirms that a locked task can be re-saved (as the Queue does for
+// retries and snoozes), keeping its TaskID, and runs again once it is due
+func testRetry(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("flaky", nil)))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	taskID := tasks[0].TaskID
+
+	// Retry in the future
+	task := tasks[0]
+	task.LockID = ""
+	task.TimeoutDate = 0
+	task.RetryCount = 1
+	task.StartDate = time.Now().Add(time.Hour).Unix()
+	require.NoError(t, storage.SaveTask(task))
+	require.Empty(t, drain(t, storage))
+
+	// Retry now
+	task.RetryCount = 2
+	task.StartDate = time.Now().Unix()
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks = drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.Equal(t, taskID, tasks[0].TaskID)
+	require.Equal(t, 2, tasks[0].RetryCount)
+}
+
+// testDeleteTask confirms that deleted tasks (locked or not) are gone for good
+func testDeleteTask(t *testing.T, storage queue.Storage) {
+
+	// Deleting an in-memory task (without a TaskID) does nothing
+	require.NoError(t, storage.DeleteTask(""))
+
+	// Delete a locked task
+	require.NoError(t, storage.SaveTask(queue.NewTask("running", nil)))
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.NoError(t, storage.DeleteTask(tasks[0].TaskID))
+
+	// Delete an unlocked task, using a TaskID assigned before it was saved
+	task := queue.NewTask("waiting", nil)
+	task.TaskID = newTaskID(t, storage)
+	require.NoError(t, storage.SaveTask(task))
+	require.NoError(t, storage.DeleteTask(task.TaskID))
+
+	require.Empty(t, drain(t, storage))
+}
+
+// testDuplicateSignatures confirms that only one task with a signature can be
+// queued, that duplicates are dropped without an error, and that re-saving the
+// same task is not a duplicate
+func testDuplicateSignatures(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("first", nil, queue.WithSignature("sig"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("second", nil, queue.WithSignature("sig"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("other", nil, queue.WithSignature("other"))))
+
+	tasks := drain(t, storage)
+	require.ElementsMatch(t, []string{"first", "other"}, names(tasks))
+
+	// Re-saving the same (locked) task keeps it
+	first := tasks[slices.IndexFunc(tasks, func(task queue.Task) bool { return task.Name == "first" })]
+	first.LockID = ""
+	first.TimeoutDate = 0
+	require.NoError(t, storage.SaveTask(first))
+	require.Equal(t, []string{"first"}, names(drain(t, storage)))
+
+	// Once the task is deleted, the signature can be used again
+	require.NoError(t, storage.DeleteTask(first.TaskID))
+	require.NoError(t, storage.SaveTask(queue.NewTask("third", nil, queue.WithSignature("sig"))))
+	require.Equal(t, []string{"third"}, names(drain(t, storage)))
+}
+
+// testDeleteTaskBySignature confirms that tasks can be deleted by signature, and
+// that deleting a signature that isn't queued is not an error
+func testDeleteTaskBySignature(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("signed", nil, queue.WithSignature("sig"), queue.WithDelayHours(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("unsigned", nil)))
+
+	require.NoError(t, storage.DeleteTaskBySignature("sig"))
+	require.NoError(t, storage.DeleteTaskBySignature("missing"))
+
+	require.Equal(t, []string{"unsigned"}, names(drain(t, storage)))
+
+	// The signature can be used again
+	require.NoError(t, storage.SaveTask(queue.NewTask("again", nil, queue.WithSignature("sig"))))
+	require.Equal(t, []string{"again"}, names(drain(t, storage)))
+}
+
+// testLogFailure confirms that failed tasks can be logged, and that logging
+// does not put them back in the queue
+func testLogFailure(t *testing.T, storage queue.Storage) {
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("doomed", nil)))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+
+	task := tasks[0]
+	task.Error = "something went wrong"
+	require.NoError(t, storage.LogFailure(task))
+	require.NoError(t, storage.DeleteTask(task.TaskID))
+
+	require.Empty(t, drain(t, storage))
+}
+
+// testConcurrentGetTasks confirms that concurrent callers never receive the same task
+func testConcurrentGetTasks(t *testing.T, storage queue.Storage) {
+
+	const taskCount = 40
+	const workerCount = 8
+
+	for index := range taskCount {
+		require.NoError(t, storage.SaveTask(queue.NewTask(fmt.Sprintf("task-%d", index), nil)))
+	}
+
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	received := make(map[string]int)
+	errs := make(chan error, workerCount)
+
+	for range workerCount {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			// Keep polling until a poll comes back empty
+			for {
+				tasks, err := storage.GetTasks()
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if len(tasks) == 0 {
+					return
+				}
+
+				mutex.Lock()
+				for _, task := range tasks {
+					received[task.TaskID]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Len(t, received, taskCount)
+	for taskID, count := range received {
+		require.Equal(t, 1, count, "task returned more than once: %s", taskID)
+	}
+}
+
+// testReleaseTask confirms that a released task is available again, with the same TaskID
+func testReleaseTask(t *testing.T, storage queue.Storage) {
+
+	releaser, ok := storage.(queue.TaskReleaser)
+
+	if !ok {
+		t.Skip("Storage does not implement queue.TaskReleaser")
+	}
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("released", nil)))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.NoError(t, releaser.ReleaseTask(tasks[0].TaskID))
+
+	released := drain(t, storage)
+	require.Len(t, released, 1)
+	require.Equal(t, tasks[0].TaskID, released[0].TaskID)
+}
+
+// testExtendLease confirms that the lease on a locked task can be extended
+func testExtendLease(t *testing.T, storage queue.Storage) {
+
+	extender, ok := storage.(queue.LeaseExtender)
+
+	if !ok {
+		t.Skip("Storage does not implement queue.LeaseExtender")
+	}
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("long-running", nil)))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.NoError(t, extender.ExtendLease(tasks[0]))
+
+	// Extending the lease does not unlock the task
+	require.Empty(t, drain(t, storage))
+}
+
+// drain calls GetTasks until it returns nothing, and returns every task that it locked
+func drain(t *testing.T, storage queue.Storage) []queue.Task {
+	t.Helper()
+
+	result := make([]queue.Task, 0)
+
+	// Providers may return any number of tasks per call, but not forever
+	for range 1000 {
+
+		tasks, err := storage.GetTasks()
+		require.NoError(t, err)
+
+		if len(tasks) == 0 {
+			return result
+		}
+
+		result = append(result, tasks...)
+	}
+
+	t.Fatal("GetTasks never ran out of tasks")
+	return nil
+}
+
+// newTaskID returns a TaskID that the Storage accepts for a new task, by saving
+// (and deleting) a placeholder task
+func newTaskID(t *testing.T, storage queue.Storage) string {
+	t.Helper()
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("placeholder", nil)))
+
+	tasks := drain(t, storage)
+	require.Len(t, tasks, 1)
+	require.NoError(t, storage.DeleteTask(tasks[0].TaskID))
+
+	return tasks[0].TaskID
+}
+
+// names returns the names of the tasks, in order
+func names(tasks []queue.Task) []string {
+
+	result := make([]string, len(tasks))
+	for index, task := range tasks {
+		result[index] = task.Name
+	}
+
+	return result
+}
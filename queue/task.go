@@ -8,19 +8,29 @@ import (
 
 // Task wraps a Task with the metadata required to track its runs and retries.
 type Task struct {
-	TaskID      string    `bson:"taskId"`              // Unique identifier for this task
-	LockID      string    `bson:"lockId,omitempty"`    // Unique identifier for the worker that is currently processing this task
-	Name        string    `bson:"name"`                // Name of the task (used to identify the handler function)
-	Arguments   mapof.Any `bson:"arguments"`           // Data required to execute this task (marshalled as a map)
-	CreateDate  int64     `bson:"createDate"`          // Unix epoch seconds when this task was created
-	StartDate   int64     `bson:"startDate"`           // Unix epoch seconds when this task is scheduled to execute
-	TimeoutDate int64     `bson:"timeoutDate"`         // Unix epoch seconds when this task will "time out" and can be reclaimed by another process
-	Priority    int       `bson:"priority"`            // Priority of the handler, determines the order that tasks are executed in.
-	Signature   string    `bson:"signature,omitempty"` // Signature of the task.  If a signature is present, then no other tasks will be allowed with this signature.
-	RetryCount  int       `bson:"retryCount"`          // Number of times that this task has already been retried
-	RetryMax    int       `bson:"retryMax"`            // Maximum number of times that this task can be retried
-	Error       string    `bson:"error,omitempty"`     // Error (if any) from the last execution
-	AsyncDelay  int       `bson:"-"`                   // If non-zero, then the `Publish` method will execute in a separate goroutine, and will sleep for this many milliseconds before publishing the Task.
+	TaskID       string    `bson:"taskId"`                 // Unique identifier for this task
+	LockID       string    `bson:"lockId,omitempty"`       // Unique identifier for the worker that is currently processing this task
+	Name         string    `bson:"name"`                   // Name of the task (used to identify the handler function)
+	Arguments    mapof.Any `bson:"arguments"`              // Data required to execute this task (marshalled as a map)
+	CreateDate   int64     `bson:"createDate"`             // Unix epoch seconds when this task was created
+	StartDate    int64     `bson:"startDate"`              // Unix epoch seconds when this task is scheduled to execute
+	TimeoutDate  int64     `bson:"timeoutDate"`            // Unix epoch seconds when this task will "time out" and can be reclaimed by another process
+	ExpireDate   int64     `bson:"expireDate,omitempty"`   // Unix epoch seconds after which this task is discarded instead of run. Zero means the task never expires.
+	Priority     int       `bson:"priority"`               // Priority of the handler, determines the order that tasks are executed in.
+	Signature    string    `bson:"signature,omitempty"`    // Signature of the task.  If a signature is present, then no other tasks will be allowed with this signature.
+	RetryCount   int       `bson:"retryCount"`             // Number of times that this task has already been retried
+	RetryMax     int       `bson:"retryMax"`               // Maximum number of times that this task can be retried
+	Error        string    `bson:"error,omitempty"`        // Error (if any) from the last execution
+	AsyncDelay   int       `bson:"-"`                      // If non-zero, then the `Publish` method will execute in a separate goroutine, and will sleep for this many milliseconds before publishing the Task.
+	Timeout      int       `bson:"timeout,omitempty"`      // Maximum number of milliseconds that a consumer may run this task before it is cancelled. If zero, then the Queue's default timeout is used.
+	Backoff      string    `bson:"backoff,omitempty"`      // Name of the BackoffStrategy (registered with the Queue) to use when retrying this task. If empty, then the Queue's default strategy is used.
+	Cron         string    `bson:"cron,omitempty"`         // Cron expression for recurring tasks. If present, the task is rescheduled for its next occurrence after every run, instead of being removed.
+	Tenant       string    `bson:"tenant,omitempty"`       // Identifies the tenant (such as a user or domain) that this task belongs to, so that a FairScheduler can share throughput between tenants.
+	QueueName    string    `bson:"queueName,omitempty"`    // Name of the queue (or topic) that this task belongs to. Only Queues that consume this name will run it. Empty is the default queue.
+	RateLimitKey string    `bson:"rateLimitKey,omitempty"` // Name of the rate limit (registered with the Queue) that applies to this task. If empty, then the task's Name is used.
+	BatchID      string    `bson:"batchId,omitempty"`      // Identifies the Batch (if any) that this task belongs to. The Batch is notified when this task finally succeeds or fails.
+	Parents      []string  `bson:"parents,omitempty"`      // TaskIDs of the parent tasks (in a Workflow) that have not yet succeeded. A task does not run until this list is empty.
+	Next         []Task    `bson:"next,omitempty"`         // Remaining tasks in a Chain. When this task succeeds, the first one is published with this task's output merged into its Arguments.
 }
 
 // NewTask uses a Task object to create a new Task record
@@ -51,6 +61,16 @@ func NewTask(name string, arguments map[string]any, options ...TaskOption) Task
 	return result
 }
 
+// HasParents returns TRUE if this task is still waiting for parent tasks to succeed
+func (task *Task) HasParents() bool {
+	return len(task.Parents) > 0
+}
+
+// IsExpired returns TRUE if this task has an expiration date that has already passed
+func (task *Task) IsExpired() bool {
+	return task.ExpireDate > 0 && task.ExpireDate <= time.Now().Unix()
+}
+
 // Delay sets the time.Duration before the task is executed
 func (task *Task) Delay(delay time.Duration) {
 	task.StartDate = time.Now().Add(delay).Unix()
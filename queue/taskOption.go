@@ -49,6 +49,80 @@ func WithDelayHours(delayHours int) TaskOption {
 	}
 }
 
+// WithTimeout sets the maximum amount of time that a consumer may spend
+// on this task. When the timeout passes, the consumer's context is cancelled
+// and the task is retried later as though it returned a queue.Error.
+func WithTimeout(timeout time.Duration) TaskOption {
+	return func(t *Task) {
+		t.Timeout = int(timeout.Milliseconds())
+	}
+}
+
+// WithBackoff sets the name of the BackoffStrategy used to delay retries of this task.
+// The strategy itself must be registered on the Queue with WithBackoffStrategy.
+// Unrecognized names fall back to the Queue's default strategy.
+func WithBackoff(name string) TaskOption {
+	return func(t *Task) {
+		t.Backoff = name
+	}
+}
+
+// WithCron makes this a recurring task, using a standard five-field cron expression
+// (such as "0 */6 * * *").  The task's start time is set to the next occurrence,
+// and after every run (successful or not) it is rescheduled for the one after that.
+// Invalid expressions are rejected when the task is published.
+func WithCron(spec string) TaskOption {
+	return func(t *Task) {
+		t.Cron = spec
+
+		if schedule, err := ParseCron(spec); err == nil {
+			t.StartDate = schedule.Next(time.Now()).Unix()
+		}
+	}
+}
+
+// WithExpiration sets the time after which the task is no longer worth running.
+// Expired tasks are moved to the error log instead of being run.
+func WithExpiration(expireDate time.Time) TaskOption {
+	return func(t *Task) {
+		t.ExpireDate = expireDate.Unix()
+	}
+}
+
+// WithTTL sets how long (from now) the task is worth running.  Expired
+// tasks are moved to the error log instead of being run.
+func WithTTL(ttl time.Duration) TaskOption {
+	return func(t *Task) {
+		t.ExpireDate = time.Now().Add(ttl).Unix()
+	}
+}
+
+// WithTenant sets the tenant (such as a user or domain) that the task belongs to.
+// Storage providers with a FairScheduler that shares throughput by tenant use
+// this to keep one tenant's backlog from starving the others.
+func WithTenant(tenant string) TaskOption {
+	return func(t *Task) {
+		t.Tenant = tenant
+	}
+}
+
+// WithQueueName assigns the task to a named queue (or topic), so that it only runs on
+// Queues that consume that name (see WithQueueNames).
+func WithQueueName(queueName string) TaskOption {
+	return func(t *Task) {
+		t.QueueName = queueName
+	}
+}
+
+// WithRateLimitKey sets the rate limit that applies to this task, so that tasks with
+// different names can share a limit (such as the API that they all call).  The limit
+// itself is registered on the Queue with WithRateLimit.
+func WithRateLimitKey(key string) TaskOption {
+	return func(t *Task) {
+		t.RateLimitKey = key
+	}
+}
+
 // WithRetryMax sets the maximum number of times that a task can be retried
 func WithRetryMax(retryMax int) TaskOption {
 	return func(t *Task) {
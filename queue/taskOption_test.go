@@ -30,6 +30,60 @@ func TestWithAsyncDelay(t *testing.T) {
 	require.Equal(t, 250, task.AsyncDelay)
 }
 
+func TestWithTimeout(t *testing.T) {
+	task := NewTask("x", nil, WithTimeout(1500*time.Millisecond))
+	require.Equal(t, 1500, task.Timeout)
+}
+
+func TestWithBackoff(t *testing.T) {
+	task := NewTask("x", nil, WithBackoff("webhook"))
+	require.Equal(t, "webhook", task.Backoff)
+}
+
+func TestWithCron(t *testing.T) {
+	task := NewTask("x", nil, WithCron("@hourly"))
+	require.Equal(t, "@hourly", task.Cron)
+
+	// The first run is scheduled at the top of the next hour
+	start := time.Unix(task.StartDate, 0)
+	require.Greater(t, task.StartDate, time.Now().Unix())
+	require.Zero(t, start.Minute())
+	require.Zero(t, start.Second())
+}
+
+func TestWithCron_Invalid(t *testing.T) {
+	// An invalid expression leaves the start date alone; Publish rejects it later
+	task := NewTask("x", nil, WithCron("not a cron"))
+	require.Equal(t, "not a cron", task.Cron)
+	require.Equal(t, task.CreateDate, task.StartDate)
+}
+
+func TestWithExpiration(t *testing.T) {
+	expireDate := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	task := NewTask("x", nil, WithExpiration(expireDate))
+	require.Equal(t, expireDate.Unix(), task.ExpireDate)
+}
+
+func TestWithTTL(t *testing.T) {
+	task := NewTask("x", nil, WithTTL(time.Hour))
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), task.ExpireDate, 1)
+}
+
+func TestWithTenant(t *testing.T) {
+	task := NewTask("x", nil, WithTenant("example.com"))
+	require.Equal(t, "example.com", task.Tenant)
+}
+
+func TestWithQueueName(t *testing.T) {
+	task := NewTask("x", nil, WithQueueName("media"))
+	require.Equal(t, "media", task.QueueName)
+}
+
+func TestWithRateLimitKey(t *testing.T) {
+	task := NewTask("x", nil, WithRateLimitKey("api"))
+	require.Equal(t, "api", task.RateLimitKey)
+}
+
 func TestWithRetryMax(t *testing.T) {
 	task := NewTask("x", nil, WithRetryMax(3))
 	require.Equal(t, 3, task.RetryMax)
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -13,3 +14,15 @@ func TestNewTask(t *testing.T) {
 	require.Equal(t, "Hello World", task.Name)
 	require.Equal(t, "value", task.Arguments["key"])
 }
+
+func TestTask_IsExpired(t *testing.T) {
+
+	task := NewTask("x", nil)
+	require.False(t, task.IsExpired()) // no expiration
+
+	task.ExpireDate = time.Now().Add(time.Minute).Unix()
+	require.False(t, task.IsExpired())
+
+	task.ExpireDate = time.Now().Unix()
+	require.True(t, task.IsExpired())
+}
@@ -1,7 +1,11 @@
 package queue
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"math"
+	"os"
 	"time"
 )
 
@@ -13,7 +17,8 @@ import (
 // longer than any real retry policy, so this clamps nothing in practice.
 const maxBackoffExponent = 27
 
-// backoff calculates the exponential backoff time for a retry
+// backoff calculates the exponential backoff time for a retry. This is the
+// default BackoffStrategy (via BackoffFunc) for Queues that do not set their own.
 func backoff(retryCount int) time.Duration {
 
 	// Clamp the exponent to avoid overflowing time.Duration (see maxBackoffExponent)
@@ -23,3 +28,37 @@ func backoff(retryCount int) time.Duration {
 
 	return time.Duration(math.Pow(2, float64(retryCount))) * time.Minute
 }
+
+// RecurringSignature returns the signature used to identify a recurring task
+// created with Queue.ScheduleRecurring.
+func RecurringSignature(name string) string {
+	return "recurring:" + name
+}
+
+// newNodeID returns an identifier for this Queue that is unique across processes.
+// It starts with the hostname, to make leader election easier to debug.
+func newNodeID() string {
+
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+
+	hostname, err := os.Hostname()
+
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+// newTaskID returns a new, unique TaskID.  The format matches a MongoDB ObjectID
+// (a four-byte timestamp followed by eight random bytes, as 24 hex characters)
+// so that it can be used by any Storage provider, and sorts by creation time.
+func newTaskID() string {
+
+	result := make([]byte, 12)
+	binary.BigEndian.PutUint32(result, uint32(time.Now().Unix()))
+	_, _ = rand.Read(result[4:])
+
+	return hex.EncodeToString(result)
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"encoding/hex"
 	"testing"
 	"time"
 
@@ -48,3 +49,15 @@ func TestBackoff_ClampPreventsOverflow(t *testing.T) {
 	// Just below the clamp is unaffected: backoff(26) = 2^26 minutes.
 	require.Equal(t, time.Duration(1<<26)*time.Minute, backoff(26))
 }
+
+func TestNewTaskID(t *testing.T) {
+
+	first := newTaskID()
+	second := newTaskID()
+
+	require.Len(t, first, 24)
+	require.NotEqual(t, first, second)
+
+	_, err := hex.DecodeString(first)
+	require.NoError(t, err)
+}
@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"github.com/benpate/derp"
+)
+
+// Workflow is a set of Tasks that depend on one another, forming a directed
+// acyclic graph.  Each Task runs only after all of its parents have succeeded.
+// If a parent fails permanently, then every Task that depends on it is cancelled.
+// Workflows require a Storage provider that implements DependencyTracker.
+type Workflow struct {
+	tasks []Task
+	index map[string]int
+	err   error
+}
+
+// NewWorkflow returns a new, empty Workflow
+func NewWorkflow() *Workflow {
+	return &Workflow{
+		tasks: make([]Task, 0),
+		index: make(map[string]int),
+	}
+}
+
+// Add includes a Task in the Workflow, which will run after all of the `dependsOn`
+// Tasks have succeeded.  It returns the TaskID (assigning one if necessary), which
+// later Tasks can depend on.  Parents must be added to the Workflow before their
+// children, which guarantees that the Workflow has no cycles.
+func (workflow *Workflow) Add(task Task, dependsOn ...string) string {
+
+	const location = "queue.Workflow.Add"
+
+	if task.TaskID == "" {
+		task.TaskID = newTaskID()
+	}
+
+	// RULE: TaskIDs must be unique within the Workflow
+	if _, exists := workflow.index[task.TaskID]; exists {
+		workflow.fail(derp.BadRequest(location, "Duplicate TaskID in workflow", task.TaskID))
+		return task.TaskID
+	}
+
+	// RULE: Parents must already be in the Workflow
+	for _, parentID := range dependsOn {
+		if _, exists := workflow.index[parentID]; !exists {
+			workflow.fail(derp.BadRequest(location, "Parent task must be added to the workflow first", task.Name, parentID))
+			return task.TaskID
+		}
+	}
+
+	// Recurring tasks never finish, so they cannot be part of a workflow
+	if task.Cron != "" {
+		workflow.fail(derp.BadRequest(location, "Recurring tasks cannot be added to a workflow", task.Name))
+		return task.TaskID
+	}
+
+	// Signed tasks may be dropped as duplicates, which would strand their dependents
+	if task.Signature != "" {
+		workflow.fail(derp.BadRequest(location, "Signed tasks cannot be added to a workflow", task.Name, task.Signature))
+		return task.TaskID
+	}
+
+	task.Parents = append(task.Parents, dependsOn...)
+	workflow.index[task.TaskID] = len(workflow.tasks)
+	workflow.tasks = append(workflow.tasks, task)
+
+	return task.TaskID
+}
+
+// Tasks returns all of the Tasks in the Workflow, with their Parents set,
+// in the order that they were added.
+func (workflow *Workflow) Tasks() []Task {
+	return workflow.tasks
+}
+
+// Error returns the first error (if any) from adding Tasks to the Workflow
+func (workflow *Workflow) Error() error {
+	return workflow.err
+}
+
+// fail records the first error from building the Workflow
+func (workflow *Workflow) fail(err error) {
+	if workflow.err == nil {
+		workflow.err = err
+	}
+}
+
+// PublishWorkflow adds every Task in a Workflow to the Queue.  Tasks are published
+// children-first, so that no Task can run (and resolve its dependents) before
+// all of its dependents have been saved.
+func (q *Queue) PublishWorkflow(workflow *Workflow) error {
+
+	const location = "queue.Queue.PublishWorkflow"
+
+	if err := workflow.Error(); err != nil {
+		return derp.Wrap(err, location, "Invalid workflow")
+	}
+
+	if _, ok := q.storage.(DependencyTracker); !ok {
+		return derp.Internal(location, "Storage provider does not support workflows")
+	}
+
+	tasks := workflow.Tasks()
+
+	for index := len(tasks) - 1; index >= 0; index-- {
+		if err := q.Publish(tasks[index]); err != nil {
+			return derp.Wrap(err, location, "Unable to publish workflow task", tasks[index].Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// trackerStorage is a mockStorage that also implements DependencyTracker
+type trackerStorage struct {
+	mockStorage
+	trackerMutex sync.Mutex
+	resolved     []string
+	cancelled    []string
+	resolveErr   error
+}
+
+func (s *trackerStorage) ResolveDependents(taskID string) error {
+	s.trackerMutex.Lock()
+	defer s.trackerMutex.Unlock()
+
+	if s.resolveErr != nil {
+		return s.resolveErr
+	}
+	s.resolved = append(s.resolved, taskID)
+	return nil
+}
+
+func (s *trackerStorage) CancelDependents(taskID string) error {
+	s.trackerMutex.Lock()
+	defer s.trackerMutex.Unlock()
+
+	s.cancelled = append(s.cancelled, taskID)
+	return nil
+}
+
+func TestWorkflow_Add(t *testing.T) {
+
+	workflow := NewWorkflow()
+
+	// Fan-out, then fan-in
+	fetch := workflow.Add(NewTask("fetch", nil))
+	resize := workflow.Add(NewTask("resize", nil), fetch)
+	scan := workflow.Add(NewTask("scan", nil), fetch)
+	publish := workflow.Add(NewTask("publish", nil), resize, scan)
+
+	require.NoError(t, workflow.Error())
+	require.Len(t, fetch, 24)
+
+	tasks := workflow.Tasks()
+	require.Len(t, tasks, 4)
+	require.Empty(t, tasks[0].Parents)
+	require.Equal(t, []string{fetch}, tasks[1].Parents)
+	require.Equal(t, []string{fetch}, tasks[2].Parents)
+	require.Equal(t, []string{resize, scan}, tasks[3].Parents)
+	require.Equal(t, publish, tasks[3].TaskID)
+}
+
+func TestWorkflow_Add_KeepsTaskID(t *testing.T) {
+	workflow := NewWorkflow()
+	require.Equal(t, "my-id", workflow.Add(Task{TaskID: "my-id", Name: "x"}))
+}
+
+func TestWorkflow_Add_UnknownParent(t *testing.T) {
+
+	// Parents must be added first, so a workflow can never contain a cycle
+	workflow := NewWorkflow()
+	workflow.Add(NewTask("x", nil), "not-in-workflow")
+	require.Error(t, workflow.Error())
+	require.Empty(t, workflow.Tasks())
+}
+
+func TestWorkflow_Add_DuplicateTaskID(t *testing.T) {
+	workflow := NewWorkflow()
+	workflow.Add(Task{TaskID: "same"})
+	workflow.Add(Task{TaskID: "same"})
+	require.Error(t, workflow.Error())
+}
+
+func TestWorkflow_Add_Recurring(t *testing.T) {
+	workflow := NewWorkflow()
+	workflow.Add(NewTask("x", nil, WithCron("@daily")))
+	require.Error(t, workflow.Error())
+}
+
+func TestWorkflow_Add_Signed(t *testing.T) {
+	workflow := NewWorkflow()
+	parent := workflow.Add(NewTask("parent", nil, WithSignature("abc")))
+	workflow.Add(NewTask("child", nil), parent)
+	require.Error(t, workflow.Error())
+}
+
+func TestPublishWorkflow(t *testing.T) {
+
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage), WithRunImmediatePriority(-1))
+
+	workflow := NewWorkflow()
+	first := workflow.Add(NewTask("first", nil))
+	second := workflow.Add(NewTask("second", nil), first)
+
+	require.NoError(t, q.PublishWorkflow(workflow))
+
+	// Children are saved before their parents
+	require.Len(t, storage.saved, 2)
+	require.Equal(t, second, storage.saved[0].TaskID)
+	require.Equal(t, []string{first}, storage.saved[0].Parents)
+	require.Equal(t, first, storage.saved[1].TaskID)
+}
+
+func TestPublishWorkflow_Invalid(t *testing.T) {
+
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage))
+
+	workflow := NewWorkflow()
+	workflow.Add(NewTask("x", nil), "missing")
+
+	require.Error(t, q.PublishWorkflow(workflow))
+	require.Empty(t, storage.saved)
+}
+
+func TestPublishWorkflow_Unsupported(t *testing.T) {
+
+	workflow := NewWorkflow()
+	workflow.Add(NewTask("x", nil))
+
+	// Neither memory-only queues nor storage without dependency tracking can run workflows
+	require.Error(t, New().PublishWorkflow(workflow))
+	require.Error(t, New(WithStorage(&mockStorage{})).PublishWorkflow(workflow))
+}
+
+func TestPublish_ParentsRequireTracker(t *testing.T) {
+	q := New(WithStorage(&mockStorage{}))
+	require.Error(t, q.Publish(Task{Name: "x", Parents: []string{"abc"}}))
+}
+
+func TestPublish_ParentsWithSignature(t *testing.T) {
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage))
+	require.Error(t, q.Publish(Task{Name: "x", Parents: []string{"abc"}, Signature: "def"}))
+	require.Empty(t, storage.saved)
+}
+
+func TestAllowImmediate_Parents(t *testing.T) {
+	q := New(WithRunImmediatePriority(10))
+	require.False(t, q.allowImmediate(&Task{Priority: 1, Parents: []string{"abc"}}))
+}
+
+func TestConsume_Success_ResolvesDependents(t *testing.T) {
+
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x"}))
+	require.Equal(t, []string{"abc"}, storage.resolved)
+	require.Equal(t, []string{"abc"}, storage.deleted)
+	require.Empty(t, storage.cancelled)
+}
+
+func TestConsume_Success_ResolveError(t *testing.T) {
+
+	storage := &trackerStorage{resolveErr: errors.New("db down")}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Success()
+	}))
+
+	// The task is kept, so that it can run again and release its dependents
+	require.Error(t, q.consume(Task{TaskID: "abc", Name: "x"}))
+	require.Empty(t, storage.deleted)
+}
+
+func TestConsume_Failure_CancelsDependents(t *testing.T) {
+
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Failure(errors.New("permanent"))
+	}))
+
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x"}))
+	require.Equal(t, []string{"abc"}, storage.cancelled)
+	require.Empty(t, storage.resolved)
+}
+
+func TestConsume_Error_DoesNotCancelDependents(t *testing.T) {
+
+	storage := &trackerStorage{}
+	q := New(WithStorage(storage), WithConsumers(func(string, map[string]any) Result {
+		return Error(errors.New("temporary"))
+	}))
+
+	// A retryable error leaves the dependents waiting
+	require.NoError(t, q.consume(Task{TaskID: "abc", Name: "x", RetryMax: 3}))
+	require.Empty(t, storage.cancelled)
+	require.Empty(t, storage.resolved)
+}
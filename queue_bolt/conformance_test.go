@@ -0,0 +1,18 @@
+package queue_bolt
+
+import (
+	"testing"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return testStorage(t, 32)
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		storage := testStorage(t, 32)
+		storage.timeoutMinutes = -1
+		return storage
+	}))
+}
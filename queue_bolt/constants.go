@@ -0,0 +1,26 @@
+package queue_bolt
+
+// BucketTasks is the name of the bucket where queued tasks are stored, by TaskID
+const BucketTasks = "Queue"
+
+// BucketWaiting is the name of the index bucket for tasks that are waiting for their
+// StartDate (or their lock timeout), ordered by the time that they become available
+const BucketWaiting = "QueueWaiting"
+
+// BucketReady is the name of the index bucket for tasks that are ready to run,
+// ordered by priority and then by StartDate
+const BucketReady = "QueueReady"
+
+// BucketSignatures is the name of the bucket that maps task signatures to TaskIDs
+const BucketSignatures = "QueueSignatures"
+
+// BucketDependents is the name of the bucket that holds one nested bucket per parent
+// task, listing the TaskIDs of the tasks that depend on it
+const BucketDependents = "QueueDependents"
+
+// BucketLog is the name of the bucket where permanently-failed tasks are stored
+const BucketLog = "QueueErrors"
+
+// BucketBatch is the name of the bucket where batch counters (and the TaskIDs that
+// they have counted) are stored
+const BucketBatch = "QueueBatches"
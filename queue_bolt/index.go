@@ -0,0 +1,209 @@
+package queue_bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/benpate/turbine/queue"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// loadTask reads a task from the tasks bucket.  It returns FALSE if the task does not exist.
+func loadTask(tx *bbolt.Tx, taskID string) (queue.Task, bool, error) {
+
+	result := queue.Task{}
+	value := tx.Bucket([]byte(BucketTasks)).Get([]byte(taskID))
+
+	if value == nil {
+		return result, false, nil
+	}
+
+	if err := bson.Unmarshal(value, &result); err != nil {
+		return result, false, err
+	}
+
+	return result, true, nil
+}
+
+// putTask writes a task to the tasks bucket, replacing the index entries of its previous
+// version (if any).  Tasks with parents are not indexed, so that they can't be returned
+// by GetTasks until their parents succeed.
+func putTask(tx *bbolt.Tx, task queue.Task) error {
+
+	previous, exists, err := loadTask(tx, task.TaskID)
+
+	if err != nil {
+		return err
+	}
+
+	if exists {
+
+		if err := unindexTask(tx, previous); err != nil {
+			return err
+		}
+
+		if previous.Signature != task.Signature {
+			if err := releaseSignature(tx, previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	value, err := bson.Marshal(task)
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket([]byte(BucketTasks)).Put([]byte(task.TaskID), value); err != nil {
+		return err
+	}
+
+	if task.HasParents() {
+		return nil
+	}
+
+	return tx.Bucket([]byte(BucketWaiting)).Put(waitingKey(task), []byte(task.TaskID))
+}
+
+// removeTask deletes a task, its index entries, and its signature.  It returns FALSE
+// if the task does not exist.
+func removeTask(tx *bbolt.Tx, taskID string) (queue.Task, bool, error) {
+
+	task, exists, err := loadTask(tx, taskID)
+
+	if err != nil || !exists {
+		return task, false, err
+	}
+
+	if err := unindexTask(tx, task); err != nil {
+		return task, false, err
+	}
+
+	if err := releaseSignature(tx, task); err != nil {
+		return task, false, err
+	}
+
+	if err := tx.Bucket([]byte(BucketTasks)).Delete([]byte(taskID)); err != nil {
+		return task, false, err
+	}
+
+	return task, true, nil
+}
+
+// unindexTask removes a task from both index buckets.  A task is only ever in one of
+// them, but deleting a missing key is not an error, so there's no need to check which.
+func unindexTask(tx *bbolt.Tx, task queue.Task) error {
+
+	if err := tx.Bucket([]byte(BucketWaiting)).Delete(waitingKey(task)); err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BucketReady)).Delete(readyKey(task))
+}
+
+// promoteTasks moves every task that has become available by `now` from the
+// waiting index into the ready index
+func promoteTasks(tx *bbolt.Tx, now int64) error {
+
+	waiting := tx.Bucket([]byte(BucketWaiting))
+	ready := tx.Bucket([]byte(BucketReady))
+
+	// Collect the keys first, because deleting while iterating can skip keys
+	due := make([][]byte, 0)
+	cursor := waiting.Cursor()
+
+	for key, _ := cursor.First(); key != nil && decodeInt(key) <= now; key, _ = cursor.Next() {
+		due = append(due, bytes.Clone(key))
+	}
+
+	for _, key := range due {
+
+		if err := waiting.Delete(key); err != nil {
+			return err
+		}
+
+		task, exists, err := loadTask(tx, string(key[8:]))
+
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		if err := ready.Put(readyKey(task), []byte(task.TaskID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseSignature removes a task's signature, if the task owns it
+func releaseSignature(tx *bbolt.Tx, task queue.Task) error {
+
+	if task.Signature == "" {
+		return nil
+	}
+
+	signatures := tx.Bucket([]byte(BucketSignatures))
+
+	if string(signatures.Get([]byte(task.Signature))) != task.TaskID {
+		return nil
+	}
+
+	return signatures.Delete([]byte(task.Signature))
+}
+
+// logFailure appends a task to the failure log
+func logFailure(tx *bbolt.Tx, task queue.Task) error {
+
+	bucket := tx.Bucket([]byte(BucketLog))
+	sequence, err := bucket.NextSequence()
+
+	if err != nil {
+		return err
+	}
+
+	value, err := bson.Marshal(task)
+
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(binary.BigEndian.AppendUint64(nil, sequence), value)
+}
+
+// waitingKey returns the key of a task in the waiting index: the time that the task
+// becomes available (its StartDate, or its lock timeout if that is later), then its TaskID
+func waitingKey(task queue.Task) []byte {
+
+	availableAt := task.StartDate
+
+	if task.LockID != "" && task.TimeoutDate > availableAt {
+		availableAt = task.TimeoutDate
+	}
+
+	return append(encodeInt(availableAt), task.TaskID...)
+}
+
+// readyKey returns the key of a task in the ready index: its priority, then its
+// StartDate, then its TaskID (which is roughly the order that tasks were created)
+func readyKey(task queue.Task) []byte {
+	key := append(encodeInt(int64(task.Priority)), encodeInt(task.StartDate)...)
+	return append(key, task.TaskID...)
+}
+
+// encodeInt encodes a number as 8 big-endian bytes, with the sign bit flipped so that
+// negative numbers sort before positive ones
+func encodeInt(value int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(value)^(1<<63))
+}
+
+// decodeInt decodes the number at the start of a key that was made by encodeInt
+func decodeInt(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]) ^ (1 << 63))
+}
@@ -0,0 +1,2 @@
+// Package queue_bolt provides a queue storage backed by an embedded bbolt database
+package queue_bolt
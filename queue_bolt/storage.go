@@ -0,0 +1,551 @@
+package queue_bolt
+
+import (
+	"slices"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/turbine/queue"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage implements a queue Storage interface using an embedded bbolt database
+type Storage struct {
+	database       *bbolt.DB // The bbolt database to read/write
+	lockQuantity   int       // The number of tasks to lock at a time
+	timeoutMinutes int       // Number of minutes to lock tasks before they are considered "timed out"
+}
+
+// New returns a fully initialized Storage object, creating the buckets that it
+// needs in the database if they do not already exist
+func New(database *bbolt.DB, lockQuantity int, timeoutMinutes int) (Storage, error) {
+
+	const location = "queue_bolt.New"
+
+	result := Storage{
+		database:       database,
+		lockQuantity:   lockQuantity,
+		timeoutMinutes: timeoutMinutes,
+	}
+
+	err := database.Update(func(tx *bbolt.Tx) error {
+
+		for _, name := range []string{BucketTasks, BucketWaiting, BucketReady, BucketSignatures, BucketDependents, BucketLog, BucketBatch} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return Storage{}, derp.Wrap(err, location, "Unable to create buckets")
+	}
+
+	return result, nil
+}
+
+// SaveTask adds/updates a task to the queue
+func (storage Storage) SaveTask(task queue.Task) error {
+
+	const location = "queue_bolt.SaveTask"
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Msg("Saving Task...")
+
+	// New tasks get a new TaskID. Existing tasks (retries, releases) keep theirs.
+	if task.TaskID == "" {
+		task.TaskID = primitive.NewObjectID().Hex()
+	}
+
+	duplicate := false
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		signatures := tx.Bucket([]byte(BucketSignatures))
+
+		if task.Signature != "" {
+
+			// If another task has the same signature, then do not save this one.
+			if owner := signatures.Get([]byte(task.Signature)); owner != nil && string(owner) != task.TaskID {
+				duplicate = true
+				return nil
+			}
+
+			if err := signatures.Put([]byte(task.Signature), []byte(task.TaskID)); err != nil {
+				return err
+			}
+		}
+
+		// Remember which tasks are waiting for each parent
+		for _, parentID := range task.Parents {
+
+			dependents, err := tx.Bucket([]byte(BucketDependents)).CreateBucketIfNotExists([]byte(parentID))
+
+			if err != nil {
+				return err
+			}
+
+			if err := dependents.Put([]byte(task.TaskID), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return putTask(tx, task)
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to save task", task.TaskID)
+	}
+
+	if duplicate {
+		log.Trace().
+			Str("location", location).
+			Str("task", task.Name).
+			Str("signature", task.Signature).
+			Msg("Duplicate signature. Task not saved.")
+	}
+
+	return nil
+}
+
+// DeleteTask removes a task from the queue
+func (storage Storage) DeleteTask(taskID string) error {
+
+	const location = "queue_bolt.DeleteTask"
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+		_, _, err := removeTask(tx, taskID)
+		return err
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to delete task", taskID)
+	}
+
+	return nil
+}
+
+// DeleteTaskBySignature removes a task from the queue by its signature
+func (storage Storage) DeleteTaskBySignature(signature string) error {
+
+	const location = "queue_bolt.DeleteTaskBySignature"
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		taskID := tx.Bucket([]byte(BucketSignatures)).Get([]byte(signature))
+
+		if taskID == nil {
+			return nil
+		}
+
+		_, _, err := removeTask(tx, string(taskID))
+		return err
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to delete task", signature)
+	}
+
+	return nil
+}
+
+// LogFailure adds a task to the failure log
+func (storage Storage) LogFailure(task queue.Task) error {
+
+	const location = "queue_bolt.LogFailure"
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+		return logFailure(tx, task)
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to log failure", task.TaskID)
+	}
+
+	return nil
+}
+
+// Failures returns the failed tasks in the failure log, oldest first
+func (storage Storage) Failures() ([]queue.Task, error) {
+
+	const location = "queue_bolt.Failures"
+
+	result := make([]queue.Task, 0)
+
+	err := storage.database.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BucketLog)).ForEach(func(_ []byte, value []byte) error {
+
+			task := queue.Task{}
+
+			if err := bson.Unmarshal(value, &task); err != nil {
+				return err
+			}
+
+			result = append(result, task)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to read failure log")
+	}
+
+	return result, nil
+}
+
+// GetTasks locks and returns the next batch of tasks, in priority order
+func (storage Storage) GetTasks() ([]queue.Task, error) {
+	return storage.getTasks(nil)
+}
+
+// GetTasksFromQueues locks and returns the next batch of tasks, like GetTasks,
+// but only from the named queues.  An empty name matches tasks that are not
+// assigned to a queue.
+func (storage Storage) GetTasksFromQueues(queueNames []string) ([]queue.Task, error) {
+
+	if len(queueNames) == 0 {
+		return make([]queue.Task, 0), nil
+	}
+
+	return storage.getTasks(queueNames)
+}
+
+// ExtendLease pushes the lock timeout of a running task further into the future
+func (storage Storage) ExtendLease(task queue.Task) error {
+
+	const location = "queue_bolt.ExtendLease"
+
+	return storage.database.Update(func(tx *bbolt.Tx) error {
+
+		current, exists, err := loadTask(tx, task.TaskID)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to load task", task.TaskID)
+		}
+
+		// Only extend the lease if this worker still holds the lock
+		if !exists || task.LockID == "" || current.LockID != task.LockID {
+			return derp.NotFound(location, "Task is no longer locked by this worker", task.TaskID, task.LockID)
+		}
+
+		current.TimeoutDate = storage.timeoutDate(time.Now())
+
+		if err := putTask(tx, current); err != nil {
+			return derp.Wrap(err, location, "Unable to extend lease", task.TaskID)
+		}
+
+		return nil
+	})
+}
+
+// ReleaseTask removes the lock from a task, so that it can be returned by GetTasks again
+func (storage Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_bolt.ReleaseTask"
+
+	return storage.database.Update(func(tx *bbolt.Tx) error {
+
+		current, exists, err := loadTask(tx, taskID)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to load task", taskID)
+		}
+
+		if !exists {
+			return derp.NotFound(location, "Task not found", taskID)
+		}
+
+		current.LockID = ""
+		current.TimeoutDate = 0
+
+		if err := putTask(tx, current); err != nil {
+			return derp.Wrap(err, location, "Unable to release task", taskID)
+		}
+
+		return nil
+	})
+}
+
+// ResolveDependents removes a successful task from the parents of every task that
+// depends on it.  Tasks whose parents have all succeeded become available to GetTasks.
+func (storage Storage) ResolveDependents(taskID string) error {
+
+	const location = "queue_bolt.ResolveDependents"
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		dependentIDs, err := takeDependents(tx, taskID)
+
+		if err != nil {
+			return err
+		}
+
+		for _, dependentID := range dependentIDs {
+
+			dependent, exists, err := loadTask(tx, dependentID)
+
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				continue
+			}
+
+			dependent.Parents = slices.DeleteFunc(dependent.Parents, func(parentID string) bool {
+				return parentID == taskID
+			})
+
+			if err := putTask(tx, dependent); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to resolve dependents", taskID)
+	}
+
+	return nil
+}
+
+// CancelDependents moves every task that depends (directly or indirectly) on a
+// failed task from the queue into the failure log, marked as cancelled.
+func (storage Storage) CancelDependents(taskID string) error {
+
+	const location = "queue_bolt.CancelDependents"
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		// Walk the graph one generation at a time
+		failed := []string{taskID}
+
+		for len(failed) > 0 {
+
+			parentID := failed[0]
+			failed = failed[1:]
+
+			dependentIDs, err := takeDependents(tx, parentID)
+
+			if err != nil {
+				return err
+			}
+
+			for _, dependentID := range dependentIDs {
+
+				dependent, exists, err := removeTask(tx, dependentID)
+
+				if err != nil {
+					return err
+				}
+
+				if !exists {
+					continue
+				}
+
+				dependent.Error = derp.Serialize(derp.Internal(location, "Task cancelled because a parent task failed", parentID))
+
+				if err := logFailure(tx, dependent); err != nil {
+					return err
+				}
+
+				failed = append(failed, dependentID)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to cancel dependents", taskID)
+	}
+
+	return nil
+}
+
+// batchRecord is a batch counter, along with the TaskIDs that it has already counted
+type batchRecord struct {
+	queue.BatchStatus `bson:",inline"`
+	Finished          []string `bson:"finished"`
+}
+
+// CreateBatch records a new batch, so that its tasks can be counted as they finish
+func (storage Storage) CreateBatch(status queue.BatchStatus) error {
+
+	const location = "queue_bolt.CreateBatch"
+
+	value, err := bson.Marshal(status)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to encode batch", status.BatchID)
+	}
+
+	err = storage.database.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BucketBatch)).Put([]byte(status.BatchID), value)
+	})
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to create batch", status.BatchID)
+	}
+
+	return nil
+}
+
+// CompleteBatchTask counts one finished task in a batch, once per taskID.  The call
+// that finishes the batch also removes it, so that it is only completed once.
+func (storage Storage) CompleteBatchTask(batchID string, taskID string, succeeded bool) (queue.BatchStatus, error) {
+
+	const location = "queue_bolt.CompleteBatchTask"
+
+	record := batchRecord{}
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		bucket := tx.Bucket([]byte(BucketBatch))
+		value := bucket.Get([]byte(batchID))
+
+		if value == nil {
+			return derp.NotFound(location, "Batch not found", batchID)
+		}
+
+		if err := bson.Unmarshal(value, &record); err != nil {
+			return derp.Wrap(err, location, "Unable to decode batch", batchID)
+		}
+
+		// Tasks that have already been counted are not counted again
+		if taskID != "" {
+
+			if slices.Contains(record.Finished, taskID) {
+				return nil
+			}
+
+			record.Finished = append(record.Finished, taskID)
+		}
+
+		if succeeded {
+			record.Succeeded++
+		} else {
+			record.Failed++
+		}
+
+		if record.Done() {
+			return bucket.Delete([]byte(batchID))
+		}
+
+		value, err := bson.Marshal(record)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to encode batch", batchID)
+		}
+
+		return bucket.Put([]byte(batchID), value)
+	})
+
+	if err != nil {
+		return record.BatchStatus, derp.Wrap(err, location, "Unable to update batch", batchID)
+	}
+
+	return record.BatchStatus, nil
+}
+
+// getTasks locks and returns the next batch of tasks.  If queueNames is
+// not nil, then only tasks from those queues are locked.
+func (storage Storage) getTasks(queueNames []string) ([]queue.Task, error) {
+
+	const location = "queue_bolt.getTasks"
+
+	result := make([]queue.Task, 0)
+
+	err := storage.database.Update(func(tx *bbolt.Tx) error {
+
+		now := time.Now()
+
+		// Move tasks that have become available into the ready index
+		if err := promoteTasks(tx, now.Unix()); err != nil {
+			return err
+		}
+
+		// Read the next tasks in priority order, skipping tasks from other queues
+		cursor := tx.Bucket([]byte(BucketReady)).Cursor()
+
+		for key, value := cursor.First(); key != nil && (storage.lockQuantity <= 0 || len(result) < storage.lockQuantity); key, value = cursor.Next() {
+
+			task, exists, err := loadTask(tx, string(value))
+
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				continue
+			}
+
+			if queueNames != nil && !slices.Contains(queueNames, task.QueueName) {
+				continue
+			}
+
+			result = append(result, task)
+		}
+
+		// Lock them (which moves them back into the waiting index until the lock times out)
+		for index := range result {
+
+			result[index].LockID = primitive.NewObjectID().Hex()
+			result[index].TimeoutDate = storage.timeoutDate(now)
+
+			if err := putTask(tx, result[index]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to lock tasks")
+	}
+
+	return result, nil
+}
+
+// timeoutDate returns the Unix time when a lock taken at `now` times out
+func (storage Storage) timeoutDate(now time.Time) int64 {
+	return now.Add(time.Duration(storage.timeoutMinutes) * time.Minute).Unix()
+}
+
+// takeDependents returns the TaskIDs of the tasks that depend on a parent task,
+// and forgets them, because a parent only finishes once
+func takeDependents(tx *bbolt.Tx, parentID string) ([]string, error) {
+
+	bucket := tx.Bucket([]byte(BucketDependents))
+	dependents := bucket.Bucket([]byte(parentID))
+	result := make([]string, 0)
+
+	if dependents == nil {
+		return result, nil
+	}
+
+	err := dependents.ForEach(func(key []byte, _ []byte) error {
+		result = append(result, string(key))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bucket.DeleteBucket([]byte(parentID)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,250 @@
+package queue_bolt
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestStorage_ImplementsInterface(_ *testing.T) {
+	var _ queue.Storage = Storage{}
+	var _ queue.LeaseExtender = Storage{}
+	var _ queue.TaskReleaser = Storage{}
+	var _ queue.DependencyTracker = Storage{}
+	var _ queue.BatchTracker = Storage{}
+	var _ queue.QueueFilter = Storage{}
+}
+
+func TestNew_Reopen(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "queue.db")
+
+	// Save a task, then close the database
+	database, err := bbolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+
+	storage, err := New(database, 32, 5)
+	require.NoError(t, err)
+	require.NoError(t, storage.SaveTask(queue.NewTask("durable", nil, queue.WithSignature("durable"))))
+	require.NoError(t, database.Close())
+
+	// The task (and its signature) survive reopening the database
+	database, err = bbolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+	defer database.Close()
+
+	storage, err = New(database, 32, 5)
+	require.NoError(t, err)
+	require.NoError(t, storage.SaveTask(queue.NewTask("durable", nil, queue.WithSignature("durable"))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"durable"}, names(tasks))
+}
+
+func TestGetTasks_PriorityOrder(t *testing.T) {
+
+	storage := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("negative", nil, queue.WithPriority(-5))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("medium", nil, queue.WithPriority(10))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"negative", "high", "medium", "low"}, names(tasks))
+}
+
+func TestGetTasks_LockQuantity(t *testing.T) {
+
+	storage := testStorage(t, 2)
+
+	for range 5 {
+		require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+	}
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.NotEmpty(t, tasks[0].LockID)
+	require.Greater(t, tasks[0].TimeoutDate, time.Now().Add(4*time.Minute).Unix())
+}
+
+func TestExtendLease(t *testing.T) {
+
+	storage := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	require.NoError(t, storage.ExtendLease(tasks[0]))
+
+	// A worker that doesn't hold the lock can't extend it
+	stolen := tasks[0]
+	stolen.LockID = "someone-else"
+	require.Error(t, storage.ExtendLease(stolen))
+
+	// Releasing the lock ends the lease
+	require.NoError(t, storage.ReleaseTask(tasks[0].TaskID))
+	require.Error(t, storage.ExtendLease(tasks[0]))
+	require.Error(t, storage.ReleaseTask("missing"))
+}
+
+func TestGetTasksFromQueues(t *testing.T) {
+
+	storage := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("default", nil)))
+	require.NoError(t, storage.SaveTask(queue.NewTask("transcode", nil, queue.WithQueueName("media"))))
+
+	// An empty list selects nothing
+	tasks, err := storage.GetTasksFromQueues(nil)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	tasks, err = storage.GetTasksFromQueues([]string{"media"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"transcode"}, names(tasks))
+
+	// Tasks from other queues are still available
+	tasks, err = storage.GetTasksFromQueues([]string{""})
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, names(tasks))
+}
+
+func TestLogFailure(t *testing.T) {
+
+	storage := testStorage(t, 32)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, storage.LogFailure(queue.NewTask(name, map[string]any{"name": name})))
+	}
+
+	failures, err := storage.Failures()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, names(failures))
+	require.Equal(t, "c", failures[2].Arguments["name"])
+}
+
+func TestDependents(t *testing.T) {
+
+	storage := testStorage(t, 32)
+
+	parent := queue.NewTask("parent", nil)
+	parent.TaskID = "parent"
+	child := queue.NewTask("child", nil)
+	child.TaskID = "child"
+	child.Parents = []string{"parent"}
+	grandchild := queue.NewTask("grandchild", nil)
+	grandchild.TaskID = "grandchild"
+	grandchild.Parents = []string{"child"}
+
+	require.NoError(t, storage.SaveTask(parent))
+	require.NoError(t, storage.SaveTask(child))
+	require.NoError(t, storage.SaveTask(grandchild))
+
+	// Only the parent can run
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"parent"}, names(tasks))
+
+	// Once the parent succeeds, the child can run
+	require.NoError(t, storage.ResolveDependents("parent"))
+	require.NoError(t, storage.DeleteTask("parent"))
+
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"child"}, names(tasks))
+	require.Empty(t, tasks[0].Parents)
+
+	// If the child fails, the grandchild is cancelled
+	require.NoError(t, storage.DeleteTask("child"))
+	require.NoError(t, storage.CancelDependents("child"))
+
+	failures, err := storage.Failures()
+	require.NoError(t, err)
+	require.Equal(t, []string{"grandchild"}, names(failures))
+	require.Contains(t, failures[0].Error, "cancelled")
+
+	// Nothing is left behind
+	require.NoError(t, storage.database.View(func(tx *bbolt.Tx) error {
+		for _, name := range []string{BucketTasks, BucketWaiting, BucketReady, BucketDependents} {
+			key, _ := tx.Bucket([]byte(name)).Cursor().First()
+			require.Nil(t, key, name)
+		}
+		return nil
+	}))
+}
+
+func TestBatches(t *testing.T) {
+
+	storage := testStorage(t, 32)
+	require.NoError(t, storage.CreateBatch(queue.BatchStatus{BatchID: "batch", Total: 2}))
+
+	status, err := storage.CompleteBatchTask("batch", "a", true)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+
+	// A task that runs again is not counted twice
+	status, err = storage.CompleteBatchTask("batch", "a", false)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+	require.Equal(t, 1, status.Succeeded)
+	require.Zero(t, status.Failed)
+
+	status, err = storage.CompleteBatchTask("batch", "b", false)
+	require.NoError(t, err)
+	require.True(t, status.Done())
+	require.Equal(t, 1, status.Succeeded)
+	require.Equal(t, 1, status.Failed)
+
+	// Finished batches are forgotten, so they can't complete twice
+	_, err = storage.CompleteBatchTask("batch", "c", true)
+	require.Error(t, err)
+}
+
+func TestEncodeInt(t *testing.T) {
+
+	values := []int64{-100, -1, 0, 1, 100, time.Now().Unix()}
+
+	for index, value := range values {
+		require.Equal(t, value, decodeInt(encodeInt(value)))
+
+		if index > 0 {
+			require.Negative(t, bytes.Compare(encodeInt(values[index-1]), encodeInt(value)))
+		}
+	}
+}
+
+// testStorage returns a Storage backed by a new database file that is removed after the test
+func testStorage(t *testing.T, lockQuantity int) Storage {
+
+	database, err := bbolt.Open(filepath.Join(t.TempDir(), "queue.db"), 0600, nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, database.Close())
+	})
+
+	storage, err := New(database, lockQuantity, 5)
+	require.NoError(t, err)
+
+	return storage
+}
+
+// names returns the names of the tasks, in order
+func names(tasks []queue.Task) []string {
+
+	result := make([]string, len(tasks))
+	for index, task := range tasks {
+		result[index] = task.Name
+	}
+
+	return result
+}
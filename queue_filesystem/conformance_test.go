@@ -0,0 +1,20 @@
+package queue_filesystem
+
+import (
+	"testing"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return New(t.TempDir())
+	}, storagetest.WithoutLockTimeouts())
+}
+
+func TestConformance_FairScheduler(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return New(t.TempDir(), WithFairScheduler(queue.NewFairScheduler()))
+	}, storagetest.WithoutLockTimeouts())
+}
@@ -0,0 +1,15 @@
+package queue_filesystem
+
+import "github.com/benpate/turbine/queue"
+
+// Option is a functional option that modifies a Storage object
+type Option func(*Storage)
+
+// WithFairScheduler picks tasks with a FairScheduler instead of in directory order,
+// so that every priority band (and, optionally, every tenant) gets a share of the
+// tasks returned by GetTasks.
+func WithFairScheduler(scheduler *queue.FairScheduler) Option {
+	return func(storage *Storage) {
+		storage.fair = scheduler
+	}
+}
@@ -1,9 +1,16 @@
 package queue_filesystem
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io/fs"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/benpate/derp"
 	"github.com/benpate/turbine/queue"
@@ -12,19 +19,28 @@ import (
 )
 
 // Storage implements a simplified queue Storage interface using a filesystem.
-// This storage engine does not support duplicate checking.  It returns a single
-// task at a time, probably in order of creation time (but no guarantees are made).
-// This storage engine is not safe for concurrent access by multiple workers.
+// It returns a single task at a time, probably in order of creation time (but no
+// guarantees are made), skipping tasks that are scheduled for the future.
+// Signatures are de-duplicated with a marker file for each signature.
+// Tasks are locked by renaming their file, so a locked task is never returned twice,
+// but locks do not time out: tasks locked by a crashed process stay locked.
 type Storage struct {
-	directory string // The filesystem directory to read/write
+	directory string               // The filesystem directory to read/write
+	fair      *queue.FairScheduler // Optional scheduler that chooses between priority bands and tenants
 }
 
 // New returns a fully initialized Storage object
-func New(directory string) Storage {
+func New(directory string, options ...Option) Storage {
 
-	return Storage{
+	result := Storage{
 		directory: directory,
 	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
 }
 
 // SaveTask adds/updates a task to the queue
@@ -37,8 +53,32 @@ func (storage Storage) SaveTask(task queue.Task) error {
 		Str("task", task.Name).
 		Msg("Saving Task...")
 
-	task.TaskID = primitive.NewObjectID().Hex()
-	filename := storage.directory + "/" + task.TaskID + ".json"
+	// New tasks get a new TaskID. Existing tasks (retries, releases) keep theirs.
+	if task.TaskID == "" {
+		task.TaskID = primitive.NewObjectID().Hex()
+	}
+
+	// Signed tasks are only saved if no other task has the same signature
+	if task.Signature != "" {
+
+		claimed, err := storage.claimSignature(task)
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to check signature", task.Signature)
+		}
+
+		if !claimed {
+			log.Trace().
+				Str("location", location).
+				Str("task", task.Name).
+				Str("signature", task.Signature).
+				Msg("Duplicate signature. Task not saved.")
+
+			return nil
+		}
+	}
+
+	filename := storage.taskFilename(task.TaskID)
 
 	// Marshal the task into JSON
 	data, err := json.Marshal(task)
@@ -51,6 +91,11 @@ func (storage Storage) SaveTask(task queue.Task) error {
 		return derp.Wrap(err, location, "Unable to write task file", filename)
 	}
 
+	// Saving a task also releases any lock that it held
+	if err := os.Remove(storage.lockFilename(task.TaskID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return derp.Wrap(err, location, "Unable to remove lock file", task.TaskID)
+	}
+
 	log.Trace().
 		Str("location", location).
 		Str("task", task.Name).
@@ -75,12 +120,22 @@ func (storage Storage) DeleteTask(taskID string) error {
 		return nil
 	}
 
-	// Try to delete the task from the filesystem
-	filename := storage.directory + "/" + taskID + ".json"
+	// Find the task file. Running tasks are stored in their lock file.
+	task, filename, err := storage.findTask(taskID)
+
+	if err != nil {
+		return derp.ReportAndReturn(derp.Wrap(err, location, "Unable to find task file", taskID))
+	}
+
 	if err := os.Remove(filename); err != nil {
 		return derp.ReportAndReturn(derp.Wrap(err, location, "Unable to delete task file", filename))
 	}
 
+	// Let other tasks use the signature again
+	if err := storage.releaseSignature(task); err != nil {
+		return derp.Wrap(err, location, "Unable to release signature", task.Signature)
+	}
+
 	// Silence is acquiescence
 	log.Trace().
 		Str("location", location).
@@ -91,8 +146,49 @@ func (storage Storage) DeleteTask(taskID string) error {
 }
 
 // DeleteTaskBySignature removes a task from the queue by its signature
-func (storage Storage) DeleteTaskBySignature(_ string) error {
-	return derp.NotImplemented("queue_filesystem.DeleteTaskBySignature", "Filesystem storage cannot delete task by signature.")
+func (storage Storage) DeleteTaskBySignature(signature string) error {
+
+	const location = "queue_filesystem.DeleteTaskBySignature"
+
+	path := storage.signatureFilename(signature)
+	owner, err := os.ReadFile(path)
+
+	if err != nil {
+
+		// No task has this signature
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return derp.Wrap(err, location, "Unable to read signature file", path)
+	}
+
+	// Remove a marker that was left behind by a task that no longer exists
+	if !storage.exists(string(owner)) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return derp.Wrap(err, location, "Unable to remove signature file", path)
+		}
+
+		return nil
+	}
+
+	if err := storage.DeleteTask(string(owner)); err != nil {
+		return derp.Wrap(err, location, "Unable to delete task", signature)
+	}
+
+	return nil
+}
+
+// ReleaseTask removes the lock from a task, so that it can be returned by GetTasks again
+func (storage Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_filesystem.ReleaseTask"
+
+	if err := os.Rename(storage.lockFilename(taskID), storage.taskFilename(taskID)); err != nil {
+		return derp.Wrap(err, location, "Unable to release task", taskID)
+	}
+
+	return nil
 }
 
 // LogFailure adds a task to the error log
@@ -115,6 +211,13 @@ func (storage Storage) GetTasks() ([]queue.Task, error) {
 		return nil, derp.Wrap(err, location, "Unable to read task directory", storage.directory)
 	}
 
+	// Let the FairScheduler choose the next task
+	if storage.fair != nil {
+		return storage.getFairTask(files)
+	}
+
+	now := time.Now().Unix()
+
 	// Check each file in the directory
 	for _, entry := range files {
 
@@ -124,27 +227,48 @@ func (storage Storage) GetTasks() ([]queue.Task, error) {
 			continue
 		}
 
-		// Use the full path for both reading and removing, so they cannot diverge
-		path := storage.directory + "/" + filename
+		taskID := strings.TrimSuffix(filename, ".json")
 
-		// Read the first file in the directory
-		file, err := os.ReadFile(path)
+		// Skip tasks that are scheduled for the future
+		task, err := storage.readTask(storage.taskFilename(taskID))
 
 		if err != nil {
-			return nil, derp.Wrap(err, location, "Unable to read task file", path)
+
+			// Another worker locked this task while we were reading the directory
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return nil, derp.Wrap(err, location, "Unable to read task file", filename)
 		}
 
-		// Unmarshal the file into a Task
-		task := queue.Task{}
-		if err := json.Unmarshal(file, &task); err != nil {
-			return nil, derp.Wrap(err, location, "Unable to unmarshal task file", path)
+		if task.StartDate > now {
+			continue
 		}
 
-		// Remove the task from the directory, because we are about to execute it
-		if err := os.Remove(path); err != nil {
-			derp.Report(derp.Wrap(err, location, "Unable to delete task file", path))
+		// Lock the task by renaming its file.  Renaming is atomic, so if another
+		// worker has already claimed this file, then move on to the next one.
+		path := storage.lockFilename(taskID)
+
+		if err := os.Rename(storage.taskFilename(taskID), path); err != nil {
+
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return nil, derp.Wrap(err, location, "Unable to lock task file", filename)
 		}
 
+		// Read the locked file again, in case the task changed before it was locked
+		task, err = storage.readTask(path)
+
+		if err != nil {
+			return nil, derp.Wrap(err, location, "Unable to read task file", path)
+		}
+
+		// Use the filename as the TaskID, so that DeleteTask and ReleaseTask find the right file
+		task.TaskID = taskID
+
 		// Success.  Return the single task.
 		return []queue.Task{task}, nil
 	}
@@ -152,3 +276,238 @@ func (storage Storage) GetTasks() ([]queue.Task, error) {
 	// If no valid files found, then return an empty slice
 	return make([]queue.Task, 0), nil
 }
+
+// getFairTask reads every unlocked task, and locks the one that the FairScheduler
+// picks.  If another worker locks that task first, then it picks again.
+func (storage Storage) getFairTask(files []fs.DirEntry) ([]queue.Task, error) {
+
+	const location = "queue_filesystem.getFairTask"
+
+	candidates := make([]queue.Task, 0, len(files))
+	now := time.Now().Unix()
+
+	for _, entry := range files {
+
+		filename := entry.Name()
+		if !strings.HasSuffix(filename, ".json") {
+			continue
+		}
+
+		task, err := storage.readTask(storage.directory + "/" + filename)
+
+		if err != nil {
+
+			// Another worker locked this task while we were reading the directory
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return nil, derp.Wrap(err, location, "Unable to read task file", filename)
+		}
+
+		// Skip tasks that are scheduled for the future
+		if task.StartDate > now {
+			continue
+		}
+
+		task.TaskID = strings.TrimSuffix(filename, ".json")
+		candidates = append(candidates, task)
+	}
+
+	// The scheduler picks tasks in order within each band and tenant
+	slices.SortStableFunc(candidates, func(a, b queue.Task) int {
+		if a.Priority != b.Priority {
+			return cmp.Compare(a.Priority, b.Priority)
+		}
+		return cmp.Compare(a.StartDate, b.StartDate)
+	})
+
+	for len(candidates) > 0 {
+
+		picked := storage.fair.Pick(candidates, 1)
+		taskID := picked[0].TaskID
+
+		// Lock the task by renaming its file
+		err := os.Rename(storage.taskFilename(taskID), storage.lockFilename(taskID))
+
+		if err == nil {
+			return picked, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, derp.Wrap(err, location, "Unable to lock task file", taskID)
+		}
+
+		// Another worker got there first, so pick again without it
+		candidates = slices.DeleteFunc(candidates, func(task queue.Task) bool {
+			return task.TaskID == taskID
+		})
+	}
+
+	return make([]queue.Task, 0), nil
+}
+
+// readTask reads and unmarshals a single task file
+func (storage Storage) readTask(path string) (queue.Task, error) {
+
+	const location = "queue_filesystem.readTask"
+
+	task := queue.Task{}
+
+	file, err := os.ReadFile(path)
+
+	if err != nil {
+		return task, derp.Wrap(err, location, "Unable to read task file", path)
+	}
+
+	if err := json.Unmarshal(file, &task); err != nil {
+		return task, derp.Wrap(err, location, "Unable to unmarshal task file", path)
+	}
+
+	return task, nil
+}
+
+// findTask reads a task from its lock file (if it is running) or its task file,
+// and returns the task along with the path of the file that holds it.
+func (storage Storage) findTask(taskID string) (queue.Task, string, error) {
+
+	const location = "queue_filesystem.findTask"
+
+	for _, path := range []string{storage.lockFilename(taskID), storage.taskFilename(taskID)} {
+
+		task, err := storage.readTask(path)
+
+		if err == nil {
+			return task, path, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return task, "", derp.Wrap(err, location, "Unable to read task file", path)
+		}
+	}
+
+	return queue.Task{}, "", derp.NotFound(location, "Task not found", taskID)
+}
+
+// exists returns TRUE if a task is in the queue, locked or not
+func (storage Storage) exists(taskID string) bool {
+
+	for _, path := range []string{storage.lockFilename(taskID), storage.taskFilename(taskID)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// claimSignature returns TRUE if the task may be saved: either no other task has
+// its signature, or the task already owns it.  Markers are created with a hard
+// link, which fails if the marker already exists, so that two processes cannot
+// both claim the same signature.
+func (storage Storage) claimSignature(task queue.Task) (bool, error) {
+
+	const location = "queue_filesystem.claimSignature"
+
+	path := storage.signatureFilename(task.Signature)
+
+	// Write the TaskID to a temporary file, so that the marker is never seen empty
+	temp := path + "." + task.TaskID + ".tmp"
+
+	if err := os.WriteFile(temp, []byte(task.TaskID), 0644); err != nil {
+		return false, derp.Wrap(err, location, "Unable to write signature file", temp)
+	}
+
+	defer os.Remove(temp)
+
+	// Try twice, in case a stale marker has to be removed first
+	for range 2 {
+
+		err := os.Link(temp, path)
+
+		if err == nil {
+			return true, nil
+		}
+
+		if !errors.Is(err, fs.ErrExist) {
+			return false, derp.Wrap(err, location, "Unable to create signature file", path)
+		}
+
+		owner, err := os.ReadFile(path)
+
+		if err != nil {
+
+			// The marker was removed after we tried to create it
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return false, derp.Wrap(err, location, "Unable to read signature file", path)
+		}
+
+		// Re-saving the same task (for a retry or a release) is not a duplicate
+		if string(owner) == task.TaskID {
+			return true, nil
+		}
+
+		if storage.exists(string(owner)) {
+			return false, nil
+		}
+
+		// The marker was left behind by a task that no longer exists
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, derp.Wrap(err, location, "Unable to remove signature file", path)
+		}
+	}
+
+	return false, derp.Internal(location, "Unable to claim signature", task.Signature)
+}
+
+// releaseSignature removes the marker for a task's signature, if the task owns it
+func (storage Storage) releaseSignature(task queue.Task) error {
+
+	const location = "queue_filesystem.releaseSignature"
+
+	if task.Signature == "" {
+		return nil
+	}
+
+	path := storage.signatureFilename(task.Signature)
+	owner, err := os.ReadFile(path)
+
+	if err != nil {
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return derp.Wrap(err, location, "Unable to read signature file", path)
+	}
+
+	if string(owner) != task.TaskID {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return derp.Wrap(err, location, "Unable to remove signature file", path)
+	}
+
+	return nil
+}
+
+// signatureFilename returns the path of the marker file for a signature.  Signatures
+// are hashed, because they may contain characters that aren't allowed in filenames.
+func (storage Storage) signatureFilename(signature string) string {
+	hash := sha256.Sum256([]byte(signature))
+	return storage.directory + "/" + hex.EncodeToString(hash[:]) + ".signature"
+}
+
+// taskFilename returns the path of the file that holds an unlocked task
+func (storage Storage) taskFilename(taskID string) string {
+	return storage.directory + "/" + taskID + ".json"
+}
+
+// lockFilename returns the path of the file that holds a locked (running) task
+func (storage Storage) lockFilename(taskID string) string {
+	return storage.directory + "/" + taskID + ".locked"
+}
@@ -46,11 +46,12 @@ func TestGetTasks(t *testing.T) {
 	require.Equal(t, 1, len(tasks))
 	require.Equal(t, "hello", tasks[0].Name)
 
-	// GetTasks must remove the task file, so a second call returns nothing
+	// GetTasks must lock the task file, so a second call returns nothing
 	// (otherwise the same task would be re-executed on every poll).
 	files, err := os.ReadDir(dir)
 	require.NoError(t, err)
-	require.Equal(t, 0, len(files))
+	require.Equal(t, 1, len(files))
+	require.Equal(t, tasks[0].TaskID+".locked", files[0].Name())
 
 	tasks, err = storage.GetTasks()
 	require.NoError(t, err)
@@ -114,6 +115,67 @@ func TestDeleteTask(t *testing.T) {
 	require.Equal(t, 0, len(files))
 }
 
+func TestDeleteTask_Locked(t *testing.T) {
+
+	dir := t.TempDir()
+	storage := New(dir)
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil)))
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// Deleting a running task removes its lock file
+	require.NoError(t, storage.DeleteTask(tasks[0].TaskID))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(files))
+}
+
+func TestReleaseTask(t *testing.T) {
+
+	storage := New(t.TempDir())
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil)))
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// A released task is returned by GetTasks again, with the same TaskID
+	require.NoError(t, storage.ReleaseTask(tasks[0].TaskID))
+
+	released, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(released))
+	require.Equal(t, tasks[0].TaskID, released[0].TaskID)
+}
+
+func TestReleaseTask_Missing(t *testing.T) {
+	storage := New(t.TempDir())
+	require.Error(t, storage.ReleaseTask("does-not-exist"))
+}
+
+func TestSaveTask_ReleasesLock(t *testing.T) {
+
+	dir := t.TempDir()
+	storage := New(dir)
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil)))
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// Re-saving a running task (e.g. for a retry) keeps its TaskID and replaces the lock file
+	tasks[0].RetryCount = 1
+	require.NoError(t, storage.SaveTask(tasks[0]))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+	require.Equal(t, tasks[0].TaskID+".json", files[0].Name())
+}
+
 func TestDeleteTask_EmptyID(t *testing.T) {
 	// An empty taskID represents an in-memory task; deletion is a no-op
 	storage := New(t.TempDir())
@@ -125,9 +187,47 @@ func TestDeleteTask_Missing(t *testing.T) {
 	require.Error(t, storage.DeleteTask("does-not-exist"))
 }
 
-func TestDeleteTaskBySignature_NotImplemented(t *testing.T) {
+func TestDeleteTaskBySignature(t *testing.T) {
+
+	dir := t.TempDir()
+	storage := New(dir)
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil, queue.WithSignature("sig"))))
+
+	// Removes both the task and its signature marker
+	require.NoError(t, storage.DeleteTaskBySignature("sig"))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestSaveTask_StaleSignature(t *testing.T) {
+
+	dir := t.TempDir()
+	storage := New(dir)
+
+	// A marker left behind by a task that no longer exists does not block new tasks
+	require.NoError(t, os.WriteFile(storage.signatureFilename("sig"), []byte("gone"), 0644))
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil, queue.WithSignature("sig"))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	owner, err := os.ReadFile(storage.signatureFilename("sig"))
+	require.NoError(t, err)
+	require.Equal(t, tasks[0].TaskID, string(owner))
+}
+
+func TestDeleteTaskBySignature_Stale(t *testing.T) {
+
 	storage := New(t.TempDir())
-	require.Error(t, storage.DeleteTaskBySignature("sig"))
+	require.NoError(t, os.WriteFile(storage.signatureFilename("sig"), []byte("gone"), 0644))
+
+	// The stale marker is removed
+	require.NoError(t, storage.DeleteTaskBySignature("sig"))
+	_, err := os.Stat(storage.signatureFilename("sig"))
+	require.ErrorIs(t, err, os.ErrNotExist)
 }
 
 func TestLogFailure(t *testing.T) {
@@ -138,4 +238,83 @@ func TestLogFailure(t *testing.T) {
 
 func TestStorage_ImplementsInterface(_ *testing.T) {
 	var _ queue.Storage = Storage{}
+	var _ queue.TaskReleaser = Storage{}
+}
+
+func TestNew_WithFairScheduler(t *testing.T) {
+	scheduler := queue.NewFairScheduler()
+	storage := New("/tmp/some-dir", WithFairScheduler(scheduler))
+	require.Equal(t, scheduler, storage.fair)
+}
+
+func TestGetTasks_FairBands(t *testing.T) {
+
+	storage := New(t.TempDir(), WithFairScheduler(queue.NewFairScheduler(
+		queue.FairBand(10, 3),
+		queue.FairBand(20, 1),
+	)))
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(10))))
+		require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	}
+
+	// Each call returns one task, and the bands share them 3:1
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		tasks, err := storage.GetTasks()
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		counts[tasks[0].Name]++
+	}
+
+	require.Equal(t, map[string]int{"high": 6, "low": 2}, counts)
+}
+
+func TestGetTasks_FairTenants(t *testing.T) {
+
+	storage := New(t.TempDir(), WithFairScheduler(queue.NewFairScheduler(queue.FairByTenant())))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, storage.SaveTask(queue.NewTask("big", nil, queue.WithTenant("big.example"))))
+	}
+	require.NoError(t, storage.SaveTask(queue.NewTask("small", nil, queue.WithTenant("small.example"))))
+
+	// The small tenant doesn't wait behind the big tenant's backlog
+	names := []string{}
+	for i := 0; i < 2; i++ {
+		tasks, err := storage.GetTasks()
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		names = append(names, tasks[0].Name)
+	}
+
+	require.ElementsMatch(t, []string{"big", "small"}, names)
+}
+
+func TestGetTasks_FairLocksTask(t *testing.T) {
+
+	dir := t.TempDir()
+	storage := New(dir, WithFairScheduler(queue.NewFairScheduler()))
+	require.NoError(t, storage.SaveTask(queue.NewTask("x", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, tasks[0].TaskID+".locked", files[0].Name())
+
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+}
+
+func TestGetTasks_FairInvalidJSON(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/bad.json", []byte("not json"), 0644))
+	storage := New(dir, WithFairScheduler(queue.NewFairScheduler()))
+	_, err := storage.GetTasks()
+	require.Error(t, err)
 }
@@ -39,7 +39,7 @@ func FuzzStorageRoundTrip(f *testing.F) {
 		require.Equal(t, name, tasks[0].Name)
 		require.Equal(t, argValue, tasks[0].Arguments.GetString(argKey))
 
-		// GetTasks removes the file as it reads, so the queue cannot be drained twice.
+		// GetTasks locks the file as it reads, so the queue cannot be drained twice.
 		tasks, err = storage.GetTasks()
 		require.NoError(t, err)
 		require.Equal(t, 0, len(tasks))
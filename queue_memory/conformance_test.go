@@ -0,0 +1,17 @@
+package queue_memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return New()
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		return New(WithLockTimeout(-time.Minute))
+	}))
+}
@@ -0,0 +1,70 @@
+package queue_memory
+
+import "time"
+
+// item is a reference to a task in one of the Storage's heaps.  Heaps are never
+// searched or updated in place: when a task changes, a new item is pushed, and
+// items whose version no longer matches the task are discarded when they are popped.
+type item struct {
+	taskID    string
+	version   int
+	priority  int
+	startDate int64
+	sequence  uint64    // order in which items were pushed, to break ties
+	readyAt   time.Time // when the task can be returned by GetTasks
+}
+
+// readyHeap holds tasks that can run now, ordered by priority, then start date
+type readyHeap []item
+
+func (h readyHeap) Len() int { return len(h) }
+
+func (h readyHeap) Less(i, j int) bool {
+
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+
+	if h[i].startDate != h[j].startDate {
+		return h[i].startDate < h[j].startDate
+	}
+
+	return h[i].sequence < h[j].sequence
+}
+
+func (h readyHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *readyHeap) Push(x any) { *h = append(*h, x.(item)) }
+
+func (h *readyHeap) Pop() any {
+	old := *h
+	result := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return result
+}
+
+// waitingHeap holds tasks that are scheduled for the future or locked, ordered
+// by the time that they become available
+type waitingHeap []item
+
+func (h waitingHeap) Len() int { return len(h) }
+
+func (h waitingHeap) Less(i, j int) bool {
+
+	if !h[i].readyAt.Equal(h[j].readyAt) {
+		return h[i].readyAt.Before(h[j].readyAt)
+	}
+
+	return h[i].sequence < h[j].sequence
+}
+
+func (h waitingHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *waitingHeap) Push(x any) { *h = append(*h, x.(item)) }
+
+func (h *waitingHeap) Pop() any {
+	old := *h
+	result := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return result
+}
@@ -0,0 +1,30 @@
+package queue_memory
+
+import "time"
+
+// Option is a functional option that modifies a Storage object
+type Option func(*Storage)
+
+// WithLockQuantity sets the maximum number of tasks that GetTasks locks at once
+func WithLockQuantity(lockQuantity int) Option {
+	return func(storage *Storage) {
+		storage.lockQuantity = lockQuantity
+	}
+}
+
+// WithLockTimeout sets how long a task stays locked before another call to
+// GetTasks can reclaim it.  Keep it comfortably longer than the Queue's
+// heartbeat interval, which extends the lock while the task is running.
+func WithLockTimeout(lockTimeout time.Duration) Option {
+	return func(storage *Storage) {
+		storage.lockTimeout = lockTimeout
+	}
+}
+
+// WithFailureLogSize sets how many failed tasks are kept in the failure log.
+// Once the log is full, the oldest failures are discarded.
+func WithFailureLogSize(failureLogSize int) Option {
+	return func(storage *Storage) {
+		storage.failureLogSize = failureLogSize
+	}
+}
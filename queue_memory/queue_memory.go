@@ -0,0 +1,2 @@
+// Package queue_memory provides a queue storage that is kept entirely in memory
+package queue_memory
@@ -0,0 +1,544 @@
+package queue_memory
+
+import (
+	"container/heap"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/turbine/queue"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage implements the queue Storage interface (and every optional Storage
+// interface) entirely in memory.  Tasks are lost when the process exits, but
+// everything else works as it does with a database: future scheduling, retry
+// delays, signatures, lock timeouts, workflows, batches, shared rate limits, and
+// leader election between Queues that share the same Storage.  It is safe for
+// concurrent use.
+type Storage struct {
+	mutex          sync.Mutex
+	lockQuantity   int                          // The number of tasks to lock at a time
+	lockTimeout    time.Duration                // How long tasks stay locked before they are considered "timed out"
+	failureLogSize int                          // The number of failed tasks to keep in the failure log
+	tasks          map[string]*entry            // Every task in the queue, by TaskID
+	signatures     map[string]string            // TaskID of the task that owns each signature
+	ready          readyHeap                    // Tasks that can run now, by priority
+	waiting        waitingHeap                  // Tasks that are scheduled for the future (or locked), by the time they become available
+	sequence       uint64                       // Counter that keeps the heaps in order when tasks are otherwise equal
+	failures       []queue.Task                 // The most recent failed tasks
+	batches        map[string]queue.BatchStatus // Batch counters, by BatchID
+	batchTasks     map[string]map[string]bool   // TaskIDs that have been counted in each Batch, by BatchID
+	leases         map[string]lease             // Leader election leases, by name
+	rateLimits     map[string]time.Time         // "Theoretical arrival time" of each rate limit, by key
+}
+
+// entry is a single task in the queue
+type entry struct {
+	task        queue.Task
+	lockedUntil time.Time // If in the future, then the task is locked
+	version     int       // Incremented every time the task changes, to invalidate old heap items
+}
+
+// lease is a leader election lease
+type lease struct {
+	nodeID  string
+	expires time.Time
+}
+
+// New returns a fully initialized Storage object
+func New(options ...Option) *Storage {
+
+	result := &Storage{
+		lockQuantity:   32,
+		lockTimeout:    5 * time.Minute,
+		failureLogSize: 1000,
+		tasks:          make(map[string]*entry),
+		signatures:     make(map[string]string),
+		ready:          make(readyHeap, 0),
+		waiting:        make(waitingHeap, 0),
+		failures:       make([]queue.Task, 0),
+		batches:        make(map[string]queue.BatchStatus),
+		batchTasks:     make(map[string]map[string]bool),
+		leases:         make(map[string]lease),
+		rateLimits:     make(map[string]time.Time),
+	}
+
+	for _, option := range options {
+		option(result)
+	}
+
+	return result
+}
+
+// SaveTask adds/updates a task to the queue
+func (storage *Storage) SaveTask(task queue.Task) error {
+
+	const location = "queue_memory.SaveTask"
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	// New tasks get a new TaskID. Existing tasks (retries, releases) keep theirs.
+	if task.TaskID == "" {
+		task.TaskID = primitive.NewObjectID().Hex()
+	}
+
+	// If another task has the same signature, then do not save this one.
+	if owner, exists := storage.signatures[task.Signature]; task.Signature != "" && exists && owner != task.TaskID {
+
+		log.Trace().
+			Str("location", location).
+			Str("task", task.Name).
+			Str("signature", task.Signature).
+			Msg("Duplicate signature. Task not saved.")
+
+		return nil
+	}
+
+	current, exists := storage.tasks[task.TaskID]
+
+	if !exists {
+		current = &entry{}
+		storage.tasks[task.TaskID] = current
+	}
+
+	// Release the old signature if it has changed
+	storage.releaseSignature(current.task)
+
+	current.task = cloneTask(task)
+	current.lockedUntil = time.Time{}
+
+	// A locked task stays locked until its TimeoutDate
+	if task.LockID != "" && task.TimeoutDate > 0 {
+		current.lockedUntil = time.Unix(task.TimeoutDate, 0)
+	}
+
+	if task.Signature != "" {
+		storage.signatures[task.Signature] = task.TaskID
+	}
+
+	storage.schedule(current)
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Msg("Task saved.")
+
+	return nil
+}
+
+// DeleteTask removes a task from the queue
+func (storage *Storage) DeleteTask(taskID string) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.remove(taskID)
+	return nil
+}
+
+// DeleteTaskBySignature removes a task from the queue by its signature
+func (storage *Storage) DeleteTaskBySignature(signature string) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if taskID, exists := storage.signatures[signature]; exists {
+		storage.remove(taskID)
+	}
+
+	return nil
+}
+
+// LogFailure adds a task to the failure log, discarding the oldest
+// failures once the log is full
+func (storage *Storage) LogFailure(task queue.Task) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.logFailure(task)
+	return nil
+}
+
+// Failures returns the failed tasks in the failure log, oldest first
+func (storage *Storage) Failures() []queue.Task {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	result := make([]queue.Task, len(storage.failures))
+	for index, task := range storage.failures {
+		result[index] = cloneTask(task)
+	}
+
+	return result
+}
+
+// GetTasks locks and returns the next batch of tasks, in priority order
+func (storage *Storage) GetTasks() ([]queue.Task, error) {
+	return storage.getTasks(nil), nil
+}
+
+// GetTasksFromQueues locks and returns the next batch of tasks, like GetTasks,
+// but only from the named queues.  An empty name matches tasks that are not
+// assigned to a queue.
+func (storage *Storage) GetTasksFromQueues(queueNames []string) ([]queue.Task, error) {
+
+	// Never treat an empty list as "every queue"
+	if len(queueNames) == 0 {
+		return make([]queue.Task, 0), nil
+	}
+
+	return storage.getTasks(queueNames), nil
+}
+
+// ExtendLease pushes the lock timeout of a running task further into the future
+func (storage *Storage) ExtendLease(task queue.Task) error {
+
+	const location = "queue_memory.ExtendLease"
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	current, exists := storage.tasks[task.TaskID]
+
+	// Only extend the lease if this worker still holds the lock
+	if !exists || task.LockID == "" || current.task.LockID != task.LockID {
+		return derp.NotFound(location, "Task is no longer locked by this worker", task.TaskID, task.LockID)
+	}
+
+	storage.lock(current, current.task.LockID, time.Now())
+	return nil
+}
+
+// ReleaseTask removes the lock from a task, so that it can be returned by GetTasks again
+func (storage *Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_memory.ReleaseTask"
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	current, exists := storage.tasks[taskID]
+
+	if !exists {
+		return derp.NotFound(location, "Task not found", taskID)
+	}
+
+	current.task.LockID = ""
+	current.task.TimeoutDate = 0
+	current.lockedUntil = time.Time{}
+	storage.schedule(current)
+
+	return nil
+}
+
+// AcquireLeadership claims (or renews) the named lease for this node.  It succeeds if
+// the lease does not exist, has expired, or is already held by this node.
+func (storage *Storage) AcquireLeadership(name string, nodeID string, duration time.Duration) (bool, error) {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+
+	if current, exists := storage.leases[name]; exists && current.nodeID != nodeID && current.expires.After(now) {
+		return false, nil
+	}
+
+	storage.leases[name] = lease{nodeID: nodeID, expires: now.Add(duration)}
+	return true, nil
+}
+
+// ReleaseLeadership removes the named lease, if it is held by this node
+func (storage *Storage) ReleaseLeadership(name string, nodeID string) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if current, exists := storage.leases[name]; exists && current.nodeID == nodeID {
+		delete(storage.leases, name)
+	}
+
+	return nil
+}
+
+// ResolveDependents removes a successful task from the parents of every task that
+// depends on it.  Tasks whose parents have all succeeded become available to GetTasks.
+func (storage *Storage) ResolveDependents(taskID string) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	for _, dependent := range storage.dependents(taskID) {
+
+		dependent.task.Parents = slices.DeleteFunc(dependent.task.Parents, func(parentID string) bool {
+			return parentID == taskID
+		})
+
+		storage.schedule(dependent)
+	}
+
+	return nil
+}
+
+// CancelDependents moves every task that depends (directly or indirectly) on a
+// failed task from the queue into the failure log, marked as cancelled.
+func (storage *Storage) CancelDependents(taskID string) error {
+
+	const location = "queue_memory.CancelDependents"
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	// Walk the graph one generation at a time
+	failed := []string{taskID}
+
+	for len(failed) > 0 {
+
+		parentID := failed[0]
+		failed = failed[1:]
+
+		for _, dependent := range storage.dependents(parentID) {
+
+			task := dependent.task
+			task.Error = derp.Serialize(derp.Internal(location, "Task cancelled because a parent task failed", parentID))
+
+			storage.logFailure(task)
+			storage.remove(task.TaskID)
+
+			failed = append(failed, task.TaskID)
+		}
+	}
+
+	return nil
+}
+
+// CreateBatch records a new batch, so that its tasks can be counted as they finish
+func (storage *Storage) CreateBatch(status queue.BatchStatus) error {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.batches[status.BatchID] = status
+	storage.batchTasks[status.BatchID] = make(map[string]bool)
+	return nil
+}
+
+// CompleteBatchTask counts one finished task in a batch, once per taskID.  The call
+// that finishes the batch also removes it, so that it is only completed once.
+func (storage *Storage) CompleteBatchTask(batchID string, taskID string, succeeded bool) (queue.BatchStatus, error) {
+
+	const location = "queue_memory.CompleteBatchTask"
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	status, exists := storage.batches[batchID]
+
+	if !exists {
+		return status, derp.NotFound(location, "Batch not found", batchID)
+	}
+
+	// Tasks that have already been counted are not counted again
+	if taskID != "" {
+
+		if storage.batchTasks[batchID][taskID] {
+			return status, nil
+		}
+
+		storage.batchTasks[batchID][taskID] = true
+	}
+
+	if succeeded {
+		status.Succeeded++
+	} else {
+		status.Failed++
+	}
+
+	if status.Done() {
+		delete(storage.batches, batchID)
+		delete(storage.batchTasks, batchID)
+	} else {
+		storage.batches[batchID] = status
+	}
+
+	return status, nil
+}
+
+// TakeToken implements a rate limit that is shared by every Queue that uses this
+// Storage, using the Generic Cell Rate Algorithm (GCRA), just like queue_mongo.
+func (storage *Storage) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+
+	if rate <= 0 {
+		return 0, nil
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	interval := time.Duration(float64(time.Second) / rate)
+	tolerance := interval * time.Duration(max(burst, 1)-1)
+
+	// The stored tat, or "now" if it has already passed
+	tat := storage.rateLimits[key]
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	// Wait until the tat is back within the burst tolerance
+	if wait := tat.Sub(now) - tolerance; wait > 0 {
+		return wait, nil
+	}
+
+	storage.rateLimits[key] = tat.Add(interval)
+	return 0, nil
+}
+
+// getTasks locks and returns the next batch of tasks.  If queueNames is
+// not nil, then only tasks from those queues are locked.
+func (storage *Storage) getTasks(queueNames []string) []queue.Task {
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	result := make([]queue.Task, 0)
+	skipped := make([]item, 0)
+
+	// Move tasks that have become available into the ready heap
+	for storage.waiting.Len() > 0 && !storage.waiting[0].readyAt.After(now) {
+
+		next := heap.Pop(&storage.waiting).(item)
+
+		if storage.isCurrent(next) {
+			heap.Push(&storage.ready, next)
+		}
+	}
+
+	for storage.ready.Len() > 0 && (storage.lockQuantity <= 0 || len(result) < storage.lockQuantity) {
+
+		next := heap.Pop(&storage.ready).(item)
+
+		if !storage.isCurrent(next) {
+			continue
+		}
+
+		current := storage.tasks[next.taskID]
+
+		// Set aside tasks from other queues
+		if queueNames != nil && !slices.Contains(queueNames, current.task.QueueName) {
+			skipped = append(skipped, next)
+			continue
+		}
+
+		storage.lock(current, primitive.NewObjectID().Hex(), now)
+		result = append(result, cloneTask(current.task))
+	}
+
+	for _, next := range skipped {
+		heap.Push(&storage.ready, next)
+	}
+
+	return result
+}
+
+// lock locks a task until the lock timeout passes
+func (storage *Storage) lock(current *entry, lockID string, now time.Time) {
+	current.lockedUntil = now.Add(storage.lockTimeout)
+	current.task.LockID = lockID
+	current.task.TimeoutDate = current.lockedUntil.Unix()
+	storage.schedule(current)
+}
+
+// schedule pushes a task into the waiting heap, to become available at its start
+// date (or when its lock times out).  Tasks with parents are not scheduled until
+// their parents succeed.  Scheduling a task invalidates every older heap item.
+func (storage *Storage) schedule(current *entry) {
+
+	current.version++
+
+	if current.task.HasParents() {
+		return
+	}
+
+	readyAt := time.Unix(current.task.StartDate, 0)
+
+	if current.lockedUntil.After(readyAt) {
+		readyAt = current.lockedUntil
+	}
+
+	storage.sequence++
+
+	heap.Push(&storage.waiting, item{
+		taskID:    current.task.TaskID,
+		version:   current.version,
+		priority:  current.task.Priority,
+		startDate: current.task.StartDate,
+		sequence:  storage.sequence,
+		readyAt:   readyAt,
+	})
+}
+
+// isCurrent returns TRUE if a heap item still refers to the latest version of its task
+func (storage *Storage) isCurrent(next item) bool {
+	current, exists := storage.tasks[next.taskID]
+	return exists && current.version == next.version
+}
+
+// remove deletes a task (and its signature).  Its heap items are discarded when they are popped.
+func (storage *Storage) remove(taskID string) {
+
+	if current, exists := storage.tasks[taskID]; exists {
+		storage.releaseSignature(current.task)
+		delete(storage.tasks, taskID)
+	}
+}
+
+// releaseSignature removes a task's signature, if the task owns it
+func (storage *Storage) releaseSignature(task queue.Task) {
+
+	if task.Signature != "" && storage.signatures[task.Signature] == task.TaskID {
+		delete(storage.signatures, task.Signature)
+	}
+}
+
+// dependents returns every task that is waiting for the given parent
+func (storage *Storage) dependents(parentID string) []*entry {
+
+	result := make([]*entry, 0)
+
+	for _, current := range storage.tasks {
+		if slices.Contains(current.task.Parents, parentID) {
+			result = append(result, current)
+		}
+	}
+
+	return result
+}
+
+// logFailure adds a task to the failure log, discarding the oldest failures once the log is full
+func (storage *Storage) logFailure(task queue.Task) {
+
+	storage.failures = append(storage.failures, cloneTask(task))
+
+	if storage.failureLogSize > 0 && len(storage.failures) > storage.failureLogSize {
+		storage.failures = slices.Clone(storage.failures[len(storage.failures)-storage.failureLogSize:])
+	}
+}
+
+// cloneTask copies a task's maps and slices, so that callers can't change the
+// stored task (as they couldn't if it was in a database)
+func cloneTask(task queue.Task) queue.Task {
+	task.Arguments = maps.Clone(task.Arguments)
+	task.Parents = slices.Clone(task.Parents)
+	task.Next = slices.Clone(task.Next)
+	return task
+}
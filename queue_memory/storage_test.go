@@ -0,0 +1,332 @@
+package queue_memory
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_ImplementsInterface(_ *testing.T) {
+	var _ queue.Storage = &Storage{}
+	var _ queue.LeaseExtender = &Storage{}
+	var _ queue.TaskReleaser = &Storage{}
+	var _ queue.LeaderElector = &Storage{}
+	var _ queue.DependencyTracker = &Storage{}
+	var _ queue.BatchTracker = &Storage{}
+	var _ queue.RateLimiter = &Storage{}
+	var _ queue.QueueFilter = &Storage{}
+}
+
+func TestNew(t *testing.T) {
+
+	storage := New()
+	require.Equal(t, 32, storage.lockQuantity)
+	require.Equal(t, 5*time.Minute, storage.lockTimeout)
+	require.Equal(t, 1000, storage.failureLogSize)
+
+	storage = New(WithLockQuantity(4), WithLockTimeout(time.Second), WithFailureLogSize(10))
+	require.Equal(t, 4, storage.lockQuantity)
+	require.Equal(t, time.Second, storage.lockTimeout)
+	require.Equal(t, 10, storage.failureLogSize)
+}
+
+func TestGetTasks_PriorityOrder(t *testing.T) {
+
+	storage := New()
+	require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("medium", nil, queue.WithPriority(10))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"high", "medium", "low"}, names(tasks))
+}
+
+func TestGetTasks_LockQuantity(t *testing.T) {
+
+	storage := New(WithLockQuantity(2))
+
+	for range 5 {
+		require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+	}
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+}
+
+func TestGetTasks_LockTimeout(t *testing.T) {
+
+	storage := New(WithLockTimeout(50 * time.Millisecond))
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+
+	first, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+
+	// Still locked
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	// Once the lock times out, the task is available again, with a new lock
+	time.Sleep(100 * time.Millisecond)
+
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, first[0].TaskID, tasks[0].TaskID)
+	require.NotEqual(t, first[0].LockID, tasks[0].LockID)
+
+	// The old lock can no longer be extended
+	require.Error(t, storage.ExtendLease(first[0]))
+	require.NoError(t, storage.ExtendLease(tasks[0]))
+}
+
+func TestExtendLease_KeepsTaskLocked(t *testing.T) {
+
+	storage := New(WithLockTimeout(100 * time.Millisecond))
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	// Keep extending the lease past the original timeout
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, storage.ExtendLease(tasks[0]))
+	}
+
+	reclaimed, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Empty(t, reclaimed)
+}
+
+func TestReleaseTask_Missing(t *testing.T) {
+	require.Error(t, New().ReleaseTask("missing"))
+}
+
+func TestGetTasks_ReturnsCopies(t *testing.T) {
+
+	storage := New(WithLockTimeout(time.Nanosecond))
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", map[string]any{"key": "value"})))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	// Changing the returned task does not change the stored task
+	tasks[0].Arguments["key"] = "changed"
+	time.Sleep(time.Millisecond)
+
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "value", tasks[0].Arguments["key"])
+}
+
+func TestGetTasksFromQueues(t *testing.T) {
+
+	storage := New()
+	require.NoError(t, storage.SaveTask(queue.NewTask("default", nil)))
+	require.NoError(t, storage.SaveTask(queue.NewTask("transcode", nil, queue.WithQueueName("media"))))
+
+	// An empty list selects nothing
+	tasks, err := storage.GetTasksFromQueues(nil)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	tasks, err = storage.GetTasksFromQueues([]string{"media"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"transcode"}, names(tasks))
+
+	// Tasks from other queues are still available
+	tasks, err = storage.GetTasksFromQueues([]string{""})
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, names(tasks))
+}
+
+func TestLogFailure_Size(t *testing.T) {
+
+	storage := New(WithFailureLogSize(2))
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, storage.LogFailure(queue.NewTask(name, nil)))
+	}
+
+	// Only the most recent failures are kept
+	require.Equal(t, []string{"b", "c"}, names(storage.Failures()))
+}
+
+func TestDependents(t *testing.T) {
+
+	storage := New()
+
+	parent := queue.NewTask("parent", nil)
+	parent.TaskID = "parent"
+	child := queue.NewTask("child", nil)
+	child.TaskID = "child"
+	child.Parents = []string{"parent"}
+	grandchild := queue.NewTask("grandchild", nil)
+	grandchild.TaskID = "grandchild"
+	grandchild.Parents = []string{"child"}
+
+	require.NoError(t, storage.SaveTask(parent))
+	require.NoError(t, storage.SaveTask(child))
+	require.NoError(t, storage.SaveTask(grandchild))
+
+	// Only the parent can run
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"parent"}, names(tasks))
+
+	// Once the parent succeeds, the child can run
+	require.NoError(t, storage.ResolveDependents("parent"))
+	require.NoError(t, storage.DeleteTask("parent"))
+
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"child"}, names(tasks))
+
+	// If the child fails, the grandchild is cancelled
+	require.NoError(t, storage.DeleteTask("child"))
+	require.NoError(t, storage.CancelDependents("child"))
+
+	require.Equal(t, []string{"grandchild"}, names(storage.Failures()))
+	require.Empty(t, storage.tasks)
+}
+
+func TestBatches(t *testing.T) {
+
+	storage := New()
+	require.NoError(t, storage.CreateBatch(queue.BatchStatus{BatchID: "batch", Total: 2}))
+
+	status, err := storage.CompleteBatchTask("batch", "a", true)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+
+	// A task that runs again is not counted twice
+	status, err = storage.CompleteBatchTask("batch", "a", false)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+	require.Equal(t, 1, status.Succeeded)
+	require.Zero(t, status.Failed)
+
+	status, err = storage.CompleteBatchTask("batch", "b", false)
+	require.NoError(t, err)
+	require.True(t, status.Done())
+	require.Equal(t, 1, status.Succeeded)
+	require.Equal(t, 1, status.Failed)
+
+	// Finished batches are forgotten, so they can't complete twice
+	_, err = storage.CompleteBatchTask("batch", "c", true)
+	require.Error(t, err)
+}
+
+func TestLeadership(t *testing.T) {
+
+	storage := New()
+
+	ok, err := storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Another node can't take a live lease, but the leader can renew it
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Only the leader can release the lease
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "b"))
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "a"))
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Nanosecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Expired leases can be taken
+	time.Sleep(time.Millisecond)
+	ok, err = storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestTakeToken(t *testing.T) {
+
+	storage := New()
+
+	// A burst of 2 is allowed...
+	for range 2 {
+		delay, err := storage.TakeToken("api", 10, 2)
+		require.NoError(t, err)
+		require.Zero(t, delay)
+	}
+
+	// ...then the next token is about 100ms away
+	delay, err := storage.TakeToken("api", 10, 2)
+	require.NoError(t, err)
+	require.Greater(t, delay, 90*time.Millisecond)
+	require.LessOrEqual(t, delay, 100*time.Millisecond)
+
+	// Other keys have their own bucket, and a zero rate is unlimited
+	delay, err = storage.TakeToken("other", 10, 1)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+
+	delay, err = storage.TakeToken("unlimited", 0, 0)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+}
+
+func TestQueue(t *testing.T) {
+
+	storage := New()
+	var calls atomic.Int32
+
+	q := queue.New(
+		queue.WithStorage(storage),
+		queue.WithConsumers(func(name string, _ map[string]any) queue.Result {
+			calls.Add(1)
+			return queue.Success()
+		}),
+	)
+
+	// Storage makes Schedule and Delete work without a database
+	require.NoError(t, q.Schedule(queue.NewTask("later", nil, queue.WithSignature("later")), time.Hour))
+	require.NoError(t, q.Delete("later"))
+
+	// Low-priority tasks go to storage, and are picked up by the poller
+	require.NoError(t, q.Publish(queue.NewTask("stored", nil, queue.WithPriority(100))))
+	require.Len(t, storage.tasks, 1)
+
+	q.Start()
+	defer q.Stop()
+
+	require.Eventually(t, func() bool {
+		storage.mutex.Lock()
+		defer storage.mutex.Unlock()
+		return calls.Load() == 1 && len(storage.tasks) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// names returns the names of the tasks, in order
+func names(tasks []queue.Task) []string {
+
+	result := make([]string, len(tasks))
+	for index, task := range tasks {
+		result[index] = task.Name
+	}
+
+	return result
+}
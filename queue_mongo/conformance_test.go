@@ -0,0 +1,16 @@
+package queue_mongo
+
+import (
+	"testing"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestIntegration_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return testStorage(t, 16, 5)
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		return testStorage(t, 16, -1)
+	}))
+}
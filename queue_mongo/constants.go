@@ -5,3 +5,12 @@ const CollectionQueue = "Queue"
 
 // CollectionLog is the name of the mongodb collection where completed/logged tasks are stored
 const CollectionLog = "QueueErrors"
+
+// CollectionLeader is the name of the mongodb collection where leader election leases are stored
+const CollectionLeader = "QueueLeaders"
+
+// CollectionBatch is the name of the mongodb collection where batch counters are stored
+const CollectionBatch = "QueueBatches"
+
+// CollectionRateLimit is the name of the mongodb collection where shared rate limits are stored
+const CollectionRateLimit = "QueueRateLimits"
@@ -2,12 +2,15 @@ package queue_mongo
 
 import (
 	"context"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/benpate/derp"
 	"github.com/benpate/turbine/queue"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -202,3 +205,617 @@ func TestIntegration_GetTasks_RespectsStartDate(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 0, len(tasks))
 }
+
+func TestIntegration_ExtendLease(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	task := queue.NewTask("long-running", nil)
+	task.StartDate = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+	require.NotEmpty(t, tasks[0].LockID)
+
+	// Pretend the lease is about to expire, then extend it
+	objectID, err := primitive.ObjectIDFromHex(tasks[0].TaskID)
+	require.NoError(t, err)
+	_, err = storage.database.Collection(CollectionQueue).UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{"$set": bson.M{"timeoutDate": time.Now().Unix()}})
+	require.NoError(t, err)
+
+	require.NoError(t, storage.ExtendLease(tasks[0]))
+
+	var stored queue.Task
+	require.NoError(t, storage.database.Collection(CollectionQueue).FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&stored))
+	require.Greater(t, stored.TimeoutDate, time.Now().Add(4*time.Minute).Unix())
+}
+
+func TestIntegration_ExtendLease_LockLost(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	task := queue.NewTask("stolen", nil)
+	task.StartDate = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// Another worker's lockID cannot extend this lease
+	tasks[0].LockID = primitive.NewObjectID().Hex()
+	require.Error(t, storage.ExtendLease(tasks[0]))
+}
+
+func TestIntegration_SaveTask_SameSignatureSameTask(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	task := queue.NewTask("signed", nil, queue.WithSignature("my-sig"))
+	task.StartDate = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// Re-saving the SAME task (e.g. to release its lock) is not a duplicate
+	released := tasks[0]
+	released.LockID = ""
+	released.TimeoutDate = 0
+	released.RetryCount = 2
+	require.NoError(t, storage.SaveTask(released))
+
+	var stored queue.Task
+	require.NoError(t, storage.database.Collection(CollectionQueue).FindOne(context.Background(), bson.M{"signature": "my-sig"}).Decode(&stored))
+	require.Equal(t, 2, stored.RetryCount)
+	require.Equal(t, int64(0), stored.TimeoutDate)
+}
+
+func TestIntegration_ReleaseTask(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	task := queue.NewTask("released", nil)
+	task.StartDate = time.Now().Add(-time.Minute).Unix()
+	require.NoError(t, storage.SaveTask(task))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(tasks))
+
+	// While locked, the task is not available to another worker
+	others, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(others))
+
+	// Once released, it can be picked up again right away
+	require.NoError(t, storage.ReleaseTask(tasks[0].TaskID))
+
+	others, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(others))
+	require.Equal(t, tasks[0].TaskID, others[0].TaskID)
+}
+
+func TestIntegration_ReleaseTask_InvalidID(t *testing.T) {
+	storage := testStorage(t, 16, 5)
+	require.Error(t, storage.ReleaseTask("not-a-valid-objectid"))
+}
+
+func TestIntegration_SignedTask_ConcurrentPublishers(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+	require.NoError(t, storage.CreateIndexes())
+	require.NoError(t, storage.CreateIndexes()) // safe to call twice
+
+	// Many processes register the same signed task at the same moment
+	done := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			done <- storage.SaveTask(queue.NewTask("report", nil, queue.WithSignature("daily-report")))
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, <-done)
+	}
+
+	count, err := storage.database.Collection(CollectionQueue).CountDocuments(context.Background(), bson.M{"signature": "daily-report"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestIntegration_ScheduleRecurring(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+	require.NoError(t, storage.CreateIndexes())
+
+	// Every node registers the same recurring task on startup
+	for i := 0; i < 3; i++ {
+		q := queue.New(queue.WithStorage(storage))
+		require.NoError(t, q.ScheduleRecurring("ImportFeeds", "0 */6 * * *", nil))
+	}
+
+	var tasks []queue.Task
+	cursor, err := storage.database.Collection(CollectionQueue).Find(context.Background(), bson.M{})
+	require.NoError(t, err)
+	require.NoError(t, cursor.All(context.Background(), &tasks))
+
+	// Only one copy is stored, scheduled for the next six-hour boundary
+	require.Equal(t, 1, len(tasks))
+	require.Equal(t, queue.RecurringSignature("ImportFeeds"), tasks[0].Signature)
+	require.Equal(t, "0 */6 * * *", tasks[0].Cron)
+	require.Equal(t, 0, time.Unix(tasks[0].StartDate, 0).UTC().Hour()%6)
+	require.Greater(t, tasks[0].StartDate, time.Now().Unix())
+}
+
+func TestIntegration_Leadership(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	// The first node claims the lease; the second is turned away
+	leader, err := storage.AcquireLeadership("scheduler", "node-1", time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	leader, err = storage.AcquireLeadership("scheduler", "node-2", time.Minute)
+	require.NoError(t, err)
+	require.False(t, leader)
+
+	// The leader can renew its own lease
+	leader, err = storage.AcquireLeadership("scheduler", "node-1", time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	// Other nodes cannot release it...
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "node-2"))
+	leader, err = storage.AcquireLeadership("scheduler", "node-2", time.Minute)
+	require.NoError(t, err)
+	require.False(t, leader)
+
+	// ...but once the leader releases it, another node takes over
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "node-1"))
+	leader, err = storage.AcquireLeadership("scheduler", "node-2", time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+}
+
+func TestIntegration_Leadership_Expired(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	leader, err := storage.AcquireLeadership("scheduler", "node-1", 50*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	// A leader that dies without releasing its lease is replaced once it expires
+	time.Sleep(100 * time.Millisecond)
+
+	leader, err = storage.AcquireLeadership("scheduler", "node-2", time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	leader, err = storage.AcquireLeadership("scheduler", "node-1", time.Minute)
+	require.NoError(t, err)
+	require.False(t, leader)
+}
+
+func TestIntegration_Leadership_SchedulesOnce(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	// Several nodes register the same recurring task, but only the leader writes it
+	queues := make([]*queue.Queue, 3)
+	for index := range queues {
+		queues[index] = queue.New(queue.WithStorage(storage), queue.WithPollStorage(false), queue.WithLeaderLease(time.Second))
+		require.NoError(t, queues[index].ScheduleRecurring("ImportFeeds", "@hourly", nil))
+		queues[index].Start()
+	}
+
+	defer func() {
+		for _, q := range queues {
+			q.Stop()
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		count, err := storage.database.Collection(CollectionQueue).CountDocuments(context.Background(), bson.M{})
+		return err == nil && count == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	leaders := 0
+	for _, q := range queues {
+		if q.IsLeader() {
+			leaders++
+		}
+	}
+	require.Equal(t, 1, leaders)
+}
+
+func TestIntegration_Workflow_WaitsForParents(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+	q := queue.New(queue.WithStorage(storage), queue.WithRunImmediatePriority(-1))
+
+	workflow := queue.NewWorkflow()
+	first := workflow.Add(queue.NewTask("first", nil))
+	second := workflow.Add(queue.NewTask("second", nil))
+	last := workflow.Add(queue.NewTask("last", nil), first, second)
+	require.NoError(t, q.PublishWorkflow(workflow))
+
+	// Only the parents can be picked at first
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+
+	// One parent succeeding is not enough...
+	require.NoError(t, storage.ResolveDependents(first))
+	require.NoError(t, storage.DeleteTask(first))
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	// ...the child is released once ALL parents have succeeded
+	require.NoError(t, storage.ResolveDependents(second))
+	require.NoError(t, storage.DeleteTask(second))
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, last, tasks[0].TaskID)
+	require.Empty(t, tasks[0].Parents)
+}
+
+func TestIntegration_Workflow_CancelDependents(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+	q := queue.New(queue.WithStorage(storage), queue.WithRunImmediatePriority(-1))
+
+	// root -> child -> grandchild, plus an unrelated task
+	workflow := queue.NewWorkflow()
+	root := workflow.Add(queue.NewTask("root", nil))
+	child := workflow.Add(queue.NewTask("child", nil), root)
+	workflow.Add(queue.NewTask("grandchild", nil), child)
+	require.NoError(t, q.PublishWorkflow(workflow))
+	require.NoError(t, storage.SaveTask(queue.NewTask("unrelated", nil)))
+
+	require.NoError(t, storage.CancelDependents(root))
+
+	// Every descendant moves to the error log, marked as cancelled
+	var logged []queue.Task
+	cursor, err := storage.database.Collection(CollectionLog).Find(context.Background(), bson.M{})
+	require.NoError(t, err)
+	require.NoError(t, cursor.All(context.Background(), &logged))
+	require.Len(t, logged, 2)
+
+	for _, task := range logged {
+		require.Contains(t, task.Error, "cancelled")
+	}
+
+	// Only the root and the unrelated task remain in the queue
+	count, err := storage.database.Collection(CollectionQueue).CountDocuments(context.Background(), bson.M{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+}
+
+func TestIntegration_Batch(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	require.NoError(t, storage.CreateBatch(queue.BatchStatus{BatchID: "batch-1", Total: 3, OnComplete: queue.NewTask("done", nil)}))
+
+	status, err := storage.CompleteBatchTask("batch-1", "a", true)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+
+	status, err = storage.CompleteBatchTask("batch-1", "b", false)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+
+	// A task that runs again is not counted twice
+	status, err = storage.CompleteBatchTask("batch-1", "b", true)
+	require.NoError(t, err)
+	require.False(t, status.Done())
+	require.Equal(t, 1, status.Succeeded)
+	require.Equal(t, 1, status.Failed)
+
+	// The last task completes the batch, and returns the OnComplete task
+	status, err = storage.CompleteBatchTask("batch-1", "c", true)
+	require.NoError(t, err)
+	require.True(t, status.Done())
+	require.Equal(t, 2, status.Succeeded)
+	require.Equal(t, 1, status.Failed)
+	require.Equal(t, "done", status.OnComplete.Name)
+
+	// Completed batches are removed, so they can't complete twice
+	_, err = storage.CompleteBatchTask("batch-1", "c", true)
+	require.True(t, derp.IsNotFound(err))
+}
+
+func TestIntegration_Batch_Concurrent(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+	require.NoError(t, storage.CreateBatch(queue.BatchStatus{BatchID: "batch-1", Total: 50}))
+
+	// Exactly one of many concurrent updates sees the batch finish
+	done := make(chan bool, 50)
+	for i := 0; i < 50; i++ {
+		go func(taskID string) {
+			status, err := storage.CompleteBatchTask("batch-1", taskID, true)
+			done <- err == nil && status.Done()
+		}(strconv.Itoa(i))
+	}
+
+	finished := 0
+	for i := 0; i < 50; i++ {
+		if <-done {
+			finished++
+		}
+	}
+
+	require.Equal(t, 1, finished)
+}
+
+func TestIntegration_TakeToken(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	// The burst is available right away
+	for i := 0; i < 3; i++ {
+		delay, err := storage.TakeToken("api", 10, 3)
+		require.NoError(t, err)
+		require.Zero(t, delay)
+	}
+
+	// Then tokens arrive once per interval
+	delay, err := storage.TakeToken("api", 10, 3)
+	require.NoError(t, err)
+	require.Greater(t, delay, time.Duration(0))
+	require.LessOrEqual(t, delay, 100*time.Millisecond)
+
+	time.Sleep(delay)
+
+	delay, err = storage.TakeToken("api", 10, 3)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+
+	// Other keys have their own buckets
+	delay, err = storage.TakeToken("other", 10, 1)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+}
+
+func TestIntegration_TakeToken_Concurrent(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	// Many nodes share one bucket: exactly `burst` of them get a token
+	results := make(chan bool, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			delay, err := storage.TakeToken("api", 1, 5)
+			results <- err == nil && delay == 0
+		}()
+	}
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if <-results {
+			allowed++
+		}
+	}
+
+	require.Equal(t, 5, allowed)
+}
+
+func TestIntegration_GetTasksFromQueues(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("default", nil)))
+	require.NoError(t, storage.SaveTask(queue.NewTask("transcode", nil, queue.WithQueueName("media"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("send", nil, queue.WithQueueName("email"))))
+
+	// Only tasks from the named queues are locked
+	tasks, err := storage.GetTasksFromQueues([]string{"media"})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "transcode", tasks[0].Name)
+
+	// The empty name selects the default queue
+	tasks, err = storage.GetTasksFromQueues([]string{""})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "default", tasks[0].Name)
+
+	// An empty list selects nothing
+	tasks, err = storage.GetTasksFromQueues(nil)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	// GetTasks still picks from every queue
+	tasks, err = storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "send", tasks[0].Name)
+}
+
+func TestIntegration_FairScheduler_Bands(t *testing.T) {
+
+	storage := testStorage(t, 4, 5)
+	storage = New(storage.database, 4, 5, WithFairScheduler(queue.NewFairScheduler(
+		queue.FairBand(10, 3),
+		queue.FairBand(20, 1),
+	)))
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(10))))
+		require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	}
+
+	// The low band gets its share, even though the high band could fill the batch
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 4)
+
+	counts := map[string]int{}
+	for _, task := range tasks {
+		counts[task.Name]++
+	}
+
+	require.Equal(t, map[string]int{"high": 3, "low": 1}, counts)
+}
+
+func TestIntegration_FairScheduler_NoLockQuantity(t *testing.T) {
+
+	storage := testStorage(t, 0, 5)
+	storage = New(storage.database, 0, 5, WithFairScheduler(queue.NewFairScheduler(
+		queue.FairBand(10, 3),
+		queue.FairBand(20, 1),
+	)))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(10))))
+		require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	}
+
+	// A lockQuantity of zero locks every available task
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 10)
+}
+
+func TestIntegration_FairScheduler_Tenants(t *testing.T) {
+
+	storage := testStorage(t, 3, 5)
+	storage = New(storage.database, 3, 5, WithFairScheduler(queue.NewFairScheduler(queue.FairByTenant())))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, storage.SaveTask(queue.NewTask("big", nil, queue.WithTenant("big.example"))))
+	}
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("small", nil, queue.WithTenant("small.example"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("none", nil)))
+
+	// Every tenant (including tasks without one) gets a task in the batch
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+
+	names := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		names = append(names, task.Name)
+	}
+
+	require.ElementsMatch(t, []string{"big", "small", "none"}, names)
+}
+
+// publishStarvationScenario saves low-priority tasks that have waited 0, 30, 60 and 120
+// minutes, for tests that then run them against a steady stream of high-priority work
+func publishStarvationScenario(t *testing.T, storage Storage) {
+
+	now := time.Now()
+
+	for _, minutes := range []int{0, 30, 60, 120} {
+		task := queue.NewTask("low", map[string]any{"minutes": minutes}, queue.WithPriority(60))
+		task.CreateDate = now.Add(-time.Duration(minutes) * time.Minute).Unix()
+		require.NoError(t, storage.SaveTask(task))
+	}
+}
+
+// runHighPriorityStream publishes one new high-priority task before every poll (so
+// there is always high-priority work waiting) and returns the tasks that were locked.
+func runHighPriorityStream(t *testing.T, storage Storage, rounds int) []queue.Task {
+
+	result := make([]queue.Task, 0, rounds)
+
+	for range rounds {
+		require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(10))))
+
+		tasks, err := storage.GetTasks()
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		result = append(result, tasks...)
+	}
+
+	return result
+}
+
+func TestIntegration_Aging_Disabled(t *testing.T) {
+
+	storage := testStorage(t, 1, 5)
+	publishStarvationScenario(t, storage)
+
+	// Without aging, low-priority tasks wait behind the stream forever
+	for _, task := range runHighPriorityStream(t, storage, 10) {
+		require.Equal(t, "high", task.Name)
+	}
+}
+
+func TestIntegration_Aging(t *testing.T) {
+
+	storage := testStorage(t, 1, 5)
+	storage = New(storage.database, 1, 5, WithAging(1))
+	publishStarvationScenario(t, storage)
+
+	// Effective priorities are 60, 30, 0 and -60, so the two oldest tasks
+	// jump ahead of the stream (priority 10), oldest first.
+	tasks := runHighPriorityStream(t, storage, 10)
+
+	require.Equal(t, "low", tasks[0].Name)
+	require.Equal(t, 120, tasks[0].Arguments.GetInt("minutes"))
+	require.Equal(t, "low", tasks[1].Name)
+	require.Equal(t, 60, tasks[1].Arguments.GetInt("minutes"))
+
+	// The younger tasks still wait until they have aged enough
+	for _, task := range tasks[2:] {
+		require.Equal(t, "high", task.Name)
+	}
+}
+
+func TestIntegration_ExpiredTasksAreNotPicked(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	require.NoError(t, storage.SaveTask(queue.NewTask("expired", nil, queue.WithExpiration(time.Now().Add(-time.Minute)))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("fresh", nil, queue.WithTTL(time.Hour))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("forever", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		names = append(names, task.Name)
+	}
+
+	require.ElementsMatch(t, []string{"fresh", "forever"}, names)
+}
+
+func TestIntegration_ExpirationIndex(t *testing.T) {
+
+	storage := testStorage(t, 16, 5)
+
+	// Safe to call more than once
+	require.NoError(t, storage.CreateExpirationIndex())
+	require.NoError(t, storage.CreateExpirationIndex())
+
+	expireDate := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, storage.SaveTask(queue.NewTask("expiring", nil, queue.WithExpiration(expireDate))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("signed", nil, queue.WithExpiration(expireDate), queue.WithSignature("sig"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("forever", nil)))
+
+	ctx, cancel := timeoutContext(16)
+	defer cancel()
+
+	// Expiring tasks (signed or not) store a BSON date for the TTL index
+	count, err := storage.database.Collection(CollectionQueue).CountDocuments(ctx, bson.M{"expireAt": expireDate})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+
+	count, err = storage.database.Collection(CollectionQueue).CountDocuments(ctx, bson.M{"expireAt": bson.M{"$exists": false}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
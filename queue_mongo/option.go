@@ -0,0 +1,28 @@
+package queue_mongo
+
+import "github.com/benpate/turbine/queue"
+
+// Option is a functional option that modifies a Storage object
+type Option func(*Storage)
+
+// WithFairScheduler picks tasks with a FairScheduler instead of strictly by priority,
+// so that every priority band (and, optionally, every tenant) gets a share of each
+// batch of locked tasks.  Share the same scheduler between Storage objects in the
+// same process so that the shares hold across all of them.
+func WithFairScheduler(scheduler *queue.FairScheduler) Option {
+	return func(storage *Storage) {
+		storage.fair = scheduler
+	}
+}
+
+// WithAging improves the effective priority of waiting tasks by `perMinute` for every
+// minute since their CreateDate, so that old, low-priority tasks eventually run even
+// when higher-priority work keeps arriving.  Priorities are compared with lower values
+// first, so a task with priority 100 and an aging of 1 per minute competes with new
+// priority 40 tasks after an hour.  Aging has no effect with a FairScheduler, which
+// prevents starvation on its own.
+func WithAging(perMinute float64) Option {
+	return func(storage *Storage) {
+		storage.agingPerMinute = perMinute
+	}
+}
@@ -16,19 +16,27 @@ import (
 
 // Storage implements a queue Storage interface using MongoDB
 type Storage struct {
-	database       *mongo.Database // The mongodb database to read/write
-	lockQuantity   int             // The number of tasks to lock at a time
-	timeoutMinutes int             // Number of minutes to lock tasks before they are considered "timed out"
+	database       *mongo.Database      // The mongodb database to read/write
+	lockQuantity   int                  // The number of tasks to lock at a time
+	timeoutMinutes int                  // Number of minutes to lock tasks before they are considered "timed out"
+	fair           *queue.FairScheduler // Optional scheduler that shares each batch between priority bands and tenants
+	agingPerMinute float64              // Optional amount that a task's effective priority improves for each minute that it waits
 }
 
 // New returns a fully initialized Storage object
-func New(database *mongo.Database, lockQuantity int, timeoutMinutes int) Storage {
+func New(database *mongo.Database, lockQuantity int, timeoutMinutes int, options ...Option) Storage {
 
-	return Storage{
+	result := Storage{
 		database:       database,
 		lockQuantity:   lockQuantity,
 		timeoutMinutes: timeoutMinutes,
 	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
 }
 
 // SaveTask adds/updates a task to the queue
@@ -42,21 +50,22 @@ func (storage Storage) SaveTask(task queue.Task) error {
 	timeout, cancel := timeoutContext(16)
 	defer cancel()
 
-	// If this is a duplicate task, then do not run it again.
-	if storage.isDuplicateSignature(timeout, task.Signature) {
-		return nil
-	}
-
 	log.Trace().
 		Str("location", location).
 		Str("task", task.Name).
 		Msg("Saving Task...")
 
-		// If the Task does not have a TaskID, then create a new one
+	// If the Task does not have a TaskID, then create a new one
 	if task.TaskID == "" {
 		taskID = primitive.NewObjectID()
 		task.TaskID = taskID.Hex()
 
+		// New tasks with a signature are inserted in a single upsert, so that
+		// concurrent publishers cannot both store the same signature.
+		if task.Signature != "" {
+			return storage.insertSignedTask(timeout, taskID, task)
+		}
+
 	} else {
 
 		var err error
@@ -66,10 +75,15 @@ func (storage Storage) SaveTask(task queue.Task) error {
 		}
 	}
 
+	// If this is a duplicate task, then do not run it again.
+	if storage.isDuplicateSignature(timeout, taskID, task.Signature) {
+		return nil
+	}
+
 	// Set up filter and option arguments
 	filter := bson.M{"_id": taskID}
 	options := options.Update().SetUpsert(true)
-	update := bson.M{"$set": task}
+	update := bson.M{"$set": storedTask{Task: task, ExpireAt: expireAt(task)}}
 
 	// Update the database
 	if _, err := storage.database.Collection(CollectionQueue).UpdateOne(timeout, filter, update, options); err != nil {
@@ -85,6 +99,88 @@ func (storage Storage) SaveTask(task queue.Task) error {
 	return nil
 }
 
+// insertSignedTask adds a new task to the queue ONLY IF no other task has the
+// same signature. Duplicates are dropped silently, just like isDuplicateSignature.
+func (storage Storage) insertSignedTask(timeout context.Context, taskID primitive.ObjectID, task queue.Task) error {
+
+	const location = "queue_mongo.insertSignedTask"
+
+	filter := bson.M{"signature": task.Signature}
+	options := options.Update().SetUpsert(true)
+	update := bson.M{"$setOnInsert": signedTask{ID: taskID, Task: task, ExpireAt: expireAt(task)}}
+
+	if _, err := storage.database.Collection(CollectionQueue).UpdateOne(timeout, filter, update, options); err != nil {
+
+		// Another process inserted the same signature first (requires the unique index from CreateIndexes)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+
+		return derp.Wrap(err, location, "Unable to save task to task queue")
+	}
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Str("signature", task.Signature).
+		Msg("Signed task saved (or already exists).")
+
+	return nil
+}
+
+// CreateIndexes creates the indexes that this Storage relies on.  It is safe to
+// call more than once.  The unique index on "signature" guarantees that only one
+// task with a given signature can exist, even when many processes publish it
+// (or register the same recurring task) at the same moment.
+func (storage Storage) CreateIndexes() error {
+
+	const location = "queue_mongo.CreateIndexes"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "signature", Value: 1}},
+			Options: options.Index().
+				SetName("signature").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"signature": bson.M{"$type": "string"}}),
+		},
+	}
+
+	if _, err := storage.database.Collection(CollectionQueue).Indexes().CreateMany(timeout, indexes); err != nil {
+		return derp.Wrap(err, location, "Unable to create indexes")
+	}
+
+	return nil
+}
+
+// CreateExpirationIndex creates a TTL index that purges expired tasks from the queue.
+// Without it, expired tasks are never picked, but stay in the queue until they are
+// deleted.  Purged tasks are NOT written to the error log.  It is safe to call more
+// than once.
+func (storage Storage) CreateExpirationIndex() error {
+
+	const location = "queue_mongo.CreateExpirationIndex"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	index := mongo.IndexModel{
+		Keys: bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().
+			SetName("expireAt").
+			SetExpireAfterSeconds(0),
+	}
+
+	if _, err := storage.database.Collection(CollectionQueue).Indexes().CreateOne(timeout, index); err != nil {
+		return derp.Wrap(err, location, "Unable to create expiration index")
+	}
+
+	return nil
+}
+
 // DeleteTask removes a task from the queue
 func (storage Storage) DeleteTask(taskID string) error {
 
@@ -173,10 +269,404 @@ func (storage Storage) LogFailure(task queue.Task) error {
 	return nil
 }
 
+// ExtendLease pushes the timeoutDate of a running task further into the future,
+// so that it is not reclaimed by another worker while it is still running.
+func (storage Storage) ExtendLease(task queue.Task) error {
+
+	const location = "queue_mongo.ExtendLease"
+
+	taskID, err := primitive.ObjectIDFromHex(task.TaskID)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Invalid taskID", task.TaskID)
+	}
+
+	lockID, err := primitive.ObjectIDFromHex(task.LockID)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Invalid lockID", task.LockID)
+	}
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	// Only extend the lease if this worker still holds the lock
+	filter := bson.M{
+		"_id":    taskID,
+		"lockId": lockID,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"timeoutDate": time.Now().Add(time.Duration(storage.timeoutMinutes) * time.Minute).Unix(),
+		},
+	}
+
+	result, err := storage.database.Collection(CollectionQueue).UpdateOne(timeout, filter, update)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to extend task lease", task.TaskID)
+	}
+
+	if result.MatchedCount == 0 {
+		return derp.NotFound(location, "Task is no longer locked by this worker", task.TaskID, task.LockID)
+	}
+
+	log.Trace().
+		Str("location", location).
+		Str("taskId", task.TaskID).
+		Msg("Task lease extended.")
+
+	return nil
+}
+
+// ReleaseTask removes the lock from a task, so that it can be picked up
+// by another worker immediately instead of waiting for its lock to time out.
+func (storage Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_mongo.ReleaseTask"
+
+	objectID, err := primitive.ObjectIDFromHex(taskID)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Invalid taskID", taskID)
+	}
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	filter := bson.M{"_id": objectID}
+
+	update := bson.M{
+		"$set":   bson.M{"timeoutDate": 0},
+		"$unset": bson.M{"lockId": ""},
+	}
+
+	if _, err := storage.database.Collection(CollectionQueue).UpdateOne(timeout, filter, update); err != nil {
+		return derp.Wrap(err, location, "Unable to release task", taskID)
+	}
+
+	log.Trace().
+		Str("location", location).
+		Str("taskId", taskID).
+		Msg("Task released.")
+
+	return nil
+}
+
+// AcquireLeadership claims (or renews) the named lease for this node.  It succeeds if
+// the lease does not exist, has expired, or is already held by this node.  If another
+// node holds an unexpired lease, then the upsert collides with the existing _id and
+// this node is not the leader.
+func (storage Storage) AcquireLeadership(name string, nodeID string, duration time.Duration) (bool, error) {
+
+	const location = "queue_mongo.AcquireLeadership"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	now := time.Now()
+
+	filter := bson.M{
+		"_id": name,
+		"$or": bson.A{
+			bson.M{"nodeId": nodeID},
+			bson.M{"expireDate": bson.M{"$lt": now.UnixMilli()}},
+		},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"nodeId":     nodeID,
+			"expireDate": now.Add(duration).UnixMilli(),
+		},
+	}
+
+	options := options.Update().SetUpsert(true)
+
+	if _, err := storage.database.Collection(CollectionLeader).UpdateOne(timeout, filter, update, options); err != nil {
+
+		// Another node holds the lease
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+
+		return false, derp.Wrap(err, location, "Unable to acquire lease", name, nodeID)
+	}
+
+	log.Trace().
+		Str("location", location).
+		Str("lease", name).
+		Str("nodeId", nodeID).
+		Msg("Lease acquired.")
+
+	return true, nil
+}
+
+// ReleaseLeadership removes the named lease, if it is held by this node,
+// so that another node can take over without waiting for it to expire.
+func (storage Storage) ReleaseLeadership(name string, nodeID string) error {
+
+	const location = "queue_mongo.ReleaseLeadership"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":    name,
+		"nodeId": nodeID,
+	}
+
+	if _, err := storage.database.Collection(CollectionLeader).DeleteOne(timeout, filter); err != nil {
+		return derp.Wrap(err, location, "Unable to release lease", name, nodeID)
+	}
+
+	return nil
+}
+
+// ResolveDependents removes a successful task from the parents of every task that
+// depends on it.  Tasks whose parents have all succeeded become available to pickTasks.
+func (storage Storage) ResolveDependents(taskID string) error {
+
+	const location = "queue_mongo.ResolveDependents"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	filter := bson.M{"parents": taskID}
+	update := bson.M{"$pull": bson.M{"parents": taskID}}
+
+	if _, err := storage.database.Collection(CollectionQueue).UpdateMany(timeout, filter, update); err != nil {
+		return derp.Wrap(err, location, "Unable to resolve dependent tasks", taskID)
+	}
+
+	return nil
+}
+
+// CancelDependents moves every task that depends (directly or indirectly) on a
+// failed task from the queue into the error log, marked as cancelled.
+func (storage Storage) CancelDependents(taskID string) error {
+
+	const location = "queue_mongo.CancelDependents"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	// Walk the graph one generation at a time
+	failed := []string{taskID}
+
+	for len(failed) > 0 {
+
+		parentID := failed[0]
+		failed = failed[1:]
+
+		cursor, err := storage.database.Collection(CollectionQueue).Find(timeout, bson.M{"parents": parentID})
+
+		if err != nil {
+			return derp.Wrap(err, location, "Unable to find dependent tasks", parentID)
+		}
+
+		dependents := make([]queue.Task, 0)
+
+		if err := cursor.All(timeout, &dependents); err != nil {
+			return derp.Wrap(err, location, "Unable to decode dependent tasks", parentID)
+		}
+
+		for _, dependent := range dependents {
+
+			dependent.Error = derp.Serialize(derp.Internal(location, "Task cancelled because a parent task failed", parentID))
+
+			if _, err := storage.database.Collection(CollectionLog).InsertOne(timeout, dependent); err != nil {
+				return derp.Wrap(err, location, "Unable to log cancelled task", dependent.TaskID)
+			}
+
+			if _, err := storage.database.Collection(CollectionQueue).DeleteOne(timeout, bson.M{"taskId": dependent.TaskID}); err != nil {
+				return derp.Wrap(err, location, "Unable to remove cancelled task", dependent.TaskID)
+			}
+
+			log.Trace().
+				Str("location", location).
+				Str("taskId", dependent.TaskID).
+				Str("parentId", parentID).
+				Msg("Dependent task cancelled.")
+
+			failed = append(failed, dependent.TaskID)
+		}
+	}
+
+	return nil
+}
+
+// CreateBatch records a new batch, so that its tasks can be counted as they finish
+func (storage Storage) CreateBatch(status queue.BatchStatus) error {
+
+	const location = "queue_mongo.CreateBatch"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	if _, err := storage.database.Collection(CollectionBatch).InsertOne(timeout, status); err != nil {
+		return derp.Wrap(err, location, "Unable to create batch", status.BatchID)
+	}
+
+	return nil
+}
+
+// CompleteBatchTask atomically counts one finished task in a batch, once per taskID.
+// Counted TaskIDs are kept in the batch's `finished` array, and the update only matches
+// batches that don't include this one.  The update that finishes the batch also removes
+// it, so that it is only completed once.
+func (storage Storage) CompleteBatchTask(batchID string, taskID string, succeeded bool) (queue.BatchStatus, error) {
+
+	const location = "queue_mongo.CompleteBatchTask"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	counter := "failed"
+
+	if succeeded {
+		counter = "succeeded"
+	}
+
+	filter := bson.M{"_id": batchID}
+	counted := bson.M{"_id": batchID}
+	update := bson.M{"$inc": bson.M{counter: 1}}
+
+	if taskID != "" {
+		counted["finished"] = bson.M{"$ne": taskID}
+		update["$addToSet"] = bson.M{"finished": taskID}
+	}
+
+	options := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var status queue.BatchStatus
+
+	if err := storage.database.Collection(CollectionBatch).FindOneAndUpdate(timeout, counted, update, options).Decode(&status); err != nil {
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return status, derp.Wrap(err, location, "Unable to update batch", batchID)
+		}
+
+		// Either the batch is missing, or this task has already been counted
+		if err := storage.database.Collection(CollectionBatch).FindOne(timeout, filter).Decode(&status); err != nil {
+
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return status, derp.NotFound(location, "Batch not found", batchID)
+			}
+
+			return status, derp.Wrap(err, location, "Unable to read batch", batchID)
+		}
+
+		// Only the update that finished the batch may return it as Done
+		if status.Done() {
+			return status, derp.NotFound(location, "Batch already complete", batchID)
+		}
+
+		return status, nil
+	}
+
+	if status.Done() {
+		if _, err := storage.database.Collection(CollectionBatch).DeleteOne(timeout, filter); err != nil {
+			return status, derp.Wrap(err, location, "Unable to remove completed batch", batchID)
+		}
+	}
+
+	return status, nil
+}
+
+// TakeToken implements a rate limit that is shared by every node, using the Generic
+// Cell Rate Algorithm (GCRA).  Each key stores a single "theoretical arrival time"
+// (tat): the time when the bucket will be full again.  A token can be taken if the
+// tat is no more than (burst - 1) intervals in the future, and taking one pushes the
+// tat forward by one interval.  The check and the update happen in a single atomic
+// pipeline update, so that concurrent nodes can never take the same token.
+func (storage Storage) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+
+	const location = "queue_mongo.TakeToken"
+
+	if rate <= 0 {
+		return 0, nil
+	}
+
+	burst = max(burst, 1)
+
+	now := time.Now().UnixNano()
+	interval := int64(float64(time.Second) / rate)
+	tolerance := interval * int64(burst-1)
+
+	// The stored tat, or "now" if it has already passed
+	tat := bson.M{"$max": bson.A{bson.M{"$ifNull": bson.A{"$tat", now}}, now}}
+
+	filter := bson.M{"_id": key}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"allowed": bson.M{"$lte": bson.A{bson.M{"$subtract": bson.A{tat, now}}, tolerance}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"tat": bson.M{"$cond": bson.A{"$allowed", bson.M{"$add": bson.A{tat, interval}}, tat}},
+		}}},
+	}
+
+	options := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var result struct {
+		TAT     int64 `bson:"tat"`
+		Allowed bool  `bson:"allowed"`
+	}
+
+	// Two nodes may try to create the same key at once. The loser retries against the winner's document.
+	for attempt := 0; ; attempt++ {
+
+		timeout, cancel := timeoutContext(16)
+		err := storage.database.Collection(CollectionRateLimit).FindOneAndUpdate(timeout, filter, update, options).Decode(&result)
+		cancel()
+
+		if err == nil {
+			break
+		}
+
+		if attempt == 0 && mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+
+		return 0, derp.Wrap(err, location, "Unable to take rate limit token", key)
+	}
+
+	if result.Allowed {
+		return 0, nil
+	}
+
+	// Wait until the tat is back within the burst tolerance
+	return time.Duration(result.TAT - tolerance - now), nil
+}
+
 // GetTasks returns all tasks that are currently locked by this worker
 func (storage Storage) GetTasks() ([]queue.Task, error) {
+	return storage.getTasks(nil)
+}
+
+// GetTasksFromQueues returns all tasks that are currently locked by this worker,
+// only locking tasks from the named queues.  An empty name matches tasks that
+// are not assigned to a queue.
+func (storage Storage) GetTasksFromQueues(queueNames []string) ([]queue.Task, error) {
+
+	// Never treat an empty list as "every queue"
+	if len(queueNames) == 0 {
+		return make([]queue.Task, 0), nil
+	}
+
+	return storage.getTasks(queueNames)
+}
+
+// getTasks locks and returns the next batch of tasks.  If queueNames is
+// not nil, then only tasks from those queues are locked.
+func (storage Storage) getTasks(queueNames []string) ([]queue.Task, error) {
 
-	const location = "queue_mongo.GetTasks"
+	const location = "queue_mongo.getTasks"
 
 	// Create a timeout context for 16 seconds
 	timeout, cancel := timeoutContext(16)
@@ -186,7 +676,7 @@ func (storage Storage) GetTasks() ([]queue.Task, error) {
 	lockID := primitive.NewObjectID()
 
 	// Try to lock more tasks if we don't already have any
-	if err := storage.lockTasks(timeout, lockID); err != nil {
+	if err := storage.lockTasks(timeout, lockID, queueNames); err != nil {
 		return result, derp.Wrap(err, location, "Unable to lock tasks")
 	}
 
@@ -216,12 +706,12 @@ func (storage Storage) GetTasks() ([]queue.Task, error) {
 }
 
 // lockTasks assigns a set of tasks to the current worker
-func (storage Storage) lockTasks(timeout context.Context, lockID primitive.ObjectID) error {
+func (storage Storage) lockTasks(timeout context.Context, lockID primitive.ObjectID, queueNames []string) error {
 
 	const location = "queue_mongo.lockTasks"
 
 	// Identify the next set of tasks that COULD be run by this worker
-	tasks, err := storage.pickTasks(timeout)
+	tasks, err := storage.pickTasks(timeout, queueNames)
 
 	if err != nil {
 		return derp.Wrap(err, location, "Unable to pick tasks")
@@ -252,7 +742,7 @@ func (storage Storage) lockTasks(timeout context.Context, lockID primitive.Objec
 }
 
 // pickTasks identifies the next set of tasks that should be assigned to workers.
-func (storage Storage) pickTasks(timeout context.Context) ([]primitive.ObjectID, error) {
+func (storage Storage) pickTasks(timeout context.Context, queueNames []string) ([]primitive.ObjectID, error) {
 
 	const location = "queue_mongo.pickTasks"
 
@@ -262,6 +752,35 @@ func (storage Storage) pickTasks(timeout context.Context) ([]primitive.ObjectID,
 	filter := bson.M{
 		"startDate":   bson.M{"$lte": startDate},
 		"timeoutDate": bson.M{"$lt": startDate},
+		"parents.0":   bson.M{"$exists": false},                  // skip tasks that are waiting for parents
+		"expireDate":  bson.M{"$not": bson.M{"$lte": startDate}}, // skip expired tasks (this also matches tasks without an expireDate)
+	}
+
+	// Limit to the named queues.  The default queue ("") is stored without a
+	// queueName, which only matches null.
+	if queueNames != nil {
+
+		names := bson.A{}
+
+		for _, queueName := range queueNames {
+			if queueName == "" {
+				names = append(names, nil)
+			} else {
+				names = append(names, queueName)
+			}
+		}
+
+		filter["queueName"] = bson.M{"$in": names}
+	}
+
+	// Share the batch between priority bands and tenants
+	if storage.fair != nil {
+		return storage.pickFairTasks(timeout, filter)
+	}
+
+	// Sort by effective priority, which improves as tasks wait
+	if storage.agingPerMinute > 0 {
+		return storage.pickAgedTasks(timeout, filter, startDate)
 	}
 
 	// Sort by startDate, and limit to the number of workers
@@ -297,9 +816,204 @@ func (storage Storage) pickTasks(timeout context.Context) ([]primitive.ObjectID,
 	return result, nil
 }
 
-// isDuplicateSignature returns TRUE if the task
-// has a signature that is already in the queue
-func (storage Storage) isDuplicateSignature(timeout context.Context, signature string) bool {
+// pickAgedTasks identifies the next set of tasks by their effective priority: the
+// stored priority, less agingPerMinute for every minute since the task was created.
+// The effective priority is computed in an aggregation pipeline, so the sort cannot
+// use an index and reads every matching task.
+func (storage Storage) pickAgedTasks(timeout context.Context, filter bson.M, now int64) ([]primitive.ObjectID, error) {
+
+	const location = "queue_mongo.pickAgedTasks"
+
+	// priority - (minutes waited * agingPerMinute)
+	waited := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, "$createDate"}}, 60}}
+	effectivePriority := bson.M{"$subtract": bson.A{"$priority", bson.M{"$multiply": bson.A{waited, storage.agingPerMinute}}}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"effectivePriority": effectivePriority}}},
+		{{Key: "$sort", Value: bson.D{{Key: "effectivePriority", Value: 1}, {Key: "startDate", Value: 1}}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	}
+
+	// Like SetLimit, a lockQuantity of zero means "no limit"
+	if storage.lockQuantity > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: storage.lockQuantity}})
+	}
+
+	cursor, err := storage.database.Collection(CollectionQueue).Aggregate(timeout, pipeline)
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to find tasks")
+	}
+
+	temp := make([]struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}, 0)
+
+	if err := cursor.All(timeout, &temp); err != nil {
+		return nil, derp.Wrap(err, location, "Unable to decode tasks")
+	}
+
+	result := make([]primitive.ObjectID, len(temp))
+	for index, item := range temp {
+		result[index] = item.ID
+	}
+
+	return result, nil
+}
+
+// pickFairTasks identifies the next set of tasks using the FairScheduler.  It gathers
+// up to lockQuantity candidates from every priority band (and every tenant within
+// each band) so that a large backlog in one band cannot crowd the others out of the
+// candidate list, and then lets the scheduler choose between them.
+func (storage Storage) pickFairTasks(timeout context.Context, filter bson.M) ([]primitive.ObjectID, error) {
+
+	const location = "queue_mongo.pickFairTasks"
+
+	candidates := make([]queue.Task, 0)
+	bands := storage.fair.Bands()
+
+	for index, band := range bands {
+
+		// Each band holds priorities above the previous band. The last band has no upper limit.
+		priority := bson.M{}
+
+		if index > 0 {
+			priority["$gt"] = bands[index-1].MaxPriority
+		}
+
+		if index < len(bands)-1 {
+			priority["$lte"] = band.MaxPriority
+		}
+
+		bandFilter := bson.M{}
+		for key, value := range filter {
+			bandFilter[key] = value
+		}
+
+		if len(priority) > 0 {
+			bandFilter["priority"] = priority
+		}
+
+		// Without tenants, the whole band is a single lane
+		if !storage.fair.ByTenant() {
+
+			tasks, err := storage.findCandidates(timeout, bandFilter)
+
+			if err != nil {
+				return nil, derp.Wrap(err, location, "Unable to find candidates", band.MaxPriority)
+			}
+
+			candidates = append(candidates, tasks...)
+			continue
+		}
+
+		// Otherwise, gather candidates from every tenant in the band
+		tenants, err := storage.database.Collection(CollectionQueue).Distinct(timeout, "tenant", bandFilter)
+
+		if err != nil {
+			return nil, derp.Wrap(err, location, "Unable to find tenants", band.MaxPriority)
+		}
+
+		// Tasks without a tenant are stored without the field, which only matches null
+		lanes := bson.A{nil}
+
+		for _, tenant := range tenants {
+			if name, ok := tenant.(string); ok && name != "" {
+				lanes = append(lanes, name)
+			}
+		}
+
+		for _, tenant := range lanes {
+
+			bandFilter["tenant"] = tenant
+			tasks, err := storage.findCandidates(timeout, bandFilter)
+
+			if err != nil {
+				return nil, derp.Wrap(err, location, "Unable to find candidates", band.MaxPriority, tenant)
+			}
+
+			candidates = append(candidates, tasks...)
+		}
+	}
+
+	// Let the scheduler choose which candidates to lock
+	picked := storage.fair.Pick(candidates, storage.pickQuantity(len(candidates)))
+	result := make([]primitive.ObjectID, 0, len(picked))
+
+	for _, task := range picked {
+
+		objectID, err := primitive.ObjectIDFromHex(task.TaskID)
+
+		if err != nil {
+			return nil, derp.Wrap(err, location, "Invalid taskID", task.TaskID)
+		}
+
+		result = append(result, objectID)
+	}
+
+	return result, nil
+}
+
+// pickQuantity returns the number of candidates that the FairScheduler should pick.
+// Like SetLimit, a lockQuantity of zero (or less) means "no limit", but Pick needs
+// an actual count, so it picks every candidate.
+func (storage Storage) pickQuantity(candidates int) int {
+
+	if storage.lockQuantity <= 0 {
+		return candidates
+	}
+
+	return storage.lockQuantity
+}
+
+// findCandidates returns up to lockQuantity tasks that match the filter, in priority
+// order, with only the fields that the FairScheduler needs.
+func (storage Storage) findCandidates(timeout context.Context, filter bson.M) ([]queue.Task, error) {
+
+	const location = "queue_mongo.findCandidates"
+
+	options := options.Find().
+		SetSort(bson.D{{Key: "priority", Value: 1}, {Key: "startDate", Value: 1}}).
+		SetLimit(int64(storage.lockQuantity)).
+		SetProjection(bson.M{
+			"_id":      1,
+			"priority": 1,
+			"tenant":   1,
+		})
+
+	cursor, err := storage.database.Collection(CollectionQueue).Find(timeout, filter, options)
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to find tasks")
+	}
+
+	temp := make([]struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Priority int                `bson:"priority"`
+		Tenant   string             `bson:"tenant"`
+	}, 0)
+
+	if err := cursor.All(timeout, &temp); err != nil {
+		return nil, derp.Wrap(err, location, "Unable to decode tasks")
+	}
+
+	result := make([]queue.Task, len(temp))
+	for index, item := range temp {
+		result[index] = queue.Task{
+			TaskID:   item.ID.Hex(),
+			Priority: item.Priority,
+			Tenant:   item.Tenant,
+		}
+	}
+
+	return result, nil
+}
+
+// isDuplicateSignature returns TRUE if the task has a signature that is
+// already used by a different task in the queue. Re-saving the same task
+// (for a retry or a release) is not a duplicate.
+func (storage Storage) isDuplicateSignature(timeout context.Context, taskID primitive.ObjectID, signature string) bool {
 
 	const location = "queue_mongo.isDuplicateSignature"
 
@@ -310,7 +1024,10 @@ func (storage Storage) isDuplicateSignature(timeout context.Context, signature s
 	var task queue.Task
 
 	// Look for unassigned tasks, or tasks that have timed out
-	filter := bson.M{"signature": signature}
+	filter := bson.M{
+		"signature": signature,
+		"_id":       bson.M{"$ne": taskID},
+	}
 	options := options.FindOne().SetProjection(bson.M{"_id": 1})
 
 	// Query the database for matching Tasks
@@ -328,3 +1045,18 @@ func (storage Storage) isDuplicateSignature(timeout context.Context, signature s
 
 	return true
 }
+
+// storedTask adds a BSON date to a Task that expires, because TTL indexes
+// (see CreateExpirationIndex) only work on dates.
+type storedTask struct {
+	queue.Task `bson:",inline"`
+	ExpireAt   *time.Time `bson:"expireAt,omitempty"`
+}
+
+// signedTask adds the MongoDB _id to a Task, so that a new task can be
+// inserted with $setOnInsert (which does not use the upsert filter's _id).
+type signedTask struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	queue.Task `bson:",inline"`
+	ExpireAt   *time.Time `bson:"expireAt,omitempty"`
+}
@@ -3,6 +3,7 @@ package queue_mongo
 import (
 	"testing"
 
+	"github.com/benpate/turbine/queue"
 	"github.com/stretchr/testify/require"
 )
 
@@ -26,3 +27,24 @@ func TestConstants(t *testing.T) {
 	require.Equal(t, "Queue", CollectionQueue)
 	require.Equal(t, "QueueErrors", CollectionLog)
 }
+
+func TestNew_WithFairScheduler(t *testing.T) {
+
+	scheduler := queue.NewFairScheduler()
+	storage := New(nil, 32, 5, WithFairScheduler(scheduler))
+
+	require.Equal(t, scheduler, storage.fair)
+}
+
+func TestPickQuantity(t *testing.T) {
+	require.Equal(t, 32, New(nil, 32, 5).pickQuantity(100))
+
+	// A lockQuantity of zero picks every candidate
+	require.Equal(t, 100, New(nil, 0, 5).pickQuantity(100))
+	require.Equal(t, 100, New(nil, -1, 5).pickQuantity(100))
+}
+
+func TestNew_WithAging(t *testing.T) {
+	storage := New(nil, 32, 5, WithAging(0.5))
+	require.Equal(t, 0.5, storage.agingPerMinute)
+}
@@ -9,4 +9,11 @@ import (
 func TestStorage(_ *testing.T) {
 
 	var _ queue.Storage = Storage{}
+	var _ queue.LeaseExtender = Storage{}
+	var _ queue.TaskReleaser = Storage{}
+	var _ queue.LeaderElector = Storage{}
+	var _ queue.DependencyTracker = Storage{}
+	var _ queue.BatchTracker = Storage{}
+	var _ queue.RateLimiter = Storage{}
+	var _ queue.QueueFilter = Storage{}
 }
@@ -3,9 +3,22 @@ package queue_mongo
 import (
 	"context"
 	"time"
+
+	"github.com/benpate/turbine/queue"
 )
 
 // timeoutContext returns a context that times out after timeoutSeconds seconds
 func timeoutContext(timeoutSeconds int) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
 }
+
+// expireAt returns the task's ExpireDate as a time, or nil if the task never expires
+func expireAt(task queue.Task) *time.Time {
+
+	if task.ExpireDate == 0 {
+		return nil
+	}
+
+	result := time.Unix(task.ExpireDate, 0)
+	return &result
+}
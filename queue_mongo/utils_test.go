@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/benpate/turbine/queue"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,3 +47,14 @@ func TestTimeoutContext_Zero(t *testing.T) {
 	_, ok := ctx.Deadline()
 	require.True(t, ok)
 }
+
+func TestExpireAt(t *testing.T) {
+
+	// Tasks that never expire have no expireAt date
+	require.Nil(t, expireAt(queue.Task{}))
+
+	expireDate := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := expireAt(queue.Task{ExpireDate: expireDate.Unix()})
+	require.NotNil(t, result)
+	require.True(t, expireDate.Equal(*result))
+}
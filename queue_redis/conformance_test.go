@@ -0,0 +1,19 @@
+package queue_redis
+
+import (
+	"testing"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		storage, _ := testStorage(t, 32)
+		return storage
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		storage, _ := testStorage(t, 32)
+		storage.timeoutMinutes = -1
+		return storage
+	}))
+}
@@ -0,0 +1,14 @@
+package queue_redis
+
+// Option is a functional option that modifies a Storage object
+type Option func(*Storage)
+
+// WithPrefix sets the prefix of every key that Storage uses (default: "turbine").
+// Queues that share a prefix share their tasks.  On Redis Cluster, wrap the prefix
+// in braces (such as "{turbine}") so that every key lands in the same hash slot,
+// which the Lua scripts require.
+func WithPrefix(prefix string) Option {
+	return func(storage *Storage) {
+		storage.prefix = prefix
+	}
+}
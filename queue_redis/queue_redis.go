@@ -0,0 +1,2 @@
+// Package queue_redis provides a queue storage backed by Redis (or any server that speaks the Redis protocol)
+package queue_redis
@@ -0,0 +1,207 @@
+package queue_redis
+
+import "github.com/redis/go-redis/v9"
+
+// Each script runs atomically on the server, so no other client can see (or change)
+// a task halfway through an update.  Every task is a hash at `<prefix>:task:<taskID>`
+// with the fields `data` (the task as JSON), `lockId`, `timeoutDate`, `startDate`,
+// `score`, `queueName` and `signature`.  Every task is also in exactly one of two
+// sorted sets: `waiting` (scored by the time it becomes available) or `ready` (scored
+// by `score`, which orders tasks by priority, then by startDate).
+
+// saveScript adds or replaces a task, unless a different task owns its signature.
+// It returns 0 for a duplicate signature, and 1 if the task was saved.
+//
+// KEYS: task, waiting, ready, signatures
+// ARGV: taskID, data, lockId, timeoutDate, startDate, score, queueName, signature, availableAt
+var saveScript = redis.NewScript(`
+local signature = ARGV[8]
+
+if signature ~= "" then
+	local owner = redis.call("HGET", KEYS[4], signature)
+	if owner and owner ~= ARGV[1] then
+		return 0
+	end
+end
+
+local previous = redis.call("HGET", KEYS[1], "signature")
+if previous and previous ~= "" and previous ~= signature and redis.call("HGET", KEYS[4], previous) == ARGV[1] then
+	redis.call("HDEL", KEYS[4], previous)
+end
+
+redis.call("HSET", KEYS[1],
+	"data", ARGV[2], "lockId", ARGV[3], "timeoutDate", ARGV[4], "startDate", ARGV[5],
+	"score", ARGV[6], "queueName", ARGV[7], "signature", signature)
+
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[9], ARGV[1])
+
+if signature ~= "" then
+	redis.call("HSET", KEYS[4], signature, ARGV[1])
+end
+
+return 1
+`)
+
+// deleteScript removes a task, its place in the sorted sets, and its signature.
+//
+// KEYS: task, waiting, ready, signatures
+// ARGV: taskID
+var deleteScript = redis.NewScript(`
+local signature = redis.call("HGET", KEYS[1], "signature")
+if signature and signature ~= "" and redis.call("HGET", KEYS[4], signature) == ARGV[1] then
+	redis.call("HDEL", KEYS[4], signature)
+end
+
+redis.call("DEL", KEYS[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+// lockScript moves every task that has become available from `waiting` to `ready`,
+// then locks up to `limit` ready tasks (all of them, if limit is zero or less) in
+// priority and startDate order, moving them back to `waiting` until their lock times out.  If
+// `filter` is "1", then only tasks from the named queues are locked.  It returns
+// the `data` of each locked task.
+//
+// KEYS: waiting, ready
+// ARGV: taskKeyPrefix, now, limit, lockId, timeoutDate, filter, queueNames...
+var lockScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", now)
+for _, taskID in ipairs(due) do
+	redis.call("ZREM", KEYS[1], taskID)
+	local score = redis.call("HGET", ARGV[1] .. taskID, "score")
+	if score then
+		redis.call("ZADD", KEYS[2], score, taskID)
+	end
+end
+
+local queueNames = {}
+for index = 7, #ARGV do
+	queueNames[ARGV[index]] = true
+end
+
+local locked = {}
+local offset = 0
+
+while limit <= 0 or #locked < limit do
+
+	local page = redis.call("ZRANGE", KEYS[2], offset, offset + 99)
+	if #page == 0 then
+		break
+	end
+
+	offset = offset + #page
+
+	for _, taskID in ipairs(page) do
+		if limit > 0 and #locked >= limit then
+			break
+		end
+
+		if ARGV[6] ~= "1" or queueNames[redis.call("HGET", ARGV[1] .. taskID, "queueName") or ""] then
+			table.insert(locked, taskID)
+		end
+	end
+end
+
+local result = {}
+for index, taskID in ipairs(locked) do
+	local key = ARGV[1] .. taskID
+	redis.call("HSET", key, "lockId", ARGV[4], "timeoutDate", ARGV[5])
+	redis.call("ZREM", KEYS[2], taskID)
+	redis.call("ZADD", KEYS[1], ARGV[5], taskID)
+	result[index] = redis.call("HGET", key, "data")
+end
+
+return result
+`)
+
+// extendScript pushes a task's lock timeout into the future, if it is still locked
+// by `lockId`.  It returns 0 if the task is missing or locked by someone else.
+//
+// KEYS: task, waiting, ready
+// ARGV: taskID, lockId, timeoutDate
+var extendScript = redis.NewScript(`
+local lockID = redis.call("HGET", KEYS[1], "lockId")
+if (not lockID) or lockID == "" or lockID ~= ARGV[2] then
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "timeoutDate", ARGV[3])
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+return 1
+`)
+
+// releaseScript removes a task's lock, so that it is available at its startDate.
+// It returns 0 if the task is missing.
+//
+// KEYS: task, waiting, ready
+// ARGV: taskID
+var releaseScript = redis.NewScript(`
+local startDate = redis.call("HGET", KEYS[1], "startDate")
+if not startDate then
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "lockId", "", "timeoutDate", 0)
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZADD", KEYS[2], startDate, ARGV[1])
+return 1
+`)
+
+// acquireScript claims (or renews) a leader election lease.  It returns 0 if
+// another node holds the lease.
+//
+// KEYS: lease
+// ARGV: nodeID, milliseconds
+var acquireScript = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// resignScript removes a leader election lease, if it is held by this node.
+//
+// KEYS: lease
+// ARGV: nodeID
+var resignScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+
+// tokenScript takes a token from a GCRA rate limit.  The key stores the "theoretical
+// arrival time" (tat).  Times are in microseconds, which Lua numbers hold exactly.
+// It returns 0 if a token was taken, or the number of microseconds to wait.
+//
+// KEYS: rateLimit
+// ARGV: now, interval, tolerance
+var tokenScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tat < now then
+	tat = now
+end
+
+local wait = tat - now - tolerance
+if wait > 0 then
+	return wait
+end
+
+tat = tat + interval
+redis.call("SET", KEYS[1], string.format("%d", tat), "PX", math.ceil((tat - now) / 1000) + 1000)
+return 0
+`)
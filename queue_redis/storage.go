@@ -0,0 +1,377 @@
+package queue_redis
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/turbine/queue"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage implements a queue Storage interface using Redis
+type Storage struct {
+	client         redis.UniversalClient // The Redis client to read/write
+	prefix         string                // Prefix for every key that this Storage uses
+	lockQuantity   int                   // The number of tasks to lock at a time
+	timeoutMinutes int                   // Number of minutes to lock tasks before they are considered "timed out"
+}
+
+// New returns a fully initialized Storage object
+func New(client redis.UniversalClient, lockQuantity int, timeoutMinutes int, options ...Option) Storage {
+
+	result := Storage{
+		client:         client,
+		prefix:         "turbine",
+		lockQuantity:   lockQuantity,
+		timeoutMinutes: timeoutMinutes,
+	}
+
+	for _, option := range options {
+		option(&result)
+	}
+
+	return result
+}
+
+// SaveTask adds/updates a task to the queue
+func (storage Storage) SaveTask(task queue.Task) error {
+
+	const location = "queue_redis.SaveTask"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Msg("Saving Task...")
+
+	// New tasks get a new TaskID. Existing tasks (retries, releases) keep theirs.
+	if task.TaskID == "" {
+		task.TaskID = primitive.NewObjectID().Hex()
+	}
+
+	data, err := json.Marshal(task)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to encode task", task.TaskID)
+	}
+
+	// The task becomes available at its StartDate, or when its lock times out
+	availableAt := task.StartDate
+
+	if task.LockID != "" && task.TimeoutDate > availableAt {
+		availableAt = task.TimeoutDate
+	}
+
+	keys := []string{storage.taskKey(task.TaskID), storage.key("waiting"), storage.key("ready"), storage.key("signatures")}
+	saved, err := saveScript.Run(timeout, storage.client, keys,
+		task.TaskID, data, task.LockID, task.TimeoutDate, task.StartDate, readyScore(task), task.QueueName, task.Signature, availableAt).Int()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to save task", task.TaskID)
+	}
+
+	// If this is a duplicate task, then do not run it again.
+	if saved == 0 {
+		log.Trace().
+			Str("location", location).
+			Str("task", task.Name).
+			Str("signature", task.Signature).
+			Msg("Duplicate signature. Task not saved.")
+	}
+
+	return nil
+}
+
+// DeleteTask removes a task from the queue
+func (storage Storage) DeleteTask(taskID string) error {
+
+	const location = "queue_redis.DeleteTask"
+
+	log.Trace().
+		Str("location", location).
+		Str("taskId", taskID).
+		Msg("Deleting task from queue...")
+
+	// If the taskID is empty, then this is an in-memory task, so there's nothing to do
+	if taskID == "" {
+		return nil
+	}
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	keys := []string{storage.taskKey(taskID), storage.key("waiting"), storage.key("ready"), storage.key("signatures")}
+
+	if err := deleteScript.Run(timeout, storage.client, keys, taskID).Err(); err != nil {
+		return derp.Wrap(err, location, "Unable to delete task from task queue", taskID)
+	}
+
+	return nil
+}
+
+// DeleteTaskBySignature removes a task from the queue by its signature
+func (storage Storage) DeleteTaskBySignature(signature string) error {
+
+	const location = "queue_redis.DeleteTaskBySignature"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	taskID, err := storage.client.HGet(timeout, storage.key("signatures"), signature).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to find task by signature", signature)
+	}
+
+	if err := storage.DeleteTask(taskID); err != nil {
+		return derp.Wrap(err, location, "Unable to delete task", signature)
+	}
+
+	return nil
+}
+
+// LogFailure adds a task to the error log
+func (storage Storage) LogFailure(task queue.Task) error {
+
+	const location = "queue_redis.LogFailure"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	data, err := json.Marshal(task)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to encode task", task.TaskID)
+	}
+
+	if err := storage.client.RPush(timeout, storage.key("errors"), data).Err(); err != nil {
+		return derp.Wrap(err, location, "Unable to log failure", task.TaskID)
+	}
+
+	return nil
+}
+
+// Failures returns the failed tasks in the error log, oldest first
+func (storage Storage) Failures() ([]queue.Task, error) {
+
+	const location = "queue_redis.Failures"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	values, err := storage.client.LRange(timeout, storage.key("errors"), 0, -1).Result()
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to read error log")
+	}
+
+	result := make([]queue.Task, len(values))
+
+	for index, value := range values {
+		if err := json.Unmarshal([]byte(value), &result[index]); err != nil {
+			return nil, derp.Wrap(err, location, "Unable to decode failed task")
+		}
+	}
+
+	return result, nil
+}
+
+// GetTasks locks and returns the next batch of tasks, in priority order
+func (storage Storage) GetTasks() ([]queue.Task, error) {
+	return storage.getTasks(nil)
+}
+
+// GetTasksFromQueues locks and returns the next batch of tasks, like GetTasks,
+// but only from the named queues.  An empty name matches tasks that are not
+// assigned to a queue.
+func (storage Storage) GetTasksFromQueues(queueNames []string) ([]queue.Task, error) {
+
+	if len(queueNames) == 0 {
+		return make([]queue.Task, 0), nil
+	}
+
+	return storage.getTasks(queueNames)
+}
+
+// ExtendLease pushes the lock timeout of a running task further into the future
+func (storage Storage) ExtendLease(task queue.Task) error {
+
+	const location = "queue_redis.ExtendLease"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	keys := []string{storage.taskKey(task.TaskID), storage.key("waiting"), storage.key("ready")}
+	extended, err := extendScript.Run(timeout, storage.client, keys, task.TaskID, task.LockID, storage.timeoutDate(time.Now())).Int()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to extend lease", task.TaskID)
+	}
+
+	// Only extend the lease if this worker still holds the lock
+	if extended == 0 {
+		return derp.NotFound(location, "Task is no longer locked by this worker", task.TaskID, task.LockID)
+	}
+
+	return nil
+}
+
+// ReleaseTask removes the lock from a task, so that it can be returned by GetTasks again
+func (storage Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_redis.ReleaseTask"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	keys := []string{storage.taskKey(taskID), storage.key("waiting"), storage.key("ready")}
+	released, err := releaseScript.Run(timeout, storage.client, keys, taskID).Int()
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to release task", taskID)
+	}
+
+	if released == 0 {
+		return derp.NotFound(location, "Task not found", taskID)
+	}
+
+	return nil
+}
+
+// AcquireLeadership claims (or renews) the named lease for this node.  It succeeds if
+// the lease does not exist, has expired, or is already held by this node.
+func (storage Storage) AcquireLeadership(name string, nodeID string, duration time.Duration) (bool, error) {
+
+	const location = "queue_redis.AcquireLeadership"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	acquired, err := acquireScript.Run(timeout, storage.client, []string{storage.key("leader:" + name)}, nodeID, duration.Milliseconds()).Int()
+
+	if err != nil {
+		return false, derp.Wrap(err, location, "Unable to acquire leadership", name, nodeID)
+	}
+
+	return acquired == 1, nil
+}
+
+// ReleaseLeadership removes the named lease, if it is held by this node
+func (storage Storage) ReleaseLeadership(name string, nodeID string) error {
+
+	const location = "queue_redis.ReleaseLeadership"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	if err := resignScript.Run(timeout, storage.client, []string{storage.key("leader:" + name)}, nodeID).Err(); err != nil {
+		return derp.Wrap(err, location, "Unable to release leadership", name, nodeID)
+	}
+
+	return nil
+}
+
+// TakeToken implements a rate limit that is shared by every node, using the
+// Generic Cell Rate Algorithm (GCRA), just like queue_mongo.
+func (storage Storage) TakeToken(key string, rate float64, burst int) (time.Duration, error) {
+
+	const location = "queue_redis.TakeToken"
+
+	if rate <= 0 {
+		return 0, nil
+	}
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	interval := time.Duration(float64(time.Second) / rate)
+	tolerance := interval * time.Duration(max(burst, 1)-1)
+
+	wait, err := tokenScript.Run(timeout, storage.client, []string{storage.key("ratelimit:" + key)},
+		time.Now().UnixMicro(), interval.Microseconds(), tolerance.Microseconds()).Int64()
+
+	if err != nil {
+		return 0, derp.Wrap(err, location, "Unable to take token", key)
+	}
+
+	return time.Duration(wait) * time.Microsecond, nil
+}
+
+// getTasks locks and returns the next batch of tasks.  If queueNames is
+// not nil, then only tasks from those queues are locked.
+func (storage Storage) getTasks(queueNames []string) ([]queue.Task, error) {
+
+	const location = "queue_redis.getTasks"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	now := time.Now()
+	lockID := primitive.NewObjectID().Hex()
+	timeoutDate := storage.timeoutDate(now)
+	filter := "0"
+
+	if queueNames != nil {
+		filter = "1"
+	}
+
+	arguments := []any{storage.taskKey(""), now.Unix(), storage.lockQuantity, lockID, timeoutDate, filter}
+
+	for _, queueName := range queueNames {
+		arguments = append(arguments, queueName)
+	}
+
+	values, err := lockScript.Run(timeout, storage.client, []string{storage.key("waiting"), storage.key("ready")}, arguments...).StringSlice()
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to lock tasks")
+	}
+
+	result := make([]queue.Task, len(values))
+
+	// The lock is stored outside of `data`, so apply it to each task here
+	for index, value := range values {
+
+		if err := json.Unmarshal([]byte(value), &result[index]); err != nil {
+			return nil, derp.Wrap(err, location, "Unable to decode task")
+		}
+
+		result[index].LockID = lockID
+		result[index].TimeoutDate = timeoutDate
+	}
+
+	return result, nil
+}
+
+// key returns the full name of one of this Storage's keys
+func (storage Storage) key(name string) string {
+	return storage.prefix + ":" + name
+}
+
+// taskKey returns the name of the hash that holds a task
+func (storage Storage) taskKey(taskID string) string {
+	return storage.key("task:" + taskID)
+}
+
+// readyScore returns the score of a task in the `ready` sorted set, which orders
+// tasks by priority, then by StartDate, just like queue_mongo.  StartDate fills the
+// low 32 bits (enough until 2106).  Redis scores are float64s, which hold the score
+// exactly as long as the priority is between -2^20 and 2^20.
+func readyScore(task queue.Task) int64 {
+	return int64(task.Priority)<<32 + task.StartDate
+}
+
+// timeoutDate returns the Unix time when a lock taken at `now` times out
+func (storage Storage) timeoutDate(now time.Time) int64 {
+	return now.Add(time.Duration(storage.timeoutMinutes) * time.Minute).Unix()
+}
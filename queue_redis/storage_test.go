@@ -0,0 +1,251 @@
+package queue_redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/benpate/turbine/queue"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_ImplementsInterface(_ *testing.T) {
+	var _ queue.Storage = Storage{}
+	var _ queue.LeaseExtender = Storage{}
+	var _ queue.TaskReleaser = Storage{}
+	var _ queue.LeaderElector = Storage{}
+	var _ queue.RateLimiter = Storage{}
+	var _ queue.QueueFilter = Storage{}
+}
+
+func TestNew(t *testing.T) {
+
+	storage := New(nil, 32, 5)
+	require.Equal(t, "turbine:ready", storage.key("ready"))
+	require.Equal(t, "turbine:task:abc", storage.taskKey("abc"))
+
+	storage = New(nil, 32, 5, WithPrefix("{jobs}"))
+	require.Equal(t, "{jobs}:ready", storage.key("ready"))
+}
+
+func TestGetTasks_PriorityOrder(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("negative", nil, queue.WithPriority(-5))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("medium", nil, queue.WithPriority(10))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"negative", "high", "medium", "low"}, names(tasks))
+}
+
+func TestGetTasks_StartDateOrder(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+	now := time.Now()
+
+	// With the same priority, the task that became due first runs first, even
+	// though it was created (and has a TaskID that sorts) last
+	require.NoError(t, storage.SaveTask(queue.NewTask("later", nil, queue.WithPriority(10), queue.WithStartTime(now.Add(-time.Minute)))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("sooner", nil, queue.WithPriority(10), queue.WithStartTime(now.Add(-2*time.Minute)))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("urgent", nil, queue.WithPriority(1), queue.WithStartTime(now))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"urgent", "sooner", "later"}, names(tasks))
+}
+
+func TestReadyScore(t *testing.T) {
+
+	// Priority always outweighs StartDate
+	low := queue.Task{Priority: 1, StartDate: 0}
+	high := queue.Task{Priority: 0, StartDate: 1<<32 - 1}
+	require.Less(t, readyScore(high), readyScore(low))
+
+	negative := queue.Task{Priority: -1, StartDate: 1<<32 - 1}
+	require.Less(t, readyScore(negative), readyScore(high))
+
+	// Scores are exact as float64s, which is how Redis stores them
+	task := queue.Task{Priority: 1 << 20, StartDate: time.Now().Unix()}
+	require.Equal(t, readyScore(task), int64(float64(readyScore(task))))
+}
+
+func TestGetTasks_LockQuantity(t *testing.T) {
+
+	storage, _ := testStorage(t, 2)
+
+	for range 5 {
+		require.NoError(t, storage.SaveTask(queue.NewTask("task", map[string]any{"key": "value"})))
+	}
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.NotEmpty(t, tasks[0].LockID)
+	require.Equal(t, tasks[0].LockID, tasks[1].LockID)
+	require.Greater(t, tasks[0].TimeoutDate, time.Now().Add(4*time.Minute).Unix())
+	require.Equal(t, "value", tasks[0].Arguments["key"])
+}
+
+func TestExtendLease(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	require.NoError(t, storage.ExtendLease(tasks[0]))
+
+	// A worker that doesn't hold the lock can't extend it
+	stolen := tasks[0]
+	stolen.LockID = "someone-else"
+	require.Error(t, storage.ExtendLease(stolen))
+
+	// Releasing the lock ends the lease
+	require.NoError(t, storage.ReleaseTask(tasks[0].TaskID))
+	require.Error(t, storage.ExtendLease(tasks[0]))
+	require.Error(t, storage.ReleaseTask("missing"))
+}
+
+func TestGetTasksFromQueues(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("default", nil)))
+	require.NoError(t, storage.SaveTask(queue.NewTask("transcode", nil, queue.WithQueueName("media"))))
+
+	// An empty list selects nothing
+	tasks, err := storage.GetTasksFromQueues(nil)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	tasks, err = storage.GetTasksFromQueues([]string{"media"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"transcode"}, names(tasks))
+
+	// Tasks from other queues are still available
+	tasks, err = storage.GetTasksFromQueues([]string{""})
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, names(tasks))
+}
+
+func TestDeleteTask_RemovesEverything(t *testing.T) {
+
+	storage, server := testStorage(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("first", nil, queue.WithSignature("first"))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("second", nil, queue.WithSignature("second"))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+
+	require.NoError(t, storage.DeleteTask(tasks[0].TaskID))
+	require.NoError(t, storage.DeleteTaskBySignature("second"))
+
+	// Deleting the last tasks removes their hashes, sorted sets, and signatures
+	require.Empty(t, server.Keys())
+}
+
+func TestLogFailure(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, storage.LogFailure(queue.NewTask(name, nil)))
+	}
+
+	failures, err := storage.Failures()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, names(failures))
+}
+
+func TestLeadership(t *testing.T) {
+
+	storage, server := testStorage(t, 32)
+
+	ok, err := storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Another node can't take a live lease, but the leader can renew it
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Only the leader can release the lease
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "b"))
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, storage.ReleaseLeadership("scheduler", "a"))
+	ok, err = storage.AcquireLeadership("scheduler", "b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Expired leases can be taken
+	server.FastForward(2 * time.Minute)
+	ok, err = storage.AcquireLeadership("scheduler", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestTakeToken(t *testing.T) {
+
+	storage, _ := testStorage(t, 32)
+
+	// A burst of 2 is allowed...
+	for range 2 {
+		delay, err := storage.TakeToken("api", 10, 2)
+		require.NoError(t, err)
+		require.Zero(t, delay)
+	}
+
+	// ...then the next token is about 100ms away
+	delay, err := storage.TakeToken("api", 10, 2)
+	require.NoError(t, err)
+	require.Greater(t, delay, 50*time.Millisecond)
+	require.LessOrEqual(t, delay, 100*time.Millisecond)
+
+	// Other keys have their own bucket, and a zero rate is unlimited
+	delay, err = storage.TakeToken("other", 10, 1)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+
+	delay, err = storage.TakeToken("unlimited", 0, 0)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+}
+
+// testStorage returns a Storage connected to a new in-process Redis server, which
+// is shut down after the test
+func testStorage(t *testing.T, lockQuantity int) (Storage, *miniredis.Miniredis) {
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	return New(client, lockQuantity, 5), server
+}
+
+// names returns the names of the tasks, in order
+func names(tasks []queue.Task) []string {
+
+	result := make([]string, len(tasks))
+	for index, task := range tasks {
+		result[index] = task.Name
+	}
+
+	return result
+}
@@ -0,0 +1,11 @@
+package queue_redis
+
+import (
+	"context"
+	"time"
+)
+
+// timeoutContext returns a context that times out after timeoutSeconds seconds
+func timeoutContext(timeoutSeconds int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+}
@@ -0,0 +1,28 @@
+package queue_sql
+
+import (
+	"testing"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/benpate/turbine/queue/storagetest"
+)
+
+func TestConformance_SQLite(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return testSQLite(t, 32)
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		storage := testSQLite(t, 32)
+		storage.timeoutMinutes = -1
+		return storage
+	}))
+}
+
+func TestIntegration_Conformance_Postgres(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) queue.Storage {
+		return testPostgres(t, 16)
+	}, storagetest.WithExpiredLocks(func(t *testing.T) queue.Storage {
+		storage := testPostgres(t, 16)
+		storage.timeoutMinutes = -1
+		return storage
+	}))
+}
@@ -0,0 +1,10 @@
+package queue_sql
+
+// TableQueue is the name of the table where queued tasks are stored
+const TableQueue = "queue"
+
+// TableLog is the name of the table where permanently-failed tasks are stored
+const TableLog = "queue_errors"
+
+// TableMigrations is the name of the table that records which schema migrations have been applied
+const TableMigrations = "queue_migrations"
@@ -0,0 +1,49 @@
+package queue_sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect identifies the SQL database that a Storage is connected to
+type Dialect string
+
+// DialectSQLite locks tasks with a single UPDATE.  SQLite only allows one writer
+// at a time, so two workers can't lock the same task, and each one waits for the
+// `busy_timeout` instead of failing while another worker holds the lock.
+const DialectSQLite Dialect = "sqlite"
+
+// DialectPostgres locks tasks with a single UPDATE that selects them with
+// `FOR UPDATE SKIP LOCKED`, so that concurrent workers skip past each other's
+// tasks instead of waiting for them.
+const DialectPostgres Dialect = "postgres"
+
+// rebind rewrites the `?` placeholders in a query into the style that the
+// dialect expects.  Queries in this package never contain a literal `?`.
+func (dialect Dialect) rebind(query string) string {
+
+	if dialect != DialectPostgres {
+		return query
+	}
+
+	var result strings.Builder
+	index := 0
+
+	for _, character := range query {
+
+		if character != '?' {
+			result.WriteRune(character)
+			continue
+		}
+
+		index++
+		result.WriteString("$" + strconv.Itoa(index))
+	}
+
+	return result.String()
+}
+
+// placeholders returns a comma-separated list of `count` placeholders, for IN clauses
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
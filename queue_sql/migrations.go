@@ -0,0 +1,166 @@
+package queue_sql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/benpate/derp"
+	"github.com/rs/zerolog/log"
+)
+
+// migrationLock is the PostgreSQL advisory lock that Migrate holds while it changes
+// the schema, so that nodes starting at the same moment apply migrations one at a time.
+const migrationLock = 7_300_104_001
+
+// rowQuerier is a database or a transaction that the schema version can be read from
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// migrations are the statements that create (and later, change) the schema.  They
+// run in order, once each, and use only SQL that both SQLite and PostgreSQL accept.
+// Never edit a migration that has been released; add a new one to the end instead.
+// Write them with IF NOT EXISTS where possible, so that a migration that another
+// node has just applied is harmless to run again.
+var migrations = []string{
+
+	// 1: pending tasks.  The columns are the fields that tasks are selected and locked
+	// by; `data` holds the whole task as JSON.  lock_id and timeout_date are updated
+	// in place, so they take precedence over the copies in `data`.
+	`CREATE TABLE IF NOT EXISTS ` + TableQueue + ` (
+		task_id TEXT NOT NULL PRIMARY KEY,
+		lock_id TEXT NOT NULL DEFAULT '',
+		queue_name TEXT NOT NULL DEFAULT '',
+		priority INTEGER NOT NULL,
+		start_date BIGINT NOT NULL,
+		timeout_date BIGINT NOT NULL DEFAULT 0,
+		signature TEXT,
+		data TEXT NOT NULL
+	)`,
+
+	// 2: the order that tasks are picked in
+	`CREATE INDEX IF NOT EXISTS ` + TableQueue + `_pick ON ` + TableQueue + ` (priority, start_date)`,
+
+	// 3: signatures are unique, but most tasks don't have one
+	`CREATE UNIQUE INDEX IF NOT EXISTS ` + TableQueue + `_signature ON ` + TableQueue + ` (signature) WHERE signature IS NOT NULL`,
+
+	// 4: permanently-failed tasks
+	`CREATE TABLE IF NOT EXISTS ` + TableLog + ` (
+		task_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		log_date BIGINT NOT NULL,
+		data TEXT NOT NULL
+	)`,
+
+	// 5: failures are usually read by date
+	`CREATE INDEX IF NOT EXISTS ` + TableLog + `_date ON ` + TableLog + ` (log_date)`,
+}
+
+// Migrate creates or updates the tables that Storage uses.  It applies each migration
+// that has not yet been applied, in its own transaction, and records it in
+// TableMigrations.  Call it once at startup; it is safe to repeat, and safe for
+// several nodes to run at the same time.  On PostgreSQL, each transaction holds an
+// advisory lock, so nodes take turns.  On SQLite, a node that loses the race fails
+// to record the migration, sees that it is already recorded, and moves on.
+func (storage Storage) Migrate() error {
+
+	const location = "queue_sql.Migrate"
+
+	timeout, cancel := timeoutContext(60)
+	defer cancel()
+
+	if err := storage.migrate(timeout, 0, `CREATE TABLE IF NOT EXISTS `+TableMigrations+` (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return derp.Wrap(err, location, "Unable to create migrations table")
+	}
+
+	version, err := storage.schemaVersion(timeout, storage.database)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to read schema version")
+	}
+
+	for index := version; index < len(migrations); index++ {
+
+		log.Trace().Str("location", location).Int("version", index+1).Msg("Applying migration")
+
+		if err := storage.migrate(timeout, index+1, migrations[index]); err != nil {
+
+			// If another node applied this migration first, then keep going
+			if current, readErr := storage.schemaVersion(timeout, storage.database); readErr == nil && current > index {
+				log.Trace().Str("location", location).Int("version", index+1).Msg("Migration already applied by another node")
+				continue
+			}
+
+			return derp.Wrap(err, location, "Unable to apply migration", index+1)
+		}
+	}
+
+	return nil
+}
+
+// migrate runs one statement in its own transaction, and records it in
+// TableMigrations as `version` (unless version is zero).  On PostgreSQL, it
+// waits for the advisory lock first, and skips versions that are already applied.
+func (storage Storage) migrate(ctx context.Context, version int, statement string) error {
+
+	const location = "queue_sql.migrate"
+
+	transaction, err := storage.database.BeginTx(ctx, nil)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to begin transaction", version)
+	}
+
+	// Rolling back a committed transaction is a no-op
+	defer func() { _ = transaction.Rollback() }()
+
+	if storage.dialect == DialectPostgres {
+
+		if _, err := transaction.ExecContext(ctx, storage.dialect.rebind(`SELECT pg_advisory_xact_lock(?)`), migrationLock); err != nil {
+			return derp.Wrap(err, location, "Unable to lock migrations", version)
+		}
+
+		// Another node may have applied this migration while we waited for the lock
+		if version > 0 {
+
+			current, err := storage.schemaVersion(ctx, transaction)
+
+			if err != nil {
+				return derp.Wrap(err, location, "Unable to read schema version", version)
+			}
+
+			if current >= version {
+				return nil
+			}
+		}
+	}
+
+	if _, err := transaction.ExecContext(ctx, statement); err != nil {
+		return derp.Wrap(err, location, "Unable to apply migration", version)
+	}
+
+	// If another node recorded this version first, then the primary key fails
+	if version > 0 {
+		if _, err := transaction.ExecContext(ctx, storage.dialect.rebind(`INSERT INTO `+TableMigrations+` (version) VALUES (?)`), version); err != nil {
+			return derp.Wrap(err, location, "Unable to record migration", version)
+		}
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return derp.Wrap(err, location, "Unable to commit migration", version)
+	}
+
+	return nil
+}
+
+// schemaVersion returns the number of the last migration that has been applied
+func (storage Storage) schemaVersion(ctx context.Context, querier rowQuerier) (int, error) {
+
+	var version int
+
+	if err := querier.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM `+TableMigrations).Scan(&version); err != nil {
+		return 0, derp.Wrap(err, "queue_sql.schemaVersion", "Unable to read schema version")
+	}
+
+	return version, nil
+}
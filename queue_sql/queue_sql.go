@@ -0,0 +1,2 @@
+// Package queue_sql provides a queue storage backed by a SQL database (SQLite or PostgreSQL)
+package queue_sql
@@ -0,0 +1,389 @@
+package queue_sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/benpate/derp"
+	"github.com/benpate/turbine/queue"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage implements a queue Storage interface using a SQL database
+type Storage struct {
+	database       *sql.DB // The SQL database to read/write
+	dialect        Dialect // The kind of SQL database, which decides how tasks are locked
+	lockQuantity   int     // The number of tasks to lock at a time
+	timeoutMinutes int     // Number of minutes to lock tasks before they are considered "timed out"
+}
+
+// New returns a fully initialized Storage object.  Call Migrate before
+// using it to create the tables that it needs.
+func New(database *sql.DB, dialect Dialect, lockQuantity int, timeoutMinutes int) Storage {
+	return Storage{
+		database:       database,
+		dialect:        dialect,
+		lockQuantity:   lockQuantity,
+		timeoutMinutes: timeoutMinutes,
+	}
+}
+
+// SaveTask adds/updates a task to the queue
+func (storage Storage) SaveTask(task queue.Task) error {
+
+	const location = "queue_sql.SaveTask"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Msg("Saving Task...")
+
+	// New tasks get a new TaskID. Existing tasks (retries, releases) keep theirs.
+	if task.TaskID == "" {
+		task.TaskID = primitive.NewObjectID().Hex()
+	}
+
+	// If this is a duplicate task, then do not run it again.
+	if storage.isDuplicateSignature(timeout, task) {
+		return nil
+	}
+
+	data, err := json.Marshal(task)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to encode task", task.TaskID)
+	}
+
+	query := `INSERT INTO ` + TableQueue + ` (task_id, lock_id, queue_name, priority, start_date, timeout_date, signature, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (task_id) DO UPDATE SET
+			lock_id = excluded.lock_id,
+			queue_name = excluded.queue_name,
+			priority = excluded.priority,
+			start_date = excluded.start_date,
+			timeout_date = excluded.timeout_date,
+			signature = excluded.signature,
+			data = excluded.data`
+
+	_, err = storage.database.ExecContext(timeout, storage.dialect.rebind(query),
+		task.TaskID, task.LockID, task.QueueName, task.Priority, task.StartDate, task.TimeoutDate, nullString(task.Signature), string(data))
+
+	if err != nil {
+
+		// If a concurrent publisher saved the same signature first, then the
+		// unique index rejects this task, and it is a duplicate after all.
+		if storage.isDuplicateSignature(timeout, task) {
+			return nil
+		}
+
+		return derp.Wrap(err, location, "Unable to save task", task.TaskID)
+	}
+
+	return nil
+}
+
+// DeleteTask removes a task from the queue
+func (storage Storage) DeleteTask(taskID string) error {
+
+	const location = "queue_sql.DeleteTask"
+
+	log.Trace().
+		Str("location", location).
+		Str("taskId", taskID).
+		Msg("Deleting task from queue...")
+
+	// If the taskID is empty, then this is an in-memory task, so there's nothing to do
+	if taskID == "" {
+		return nil
+	}
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	if _, err := storage.database.ExecContext(timeout, storage.dialect.rebind(`DELETE FROM `+TableQueue+` WHERE task_id = ?`), taskID); err != nil {
+		return derp.Wrap(err, location, "Unable to delete task from task queue", taskID)
+	}
+
+	return nil
+}
+
+// DeleteTaskBySignature removes a task from the queue by its signature
+func (storage Storage) DeleteTaskBySignature(signature string) error {
+
+	const location = "queue_sql.DeleteTaskBySignature"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	if _, err := storage.database.ExecContext(timeout, storage.dialect.rebind(`DELETE FROM `+TableQueue+` WHERE signature = ?`), signature); err != nil {
+		return derp.Wrap(err, location, "Unable to delete task from task queue", signature)
+	}
+
+	return nil
+}
+
+// LogFailure adds a task to the error log
+func (storage Storage) LogFailure(task queue.Task) error {
+
+	const location = "queue_sql.LogFailure"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	data, err := json.Marshal(task)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to encode task", task.TaskID)
+	}
+
+	query := `INSERT INTO ` + TableLog + ` (task_id, name, log_date, data) VALUES (?, ?, ?, ?)`
+
+	if _, err := storage.database.ExecContext(timeout, storage.dialect.rebind(query), task.TaskID, task.Name, time.Now().Unix(), string(data)); err != nil {
+		return derp.Wrap(err, location, "Unable to log failure", task.TaskID)
+	}
+
+	return nil
+}
+
+// GetTasks locks and returns the next batch of tasks, in priority order
+func (storage Storage) GetTasks() ([]queue.Task, error) {
+	return storage.getTasks(nil)
+}
+
+// GetTasksFromQueues locks and returns the next batch of tasks, like GetTasks,
+// but only from the named queues.  An empty name matches tasks that are not
+// assigned to a queue.
+func (storage Storage) GetTasksFromQueues(queueNames []string) ([]queue.Task, error) {
+
+	if len(queueNames) == 0 {
+		return make([]queue.Task, 0), nil
+	}
+
+	return storage.getTasks(queueNames)
+}
+
+// ExtendLease pushes the lock timeout of a running task further into the future
+func (storage Storage) ExtendLease(task queue.Task) error {
+
+	const location = "queue_sql.ExtendLease"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	// Only extend the lease if this worker still holds the lock
+	query := `UPDATE ` + TableQueue + ` SET timeout_date = ? WHERE task_id = ? AND lock_id = ? AND lock_id <> ''`
+	result, err := storage.database.ExecContext(timeout, storage.dialect.rebind(query), storage.timeoutDate(time.Now()), task.TaskID, task.LockID)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to extend lease", task.TaskID)
+	}
+
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return derp.NotFound(location, "Task is no longer locked by this worker", task.TaskID, task.LockID)
+	}
+
+	return nil
+}
+
+// ReleaseTask removes the lock from a task, so that it can be returned by GetTasks again
+func (storage Storage) ReleaseTask(taskID string) error {
+
+	const location = "queue_sql.ReleaseTask"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	query := `UPDATE ` + TableQueue + ` SET lock_id = '', timeout_date = 0 WHERE task_id = ?`
+	result, err := storage.database.ExecContext(timeout, storage.dialect.rebind(query), taskID)
+
+	if err != nil {
+		return derp.Wrap(err, location, "Unable to release task", taskID)
+	}
+
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return derp.NotFound(location, "Task not found", taskID)
+	}
+
+	return nil
+}
+
+// getTasks locks and returns the next batch of tasks.  If queueNames is
+// not nil, then only tasks from those queues are locked.
+func (storage Storage) getTasks(queueNames []string) ([]queue.Task, error) {
+
+	const location = "queue_sql.getTasks"
+
+	timeout, cancel := timeoutContext(16)
+	defer cancel()
+
+	lockID := primitive.NewObjectID().Hex()
+
+	// Lock the next tasks with a single lockID
+	if err := storage.lockTasks(timeout, lockID, queueNames); err != nil {
+		return nil, derp.Wrap(err, location, "Unable to lock tasks")
+	}
+
+	// Return every task that was locked
+	query := `SELECT task_id, lock_id, timeout_date, data FROM ` + TableQueue + ` WHERE lock_id = ? ORDER BY priority, start_date`
+	rows, err := storage.database.QueryContext(timeout, storage.dialect.rebind(query), lockID)
+
+	if err != nil {
+		return nil, derp.Wrap(err, location, "Unable to read locked tasks")
+	}
+
+	defer rows.Close()
+
+	result := make([]queue.Task, 0)
+
+	for rows.Next() {
+
+		task, err := scanTask(rows)
+
+		if err != nil {
+			return nil, derp.Wrap(err, location, "Unable to read locked task")
+		}
+
+		result = append(result, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, derp.Wrap(err, location, "Unable to read locked tasks")
+	}
+
+	return result, nil
+}
+
+// lockTasks locks the next tasks in a single UPDATE, so there is no window between
+// choosing tasks and locking them.  On PostgreSQL, `FOR UPDATE SKIP LOCKED` keeps
+// concurrent workers from selecting the same rows, without waiting for each other.
+// On SQLite, the UPDATE takes the write lock before it reads anything, so workers
+// take turns (waiting up to the `busy_timeout`) instead of failing with SQLITE_BUSY
+// when a read-only transaction tries to become a write.
+func (storage Storage) lockTasks(timeout context.Context, lockID string, queueNames []string) error {
+
+	now := time.Now()
+	where, arguments := availableClause(queueNames, now.Unix())
+	limit, limitArguments := storage.limitClause()
+	skipLocked := ""
+
+	if storage.dialect == DialectPostgres {
+		skipLocked = `
+			FOR UPDATE SKIP LOCKED`
+	}
+
+	// The final check on timeout_date is redundant where the subquery runs inside the
+	// UPDATE, but keeps a task from being locked twice on any database that doesn't.
+	query := `UPDATE ` + TableQueue + ` SET lock_id = ?, timeout_date = ?
+		WHERE task_id IN (
+			SELECT task_id FROM ` + TableQueue + `
+			WHERE ` + where + `
+			ORDER BY priority, start_date` + limit + skipLocked + `
+		)
+		AND timeout_date < ?`
+
+	arguments = append([]any{lockID, storage.timeoutDate(now)}, arguments...)
+	arguments = append(arguments, limitArguments...)
+	arguments = append(arguments, now.Unix())
+
+	_, err := storage.database.ExecContext(timeout, storage.dialect.rebind(query), arguments...)
+	return err
+}
+
+// isDuplicateSignature returns TRUE if a different task with the same signature
+// is already in the queue
+func (storage Storage) isDuplicateSignature(timeout context.Context, task queue.Task) bool {
+
+	const location = "queue_sql.isDuplicateSignature"
+
+	if task.Signature == "" {
+		return false
+	}
+
+	var taskID string
+
+	query := `SELECT task_id FROM ` + TableQueue + ` WHERE signature = ? AND task_id <> ?`
+	err := storage.database.QueryRowContext(timeout, storage.dialect.rebind(query), task.Signature, task.TaskID).Scan(&taskID)
+
+	// If we can't retrieve a duplicate, then there isn't one.
+	if err != nil {
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			derp.Report(derp.Wrap(err, location, "Unable to find duplicate signature"))
+		}
+
+		return false
+	}
+
+	log.Trace().
+		Str("location", location).
+		Str("task", task.Name).
+		Str("signature", task.Signature).
+		Msg("Duplicate signature. Task not saved.")
+
+	return true
+}
+
+// limitClause returns the LIMIT clause (and its argument) for picking tasks.
+// A lockQuantity of zero or less means "no limit".
+func (storage Storage) limitClause() (string, []any) {
+
+	if storage.lockQuantity <= 0 {
+		return "", nil
+	}
+
+	return ` LIMIT ?`, []any{storage.lockQuantity}
+}
+
+// timeoutDate returns the Unix time when a lock taken at `now` times out
+func (storage Storage) timeoutDate(now time.Time) int64 {
+	return now.Add(time.Duration(storage.timeoutMinutes) * time.Minute).Unix()
+}
+
+// availableClause returns the WHERE clause (and its arguments) that matches tasks
+// that are ready to run, and are unlocked or have timed out
+func availableClause(queueNames []string, now int64) (string, []any) {
+
+	clause := `start_date <= ? AND timeout_date < ?`
+	arguments := []any{now, now}
+
+	if queueNames != nil {
+
+		clause += ` AND queue_name IN (` + placeholders(len(queueNames)) + `)`
+
+		for _, queueName := range queueNames {
+			arguments = append(arguments, queueName)
+		}
+	}
+
+	return clause, arguments
+}
+
+// scanTask reads a task from a row of `task_id, lock_id, timeout_date, data`.
+// The columns are updated in place by locks, so they override the JSON.
+func scanTask(rows *sql.Rows) (queue.Task, error) {
+
+	var task queue.Task
+	var taskID, lockID, data string
+	var timeoutDate int64
+
+	if err := rows.Scan(&taskID, &lockID, &timeoutDate, &data); err != nil {
+		return task, err
+	}
+
+	if err := json.Unmarshal([]byte(data), &task); err != nil {
+		return task, err
+	}
+
+	task.TaskID = taskID
+	task.LockID = lockID
+	task.TimeoutDate = timeoutDate
+
+	return task, nil
+}
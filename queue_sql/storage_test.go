@@ -0,0 +1,188 @@
+package queue_sql
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benpate/turbine/queue"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestStorage_ImplementsInterface(_ *testing.T) {
+	var _ queue.Storage = Storage{}
+	var _ queue.LeaseExtender = Storage{}
+	var _ queue.TaskReleaser = Storage{}
+	var _ queue.QueueFilter = Storage{}
+}
+
+func TestRebind(t *testing.T) {
+
+	query := `UPDATE queue SET lock_id = ? WHERE task_id IN (?, ?)`
+
+	require.Equal(t, query, DialectSQLite.rebind(query))
+	require.Equal(t, `UPDATE queue SET lock_id = $1 WHERE task_id IN ($2, $3)`, DialectPostgres.rebind(query))
+	require.Equal(t, "?, ?, ?", placeholders(3))
+}
+
+func TestMigrate(t *testing.T) {
+
+	storage := testSQLite(t, 32)
+
+	// Migrations are only applied once
+	require.NoError(t, storage.Migrate())
+
+	var count int
+	require.NoError(t, storage.database.QueryRow(`SELECT COUNT(*) FROM `+TableMigrations).Scan(&count))
+	require.Equal(t, len(migrations), count)
+}
+
+func TestMigrate_Concurrent(t *testing.T) {
+
+	database, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "queue.db")+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+	database.SetMaxOpenConns(8)
+
+	t.Cleanup(func() {
+		require.NoError(t, database.Close())
+	})
+
+	storage := New(database, DialectSQLite, 32, 5)
+
+	// Nodes that start at the same moment all migrate the fresh database without failing
+	errs := make(chan error, 8)
+
+	for range 8 {
+		go func() {
+			errs <- storage.Migrate()
+		}()
+	}
+
+	for range 8 {
+		require.NoError(t, <-errs)
+	}
+
+	var count int
+	require.NoError(t, storage.database.QueryRow(`SELECT COUNT(*) FROM `+TableMigrations).Scan(&count))
+	require.Equal(t, len(migrations), count)
+}
+
+func TestGetTasks_PriorityOrder(t *testing.T) {
+
+	storage := testSQLite(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("low", nil, queue.WithPriority(20))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("high", nil, queue.WithPriority(1))))
+	require.NoError(t, storage.SaveTask(queue.NewTask("medium", nil, queue.WithPriority(10))))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Equal(t, []string{"high", "medium", "low"}, names(tasks))
+}
+
+func TestGetTasks_LockQuantity(t *testing.T) {
+
+	storage := testSQLite(t, 2)
+
+	for range 5 {
+		require.NoError(t, storage.SaveTask(queue.NewTask("task", map[string]any{"key": "value"})))
+	}
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.NotEmpty(t, tasks[0].LockID)
+	require.Equal(t, tasks[0].LockID, tasks[1].LockID)
+	require.Greater(t, tasks[0].TimeoutDate, time.Now().Add(4*time.Minute).Unix())
+	require.Equal(t, "value", tasks[0].Arguments["key"])
+}
+
+func TestExtendLease(t *testing.T) {
+
+	storage := testSQLite(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("task", nil)))
+
+	tasks, err := storage.GetTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+
+	require.NoError(t, storage.ExtendLease(tasks[0]))
+
+	// A worker that doesn't hold the lock can't extend it
+	stolen := tasks[0]
+	stolen.LockID = "someone-else"
+	require.Error(t, storage.ExtendLease(stolen))
+
+	// Releasing the lock ends the lease
+	require.NoError(t, storage.ReleaseTask(tasks[0].TaskID))
+	require.Error(t, storage.ExtendLease(tasks[0]))
+	require.Error(t, storage.ReleaseTask("missing"))
+}
+
+func TestGetTasksFromQueues(t *testing.T) {
+
+	storage := testSQLite(t, 32)
+	require.NoError(t, storage.SaveTask(queue.NewTask("default", nil)))
+	require.NoError(t, storage.SaveTask(queue.NewTask("transcode", nil, queue.WithQueueName("media"))))
+
+	// An empty list selects nothing
+	tasks, err := storage.GetTasksFromQueues(nil)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	tasks, err = storage.GetTasksFromQueues([]string{"media"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"transcode"}, names(tasks))
+
+	// Tasks from other queues are still available
+	tasks, err = storage.GetTasksFromQueues([]string{""})
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, names(tasks))
+}
+
+func TestLogFailure(t *testing.T) {
+
+	storage := testSQLite(t, 32)
+	task := queue.NewTask("failed", nil)
+	task.TaskID = "failed-task"
+
+	require.NoError(t, storage.LogFailure(task))
+	require.NoError(t, storage.LogFailure(task))
+
+	// Every failure is kept, even for the same task
+	var count int
+	require.NoError(t, storage.database.QueryRow(`SELECT COUNT(*) FROM `+TableLog+` WHERE task_id = 'failed-task'`).Scan(&count))
+	require.Equal(t, 2, count)
+}
+
+// testSQLite returns a Storage backed by a new SQLite database file that is removed after the test
+func testSQLite(t *testing.T, lockQuantity int) Storage {
+
+	database, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "queue.db")+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+
+	// SQLite allows one writer at a time. Several connections are fine, because
+	// the busy_timeout makes writers wait for each other instead of failing.
+	database.SetMaxOpenConns(8)
+
+	t.Cleanup(func() {
+		require.NoError(t, database.Close())
+	})
+
+	storage := New(database, DialectSQLite, lockQuantity, 5)
+	require.NoError(t, storage.Migrate())
+
+	return storage
+}
+
+// names returns the names of the tasks, in order
+func names(tasks []queue.Task) []string {
+
+	result := make([]string, len(tasks))
+	for index, task := range tasks {
+		result[index] = task.Name
+	}
+
+	return result
+}
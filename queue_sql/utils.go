@@ -0,0 +1,21 @@
+package queue_sql
+
+import (
+	"context"
+	"time"
+)
+
+// timeoutContext returns a context that times out after timeoutSeconds seconds
+func timeoutContext(timeoutSeconds int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+}
+
+// nullString returns nil for an empty string, so that it is stored as NULL
+func nullString(value string) any {
+
+	if value == "" {
+		return nil
+	}
+
+	return value
+}